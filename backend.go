@@ -2,11 +2,16 @@ package db2secretengine
 
 import (
 	"context"
+	"fmt"
+	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hashicorp/vault/sdk/queue"
 )
 
 func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend, error) {
@@ -22,16 +27,72 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 // target API's client.
 type db2Backend struct {
 	*framework.Backend
-	lock   sync.RWMutex
-	client *db2Client
+	lock sync.RWMutex
 	//store map[string][]byte
+
+	// clients caches the client of each connection by connection name. A
+	// client replaced or removed from the cache is only closed once every
+	// caller of getClient using it has released it.
+	clients map[string]*db2Client
+
+	// configLock serializes changes to the config, such as rotate-root,
+	// without blocking getClient callers. Role writes hold it from checking
+	// that their connection exists until the role is stored, so that a
+	// connection is never deleted from under a role. It is taken after a
+	// role's lock, never before.
+	configLock sync.Mutex
+
+	// libraryLock serializes changes to library sets, so that a static role
+	// is never added to two sets at once, nor deleted while a set lists it.
+	// It is taken after a role's lock, never before.
+	libraryLock sync.Mutex
+
+	// roleLocks serialize operations on a single static role, so rotations
+	// of different roles run concurrently while two rotations, or a rotation
+	// and a write, of the same role do not interleave.
+	roleLocks []*locksutil.LockEntry
+
+	// credRotationQueue is an in-memory priority queue used to track static
+	// roles that require periodic rotation. Each item is keyed by role name
+	// and prioritized by the role's next rotation time.
+	credRotationQueue *queue.PriorityQueue
+
+	// clientFactory builds the client used to talk to DB2. It defaults to
+	// newClient and is replaced in tests.
+	clientFactory func(config *db2Config) (*db2Client, error)
+
+	// now returns the current time. It defaults to time.Now and is replaced
+	// in tests to drive the rotation schedule.
+	now func() time.Time
+
+	// lastDriftCheck is when the periodic function last checked the static
+	// roles for drift. It is only used by the periodic function.
+	lastDriftCheck time.Time
+
+	// webhookClient and webhookBackoff are used to deliver rotation events.
+	// Deliveries run in the background under webhookCtx, which is cancelled
+	// by clean, and are tracked by webhooks.
+	webhookClient  *http.Client
+	webhookBackoff time.Duration
+	webhookCtx     context.Context
+	webhookCancel  context.CancelFunc
+	webhooks       sync.WaitGroup
 }
 
 // backend defines the target API backend
 // for Vault. It must include each path
 // and the secrets it will store.
 func backend() *db2Backend {
-	var b = db2Backend{}
+	var b = db2Backend{
+		clients:           make(map[string]*db2Client),
+		roleLocks:         locksutil.CreateLocks(),
+		credRotationQueue: queue.New(),
+		clientFactory:     newClient,
+		now:               time.Now,
+		webhookClient:     &http.Client{Timeout: webhookTimeout},
+		webhookBackoff:    webhookRetryBackoff,
+	}
+	b.webhookCtx, b.webhookCancel = context.WithCancel(context.Background())
 
 	b.Backend = &framework.Backend{
 		Help: strings.TrimSpace(backendHelp),
@@ -39,65 +100,170 @@ func backend() *db2Backend {
 			LocalStorage: []string{},
 			SealWrapStorage: []string{
 				"config",
-				"role/*",
+				connectionPath + "*",
+				staticRolePath + "*",
+				framework.WALPrefix + "*",
+				webhookPath + "*",
 			},
 		},
 		Paths: framework.PathAppend(
 			pathRole(&b),
+			pathRoleHistory(&b),
+			pathRotateCredentials(&b),
+			pathWebhooks(&b),
+			pathLibrary(&b),
+			pathJITRole(&b),
+			pathConnections(&b),
 			[]*framework.Path{
 				pathConfig(&b),
+				pathRoleVerify(&b),
+				pathRoleCircuitBreaker(&b),
+				pathStatus(&b),
 				pathCredentials(&b),
-				pathRotateCredentials(&b),
+				pathJITCredentials(&b),
 			},
 		),
-		Secrets: []*framework.Secret{},
-		BackendType: logical.TypeLogical,
-		Invalidate:  b.invalidate,
+		Secrets: []*framework.Secret{
+			b.libraryAccount(),
+			b.jitGrant(),
+		},
+		BackendType:       logical.TypeLogical,
+		Invalidate:        b.invalidate,
+		Clean:             b.clean,
+		InitializeFunc:    b.initialize,
+		PeriodicFunc:      b.periodicFunc,
+		WALRollback:       b.walRollback,
+		WALRollbackMinAge: minStaticWALAge,
 	}
 	return &b
 }
 
-// reset clears any client configuration for a new
-// backend to be configured
-func (b *db2Backend) reset() {
+// roleLock returns the lock guarding the named static role.
+func (b *db2Backend) roleLock(name string) *locksutil.LockEntry {
+	return locksutil.LockForKey(b.roleLocks, name)
+}
+
+// reset clears the client of the named connection so that the next
+// invocation is configured anew, closing the client's pooled connections
+func (b *db2Backend) reset(name string) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
-	b.client = nil
+	b.closeClient(name)
+}
+
+// resetClients clears the clients of every connection.
+func (b *db2Backend) resetClients() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for name := range b.clients {
+		b.closeClient(name)
+	}
+}
+
+// closeClient forgets the client of the named connection and closes it, or
+// leaves it to the last caller still using it to close. The caller must hold
+// b.lock.
+func (b *db2Backend) closeClient(name string) {
+	client, ok := b.clients[name]
+	if !ok {
+		return
+	}
+	delete(b.clients, name)
+
+	client.refsLock.Lock()
+	defer client.refsLock.Unlock()
+	client.retired = true
+	if client.refs == 0 {
+		b.closeRetiredClient(name, client)
+	}
+}
+
+// releaseClient hands back a client returned by getClient, closing it if it
+// has since been removed from the cache and this was its last user.
+func (b *db2Backend) releaseClient(client *db2Client) {
+	client.refsLock.Lock()
+	defer client.refsLock.Unlock()
+	client.refs--
+	if client.refs == 0 && client.retired {
+		b.closeRetiredClient(client.name, client)
+	}
+}
+
+// closeRetiredClient closes a client that is no longer cached or in use.
+func (b *db2Backend) closeRetiredClient(name string, client *db2Client) {
+	if err := client.Close(); err != nil {
+		b.Logger().Warn("unable to close DB2 connections", "connection", name, "error", err)
+	}
+}
+
+// clean stops any webhook deliveries still in progress and closes the DB2
+// connections when the backend is unmounted or Vault shuts down.
+func (b *db2Backend) clean(ctx context.Context) {
+	b.webhookCancel()
+	b.webhooks.Wait()
+	b.resetClients()
 }
 
 // invalidate clears an existing client configuration in
 // the backend
 func (b *db2Backend) invalidate(ctx context.Context, key string) {
-	if key == "config" {
-		b.reset()
+	switch {
+	case key == configStoragePath:
+		b.reset(defaultConnectionName)
+	case strings.HasPrefix(key, connectionPath):
+		b.reset(strings.TrimPrefix(key, connectionPath))
 	}
 }
 
 // getClient locks the backend as it configures and creates a
-// a new client for the target API
-func (b *db2Backend) getClient(ctx context.Context, s logical.Storage) (*db2Client, error) {
+// a new client for the target API on the named connection. The caller must
+// hand the client back with releaseClient once it is done with it.
+func (b *db2Backend) getClient(ctx context.Context, s logical.Storage, name string) (*db2Client, error) {
+	b.lock.RLock()
+	unlockFunc := b.lock.RUnlock
+	defer func() { unlockFunc() }()
 
-	config, err := getConfig(ctx, s)
+	if client, ok := b.clients[name]; ok {
+		client.acquire()
+		return client, nil
+	}
+
+	b.lock.RUnlock()
+	b.lock.Lock()
+	unlockFunc = b.lock.Unlock
+
+	if client, ok := b.clients[name]; ok {
+		client.acquire()
+		return client, nil
+	}
+
+	config, err := getConnectionConfig(ctx, s, name)
 	if err != nil {
 		return nil, err
 	}
 
 	if config == nil {
+		if name != defaultConnectionName {
+			return nil, fmt.Errorf("connection %q does not exist", name)
+		}
 		config = new(db2Config)
 	}
 
-	b.client, err = newClient(config)
+	client, err := b.clientFactory(config)
 	if err != nil {
 		return nil, err
 	}
+	client.name = name
+	b.clients[name] = client
 
-	return b.client, nil
+	client.acquire()
+	return client, nil
 }
 
-
 // backendHelp should contain help information for the backend
 const backendHelp = `
 The DB2 secrets backend provides the ability to rotate passwords of existing DB2 users.
 After mounting this backend, credentials for existing DB2 users 
-must be configured with the "config/" endpoints.
+must be configured with the "config/" endpoints. Further DB2 servers
+can be configured with the "connection/" endpoints.
 `
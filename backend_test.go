@@ -2,12 +2,23 @@ package db2secretengine
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-secure-stdlib/base62"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/stretchr/testify/require"
+
+	"vault-plugin-secrets-hashicups/db2client"
 )
 
 const (
@@ -15,6 +26,8 @@ const (
 	envVarHashiCupsUsername = "TEST_HASHICUPS_USERNAME"
 	envVarHashiCupsPassword = "TEST_HASHICUPS_PASSWORD"
 	envVarHashiCupsURL      = "TEST_HASHICUPS_URL"
+
+	testPasswordPolicy = "testpolicy"
 )
 
 // getTestBackend will help you construct a test backend object.
@@ -25,16 +38,293 @@ func getTestBackend(tb testing.TB) (*db2Backend, logical.Storage) {
 	config := logical.TestBackendConfig()
 	config.StorageView = new(logical.InmemStorage)
 	config.Logger = hclog.NewNullLogger()
-	config.System = logical.TestSystemView()
+	sysView := logical.TestSystemView()
+	sysView.SetPasswordPolicy(testPasswordPolicy, func() (string, error) {
+		return base62.Random(16)
+	})
+	config.System = sysView
 
 	b, err := Factory(context.Background(), config)
 	if err != nil {
 		tb.Fatal(err)
 	}
+	tb.Cleanup(func() { b.Cleanup(context.Background()) })
 
 	return b.(*db2Backend), config.StorageView
 }
 
+// fakeDB2 stands in for a DB2 server. It tracks the password of every
+// user and only accepts a password change when the current password matches.
+type fakeDB2 struct {
+	sync.Mutex
+	passwords map[string]string
+	rotations int
+
+	// statements records every statement run with Exec or ExecStatements
+	statements []string
+
+	// grants holds the authorities granted with Exec, keyed "user:authority"
+	grants map[string]bool
+
+	// execErr, when set, makes Exec fail without running any statement.
+	execErr error
+
+	// externalInput, when set, is where a test external command writes its
+	// input, which the fake applies on the next Verify.
+	externalInput string
+
+	// blocked, when set for a user, makes ChangePassword for that user
+	// report on entered and then wait until the channel is closed.
+	blocked map[string]chan struct{}
+	entered chan string
+
+	// failPhase, when set, makes ChangePassword change the password and then
+	// fail in the named verification phase.
+	failPhase string
+
+	// pingErr, when set, makes Ping fail as if the server were unreachable.
+	pingErr error
+
+	// expired holds the users whose password has expired. Logging in as
+	// them fails, but ChangePassword can still change the password.
+	expired map[string]bool
+
+	// closed counts the calls to Close.
+	closed int
+}
+
+// withFakeDB2 points the backend at a fake DB2 server.
+func withFakeDB2(b *db2Backend) *fakeDB2 {
+	f := &fakeDB2{
+		passwords: map[string]string{},
+		grants:    map[string]bool{},
+		expired:   map[string]bool{},
+		blocked:   map[string]chan struct{}{},
+		entered:   make(chan string, 1),
+	}
+	b.clientFactory = func(config *db2Config) (*db2Client, error) {
+		return &db2Client{db2Conn: f}, nil
+	}
+	return f
+}
+
+func (f *fakeDB2) ChangePassword(ctx context.Context, info db2client.ConnectionInfo, newPassword string) error {
+	f.Lock()
+	blocked := f.blocked[info.Username]
+	f.Unlock()
+	if blocked != nil {
+		f.entered <- info.Username
+		select {
+		case <-blocked:
+		case <-ctx.Done():
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return &db2client.RotationError{Phase: db2client.PhaseChange, Err: err}
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if f.passwords[info.Username] != info.Password {
+		return &db2client.RotationError{Phase: db2client.PhaseChange, Err: fakeSecurityError(24, "USERNAME AND/OR PASSWORD INVALID")}
+	}
+	if f.failPhase == db2client.PhaseChange {
+		return &db2client.RotationError{Phase: f.failPhase, Err: errors.New("connection reset")}
+	}
+	f.passwords[info.Username] = newPassword
+	delete(f.expired, info.Username)
+	if f.failPhase != "" {
+		return &db2client.RotationError{Phase: f.failPhase, Err: errors.New("verification failed")}
+	}
+	f.rotations++
+	return nil
+}
+
+func (f *fakeDB2) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	f.closed++
+	return nil
+}
+
+func (f *fakeDB2) Ping(ctx context.Context, hostname, port string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	return f.pingErr
+}
+
+func (f *fakeDB2) Verify(ctx context.Context, info db2client.ConnectionInfo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.applyExternalCommand()
+	if f.passwords[info.Username] != info.Password {
+		return fakeSecurityError(24, "USERNAME AND/OR PASSWORD INVALID")
+	}
+	if f.expired[info.Username] {
+		return fakeSecurityError(1, "PASSWORD EXPIRED")
+	}
+	return nil
+}
+
+// fakeSecurityError is the error DB2 reports when it refuses a login.
+func fakeSecurityError(reason int, text string) error {
+	return db2client.Classify(fmt.Errorf("SQL30082N  Security processing failed with reason \"%d\" (\"%s\").  SQLSTATE=08001", reason, text))
+}
+
+// fakeSetPassword sets the password of a user, like a site's own password
+// management procedure would.
+var fakeSetPassword = regexp.MustCompile(`^CALL SYSPROC.SET_PASSWORD\('((?:[^']|'')*)', '((?:[^']|'')*)'\)$`)
+
+// fakeGrant and fakeRevoke grant and revoke a database authority.
+var (
+	fakeGrant  = regexp.MustCompile(`^GRANT (\w+) ON DATABASE TO USER (\w+)$`)
+	fakeRevoke = regexp.MustCompile(`^REVOKE (\w+) ON DATABASE FROM USER (\w+)$`)
+)
+
+func (f *fakeDB2) ExecStatements(ctx context.Context, info db2client.ConnectionInfo, statements []string) error {
+	if err := f.Exec(ctx, info, statements); err != nil {
+		return &db2client.RotationError{Phase: db2client.PhaseChange, Err: err}
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	f.rotations++
+	return nil
+}
+
+// Exec understands fakeSetPassword, fakeGrant and fakeRevoke, and applies
+// either all statements or none.
+func (f *fakeDB2) Exec(ctx context.Context, info db2client.ConnectionInfo, statements []string) error {
+	if err := f.Verify(ctx, info); err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if f.execErr != nil {
+		return db2client.Classify(f.execErr)
+	}
+	f.statements = append(f.statements, statements...)
+
+	passwords := map[string]string{}
+	grants := map[string]bool{}
+	for k, v := range f.grants {
+		grants[k] = v
+	}
+	for i, statement := range statements {
+		if m := fakeSetPassword.FindStringSubmatch(statement); m != nil {
+			passwords[strings.ReplaceAll(m[1], "''", "'")] = strings.ReplaceAll(m[2], "''", "'")
+		} else if m := fakeGrant.FindStringSubmatch(statement); m != nil {
+			grants[m[2]+":"+m[1]] = true
+		} else if m := fakeRevoke.FindStringSubmatch(statement); m != nil {
+			if !grants[m[2]+":"+m[1]] {
+				return fmt.Errorf("statement %d: %w", i+1, db2client.Classify(fmt.Errorf("SQL0556N An attempt to revoke a privilege, security label, exemption, or role from %q was denied because %q does not hold this privilege", m[2], m[2])))
+			}
+			delete(grants, m[2]+":"+m[1])
+		} else {
+			return fmt.Errorf("statement %d: %w", i+1, db2client.Classify(fmt.Errorf("SQL0104N An unexpected token was found: %q", statement)))
+		}
+	}
+
+	for k, v := range passwords {
+		f.passwords[k] = v
+	}
+	f.grants = grants
+	return nil
+}
+
+// applyExternalCommand adopts the password change an external command test
+// script left in externalInput, as if it had changed the password in DB2.
+func (f *fakeDB2) applyExternalCommand() {
+	if f.externalInput == "" {
+		return
+	}
+	raw, err := ioutil.ReadFile(f.externalInput)
+	if err != nil {
+		return
+	}
+	os.Remove(f.externalInput)
+
+	var input externalCommandInput
+	if err := json.Unmarshal(raw, &input); err == nil && f.passwords[input.Username] == input.OldPassword {
+		f.passwords[input.Username] = input.NewPassword
+	}
+}
+
+// granted reports whether user holds authority.
+func (f *fakeDB2) granted(user, authority string) bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.grants[user+":"+authority]
+}
+
+func (f *fakeDB2) VerifyRotation(ctx context.Context, info db2client.ConnectionInfo, newPassword string) error {
+	newInfo := info
+	newInfo.Password = newPassword
+	if err := f.Verify(ctx, newInfo); err != nil {
+		return &db2client.RotationError{Phase: db2client.PhaseVerifyNew, Err: err}
+	}
+	err := f.Verify(ctx, info)
+	switch {
+	case errors.Is(err, db2client.ErrInvalidCredentials):
+		return nil
+	case err == nil || errors.Is(err, db2client.ErrPasswordExpired):
+		return &db2client.RotationError{Phase: db2client.PhaseVerifyOldFails, Err: errors.New("old password still authenticates")}
+	}
+	return &db2client.RotationError{Phase: db2client.PhaseVerifyOldFails, Err: err}
+}
+
+func (f *fakeDB2) password(username string) string {
+	f.Lock()
+	defer f.Unlock()
+	return f.passwords[username]
+}
+
+// setExpired marks the password of a user as expired or not.
+func (f *fakeDB2) setExpired(username string, expired bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.expired[username] = expired
+}
+
+func (f *fakeDB2) setPassword(username, password string) {
+	f.Lock()
+	defer f.Unlock()
+	f.passwords[username] = password
+}
+
+// testClock is a manually advanced clock used to drive the rotation schedule.
+type testClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+// withTestClock replaces the backend clock with one that only moves when the
+// test advances it.
+func withTestClock(b *db2Backend) *testClock {
+	c := &testClock{now: time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)}
+	b.now = c.Now
+	return c
+}
+
+func (c *testClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
+
 // runAcceptanceTests will separate unit tests from
 // acceptance tests, which will make active requests
 // to your target API.
@@ -120,23 +410,3 @@ func (e *testEnv) ReadUserToken(t *testing.T) {
 		e.SecretToken = t.(string)
 	}
 }
-
-// CleanupUserTokens removes the tokens
-// when the test completes.
-func (e *testEnv) CleanupUserTokens(t *testing.T) {
-	if len(e.Tokens) == 0 {
-		t.Fatalf("expected 2 tokens, got: %d", len(e.Tokens))
-	}
-
-	for _, token := range e.Tokens {
-		b := e.Backend.(*db2Backend)
-		client, err := b.getClient(e.Context, e.Storage)
-		if err != nil {
-			t.Fatal("fatal getting db2client")
-		}
-		client.Client.Token = string(token)
-		if err := client.SignOut(); err != nil {
-			t.Fatalf("unexpected error deleting user token: %s", err)
-		}
-	}
-}
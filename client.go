@@ -1,28 +1,174 @@
 package db2secretengine
 
 import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
 
 	"vault-plugin-secrets-hashicups/db2client"
 )
 
+// db2ErrorHint returns what an operator can do about a DB2 error, or "" if
+// the error is not one the backend recognizes.
+func db2ErrorHint(err error) string {
+	switch {
+	case errors.Is(err, db2client.ErrInvalidCredentials):
+		return "DB2 rejected the username or password; if a role's password was changed outside Vault, write it to the role's current_password"
+	case errors.Is(err, db2client.ErrPasswordExpired):
+		return "the password has expired; rotating the role with the newpwd rotation mechanism replaces it"
+	case errors.Is(err, db2client.ErrAccountLocked):
+		return "the DB2 account is locked, disabled or revoked and must be unlocked in DB2 or the operating system"
+	case errors.Is(err, db2client.ErrNewPasswordInvalid):
+		return "DB2 rejected the generated password; make the password_policy match the DB2 password rules"
+	case errors.Is(err, db2client.ErrDatabaseNotFound):
+		return "check the database name of the role or config"
+	case errors.Is(err, db2client.ErrConnection):
+		return "check the hostname and port in the config and that the DB2 server is reachable from Vault"
+	}
+	return ""
+}
+
+// describeDB2Error returns the error message followed by its hint, if any.
+func describeDB2Error(err error) string {
+	if hint := db2ErrorHint(err); hint != "" {
+		return err.Error() + " (" + hint + ")"
+	}
+	return err.Error()
+}
+
+// db2Conn describes the DB2 operations the backend relies on.
+// It is satisfied by *db2client.Client. Every operation is aborted when its
+// context is cancelled, such as when the Vault request that started it is.
+type db2Conn interface {
+	ChangePassword(ctx context.Context, info db2client.ConnectionInfo, newPassword string) error
+	Verify(ctx context.Context, info db2client.ConnectionInfo) error
+	VerifyRotation(ctx context.Context, info db2client.ConnectionInfo, newPassword string) error
+	ExecStatements(ctx context.Context, info db2client.ConnectionInfo, statements []string) error
+	Exec(ctx context.Context, info db2client.ConnectionInfo, statements []string) error
+	Ping(ctx context.Context, hostname, port string) error
+	Close() error
+}
+
 // Db2Client creates an object storing
 // the client.
 type db2Client struct {
-	*db2client.Client
+	db2Conn
+
+	// caFile is the private copy of the config's tls_ca_pem handed to the
+	// driver, removed when the client is closed.
+	caFile string
+
+	// name is the connection the client is cached for. refs counts the
+	// callers of getClient still using the client, and retired is set once
+	// it has been removed from the cache, so that the last of them closes
+	// it rather than fail their operations with a closed client.
+	name     string
+	refsLock sync.Mutex
+	refs     int
+	retired  bool
+}
+
+// acquire records another user of the client.
+func (c *db2Client) acquire() {
+	c.refsLock.Lock()
+	defer c.refsLock.Unlock()
+	c.refs++
 }
 
-// newClient creates a new client to access HashiCups
-// and exposes it for any secrets or roles to use.
+// newClient creates a new client to access DB2 with the timeouts, pool
+// sizes and TLS settings in config and exposes it for any secrets or roles
+// to use.
 func newClient(config *db2Config) (*db2Client, error) {
 	if config == nil {
 		return nil, errors.New("client configuration was nil")
 	}
 
-	c, err := db2client.NewClient(&config.Hostname, &config.Port)
+	clientConfig := db2client.Config{
+		ConnectTimeout:        config.ConnectTimeout,
+		StatementTimeout:      config.StatementTimeout,
+		MaxOpenConnections:    config.MaxOpenConnections,
+		MaxIdleConnections:    config.MaxIdleConnections,
+		MaxConnectionLifetime: config.MaxConnectionLifetime,
+	}
+
+	var caFile string
+	if config.TLSEnabled {
+		clientConfig.TLS = &db2client.TLSConfig{HostnameValidation: config.TLSServerHostname != ""}
+		if config.TLSCAPEM != "" {
+			var err error
+			caFile, err = writeCAFile(config.TLSCAPEM)
+			if err != nil {
+				return nil, err
+			}
+			clientConfig.TLS.CAFile = caFile
+		}
+	}
+
+	return &db2Client{db2Conn: db2client.NewClient(clientConfig), caFile: caFile}, nil
+}
+
+// Close closes the client's connections and removes its CA file.
+func (c *db2Client) Close() error {
+	err := c.db2Conn.Close()
+	if c.caFile != "" {
+		if removeErr := os.Remove(c.caFile); err == nil && !os.IsNotExist(removeErr) {
+			err = removeErr
+		}
+	}
+	return err
+}
+
+// writeCAFile writes caPEM to a new temporary file readable only by Vault,
+// as the driver only reads certificates from files, and returns its path.
+func writeCAFile(caPEM string) (string, error) {
+	f, err := ioutil.TempFile("", "vault-db2-ca-*.pem")
+	if err != nil {
+		return "", fmt.Errorf("unable to create the CA file: %w", err)
+	}
+	if err := f.Chmod(0600); err == nil {
+		_, err = f.WriteString(caPEM)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		return nil, err
+		os.Remove(f.Name())
+		return "", fmt.Errorf("unable to write the CA file: %w", err)
 	}
-	return &db2Client{c}, nil
+	return f.Name(), nil
+}
 
+// parseCACertificates parses the certificates in caPEM, which must hold at
+// least one certificate and nothing else, such as a private key.
+func parseCACertificates(caPEM string) ([]*x509.Certificate, error) {
+	var certificates []*x509.Certificate
+	rest := []byte(caPEM)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("found a %s block, only certificates are allowed", block.Type)
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("certificate %d: %w", len(certificates)+1, err)
+		}
+		certificates = append(certificates, certificate)
+	}
+	if strings.TrimSpace(string(rest)) != "" {
+		return nil, errors.New("found data that is not PEM encoded")
+	}
+	if len(certificates) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certificates, nil
 }
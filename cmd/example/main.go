@@ -1,30 +1,35 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+
 	client "vault-plugin-secrets-hashicups/db2client"
 )
 
 func main() {
-
-
-	hostname := "10.0.2.2"
-	port := "50000"
-
-	result := client.Createconnection(hostname, port, "dojo","moayad", "T5SEEDfd", "vCu5RYrR")
-	if result != nil {
-		fmt.Println("Pass")
-	} else {
-		fmt.Println("Fail")
+	ctx := context.Background()
+
+	info := client.ConnectionInfo{
+		Hostname: "10.0.2.2",
+		Port:     "50000",
+		Database: "dojo",
+		Username: "moayad",
+		Password: "T5SEEDfd",
 	}
 
-	db2client, _ := client.NewClient(&hostname, &port)
-	//db2client := new(client.Client)
-
-
-	//db2client.UpdatePassword(hostname, port, "dojo","moayad", "vCu5RYrb", "vCu5RYrR")
-	db2client.UpdatePassword(hostname, port, "dojo","moayad", "T5SEEDfd", "vCu5RYrD")
+	db2client := client.NewClient(client.Config{})
+	defer db2client.Close()
 
+	if err := db2client.Verify(ctx, info); err != nil {
+		fmt.Println("Fail:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Pass")
 
+	if err := db2client.ChangePassword(ctx, info, "vCu5RYrD"); err != nil {
+		fmt.Println("Fail:", err)
+		os.Exit(1)
+	}
 }
-
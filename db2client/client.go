@@ -1,91 +1,499 @@
 package db2client
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
-	//"time"
-	//"fmt"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
 
 	_ "github.com/ibmdb/go_ibm_db"
 )
 
-func NewClient(host, port *string) (*Client,error) {
-	var c = Client{
-		Hostname: *host,
-		Port:     *port,
-	}
-	return &c, nil
+const (
+	// driverName is the database/sql driver registered by go_ibm_db.
+	driverName = "go_ibm_db"
+
+	// probeStatement is a harmless query used to prove a connection is usable.
+	probeStatement = "SELECT 1 FROM SYSIBM.SYSDUMMY1"
+
+	// DefaultConnectTimeout, DefaultStatementTimeout and
+	// DefaultMaxOpenConnections are used when a Config does not set its own.
+	DefaultConnectTimeout     = 15 * time.Second
+	DefaultStatementTimeout   = 60 * time.Second
+	DefaultMaxOpenConnections = 4
+)
+
+// ErrClientClosed is returned by operations on a Client after Close.
+var ErrClientClosed = errors.New("db2 client is closed")
+
+// Phases of a password rotation, reported in a RotationError.
+const (
+	PhaseChange         = "change"
+	PhaseVerifyNew      = "verify new password"
+	PhaseVerifyOldFails = "verify old password is rejected"
+)
+
+// RotationError reports the phase in which a password rotation failed.
+type RotationError struct {
+	Phase string
+	Err   error
 }
 
+func (e *RotationError) Error() string {
+	return fmt.Sprintf("password rotation failed during %s: %v", e.Phase, e.Err)
+}
+
+func (e *RotationError) Unwrap() error {
+	return e.Err
+}
+
+// ConnectionInfo identifies a DB2 database and the user to log in to it as.
+// Attributes are further CLI keywords, such as CurrentSchema, added to the
+// connection string; see ValidateAttributes.
+type ConnectionInfo struct {
+	Hostname   string
+	Port       string
+	Database   string
+	Username   string
+	Password   string
+	Attributes map[string]string
+}
+
+// Config holds the timeouts and pool sizes of a Client. Zero values mean
+// the package defaults.
+type Config struct {
+	// ConnectTimeout limits how long opening a connection may take and
+	// StatementTimeout how long each statement may run.
+	ConnectTimeout   time.Duration
+	StatementTimeout time.Duration
+
+	// MaxOpenConnections, MaxIdleConnections and MaxConnectionLifetime size
+	// the pools Exec keeps. MaxIdleConnections defaults to
+	// MaxOpenConnections and a zero MaxConnectionLifetime keeps connections
+	// open for as long as they are usable.
+	MaxOpenConnections    int
+	MaxIdleConnections    int
+	MaxConnectionLifetime time.Duration
+
+	// TLS, when set, encrypts every connection.
+	TLS *TLSConfig
+}
+
+// TLSConfig configures encrypted connections to DB2.
+type TLSConfig struct {
+	// CAFile is a PEM file of the certificates the server's certificate
+	// must chain to. When empty the driver's own trust store is used.
+	CAFile string
+
+	// HostnameValidation requires the server's certificate to be issued
+	// for the hostname connected to. Without it, the driver and Ping only
+	// check that the certificate chains to a trusted CA.
+	HostnameValidation bool
+}
+
+// Client opens connections to DB2. Every operation takes a context, and
+// cancelling it aborts the call.
+//
+// Exec and ExecStatements run on a pool of connections kept per database and
+// user, which stays open until Close or until the user's password changes. Every other operation logs in afresh,
+// as proving a password requires, and closes its connection before it
+// returns.
 type Client struct {
-	Hostname string
-	Port   	 string
-	Database string
-	Username string
-	Password string
-	ConnectionString string
-	RotateStatement  string
+	config Config
+
+	lock   sync.Mutex
+	pools  map[string]*pool
+	closed bool
+}
+
+// pool is the connection pool of a database and user, opened with
+// connectionString.
+type pool struct {
+	db               *sql.DB
+	connectionString string
+}
+
+// NewClient returns a client using config.
+func NewClient(config Config) *Client {
+	return &Client{
+		config: config,
+		pools:  map[string]*pool{},
+	}
+}
+
+func (c *Client) connectTimeout() time.Duration {
+	if c.config.ConnectTimeout == 0 {
+		return DefaultConnectTimeout
+	}
+	return c.config.ConnectTimeout
+}
+
+func (c *Client) statementTimeout() time.Duration {
+	if c.config.StatementTimeout == 0 {
+		return DefaultStatementTimeout
+	}
+	return c.config.StatementTimeout
+}
+
+// Close closes every pooled connection. Operations started afterwards fail
+// with ErrClientClosed; statements already running are waited for.
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var err error
+	for key, p := range c.pools {
+		if closeErr := p.db.Close(); err == nil {
+			err = closeErr
+		}
+		delete(c.pools, key)
+	}
+	c.closed = true
+	return err
 }
 
+func (c *Client) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
 
-func (c *Client) UpdatePassword(hostname, port, database, username, currentpassword, newpassword string) (error) {
+// poolKey identifies the pool for info by everything but the password, so
+// that a password change replaces the user's pool rather than adding one.
+func (c *Client) poolKey(info ConnectionInfo) (string, error) {
+	info.Password = ""
+	return c.connectionString(info, "")
+}
 
-	//connectionString := "HOSTNAME=" + hostname + ";PORT=" + port + ";DATABASE=" + database + ";UID=" + username + ";PWD=" + currentpassword
-	rotateStatement := "HOSTNAME=" + hostname + ";PORT=" + port + ";DATABASE=" + database + ";UID=" + username + ";PWD=" + currentpassword + ";NEWPWD=" + newpassword
+// pool returns the connection pool for info, opening it if needed. A pool
+// opened with another password is closed, as that password no longer works.
+func (c *Client) pool(info ConnectionInfo) (*sql.DB, error) {
+	key, err := c.poolKey(info)
+	if err != nil {
+		return nil, err
+	}
+	connectionString, err := c.connectionString(info, "")
+	if err != nil {
+		return nil, err
+	}
 
-	println(rotateStatement)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+	if p, ok := c.pools[key]; ok {
+		if p.connectionString == connectionString {
+			return p.db, nil
+		}
+		// Close waits for statements still running on the old pool
+		go p.db.Close()
+		delete(c.pools, key)
+	}
 
-	//Connect and change the password, with the NEWPWD parameter
-	db, err := sql.Open("go_ibm_db", rotateStatement)
-	db.Exec("DROP table rocket")
-	_, err = db.Exec("create table rocket(a int)")
+	db, err := sql.Open(driverName, connectionString)
 	if err != nil {
-		println("error dropping table")
+		return nil, Classify(err)
+	}
+	maxOpen := c.config.MaxOpenConnections
+	if maxOpen == 0 {
+		maxOpen = DefaultMaxOpenConnections
+	}
+	maxIdle := c.config.MaxIdleConnections
+	if maxIdle == 0 || maxIdle > maxOpen {
+		maxIdle = maxOpen
+	}
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxLifetime(c.config.MaxConnectionLifetime)
+
+	c.pools[key] = &pool{db: db, connectionString: connectionString}
+	return db, nil
+}
+
+// Conn is an open connection to DB2 as a single user. It must be closed.
+type Conn struct {
+	// db is the single-connection database the connection was opened with,
+	// or nil when the connection belongs to a pool.
+	db               *sql.DB
+	conn             *sql.Conn
+	statementTimeout time.Duration
+}
+
+// Connect logs in to DB2 as described by info.
+func (c *Client) Connect(ctx context.Context, info ConnectionInfo) (*Conn, error) {
+	connectionString, err := c.connectionString(info, "")
+	if err != nil {
+		return nil, err
+	}
+	return c.connect(ctx, connectionString)
+}
+
+func (c *Client) connect(ctx context.Context, connectionString string) (*Conn, error) {
+	if c.isClosed() {
+		return nil, ErrClientClosed
+	}
+
+	db, err := sql.Open(driverName, connectionString)
+	if err != nil {
+		return nil, Classify(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	conn, err := c.conn(ctx, db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	conn.db = db
+	return conn, nil
+}
+
+// conn takes a connection from db within the connect timeout.
+func (c *Client) conn(ctx context.Context, db *sql.DB) (*Conn, error) {
+	connectCtx, cancel := context.WithTimeout(ctx, c.connectTimeout())
+	defer cancel()
+	conn, err := db.Conn(connectCtx)
+	if err != nil {
+		return nil, contextError(ctx, connectCtx, err, c.connectTimeout())
+	}
+	return &Conn{conn: conn, statementTimeout: c.statementTimeout()}, nil
+}
+
+// Close closes the connection, or returns it to its pool.
+func (c *Conn) Close() error {
+	err := c.conn.Close()
+	if c.db == nil {
 		return err
-	} else {
-		println("success creating and dropping table")
 	}
-	db.Close()
+	if dbErr := c.db.Close(); err == nil {
+		err = dbErr
+	}
 	return err
+}
 
+// Ping runs a harmless probe query to prove that the connection is usable.
+func (c *Conn) Ping(ctx context.Context) error {
+	statementCtx, cancel := context.WithTimeout(ctx, c.statementTimeout)
+	defer cancel()
 
-	//start another connect with the old password, using con
-	//this should return an error since it shouldn't  be able to connect.
+	var result int
+	if err := c.conn.QueryRowContext(statementCtx, probeStatement).Scan(&result); err != nil {
+		return contextError(ctx, statementCtx, err, c.statementTimeout)
+	}
+	return nil
+}
 
-	//db1, err := sql.Open("go_ibm_db", rotateStatement)
-	//db1.Exec("DROP table rocket")
-	//_, err = db1.Exec("create table rocket(a int)")
-	//if err != nil {
-	//	println("error dropping table")
-	//} else {
-	//	println("success creating and dropping table")
-	//}
-	//db1.Close()
+// Exec runs statements in a single transaction. Either every statement
+// takes effect or none does.
+func (c *Conn) Exec(ctx context.Context, statements []string) error {
+	tx, err := c.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return Classify(err)
+	}
+	for i, statement := range statements {
+		statementCtx, cancel := context.WithTimeout(ctx, c.statementTimeout)
+		_, err := tx.ExecContext(statementCtx, statement)
+		if err != nil {
+			err = contextError(ctx, statementCtx, err, c.statementTimeout)
+		}
+		cancel()
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("statement %d: %w", i+1, err)
+		}
+	}
+	return Classify(tx.Commit())
 }
 
-func TestConnect(hostname, port, database, username, currentpassword, newpassword string) error {
+// contextError returns err classified, unless it was caused by ctx being
+// cancelled, in which case ctx's error is returned, or by the operation
+// timing out after timeout.
+func contextError(ctx, opCtx context.Context, err error, timeout time.Duration) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if errors.Is(opCtx.Err(), context.DeadlineExceeded) {
+		return &Error{Kind: ErrConnection, Err: fmt.Errorf("timed out after %s: %w", timeout, err)}
+	}
+	return Classify(err)
+}
+
+// Ping checks that the DB2 server accepts TCP connections on hostname and
+// port and, when the client uses TLS, that it presents a certificate the
+// client trusts. It does not authenticate.
+func (c *Client) Ping(ctx context.Context, hostname, port string) error {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
 
-	connectionString := "HOSTNAME=" + hostname + ";PORT=" + port + ";DATABASE=" + database + ";UID=" + username + ";PWD=" + currentpassword
-	//rotateStatement := "HOSTNAME=" + hostname + ";PORT=" + port + ";DATABASE=" + database + ";UID=" + username + ";PWD=" + currentpassword + ";NEWPWD=" + newpassword
+	ctx, cancel := context.WithTimeout(ctx, c.connectTimeout())
+	defer cancel()
 
-	println(connectionString)
+	var dialer interface {
+		DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	} = &net.Dialer{}
+	if c.config.TLS != nil {
+		tlsConfig, err := c.config.TLS.clientConfig(hostname)
+		if err != nil {
+			return err
+		}
+		dialer = &tls.Dialer{Config: tlsConfig}
+	}
 
-	//Connect and change the password, with the NEWPWD parameter
-	db, err := sql.Open("go_ibm_db", connectionString)
-	_,err =  db.Exec("DROP table rocket")
-	_,err = db.Exec("create table rocket(a int)")
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(hostname, port))
 	if err != nil {
-		println("error dropping table")
+		if ctx.Err() != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return ctx.Err()
+		}
+		return &Error{Kind: ErrConnection, Err: err}
+	}
+	return conn.Close()
+}
+
+// clientConfig returns the crypto/tls settings matching t, for checking the
+// certificate of the server at hostname the way the driver does.
+func (t *TLSConfig) clientConfig(hostname string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: hostname}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the CA file: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in the CA file %s", t.CAFile)
+		}
+	}
+	if !t.HostnameValidation {
+		// only the chain is checked, by verifyChain rather than crypto/tls
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = verifyChain(config.RootCAs)
+	}
+	return config, nil
+}
+
+// verifyChain returns a tls.Config VerifyPeerCertificate function checking
+// that the server's certificate chains to roots, or to the system roots when
+// roots is nil, whatever name it is issued for.
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("the server presented no certificate")
+		}
+		intermediates := x509.NewCertPool()
+		var leaf *x509.Certificate
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			if i == 0 {
+				leaf = cert
+			} else {
+				intermediates.AddCert(cert)
+			}
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
 		return err
-	} else {
-		println("success creating and dropping table")
 	}
-	db.Close()
-	return err
-	
 }
 
-func Createconnection(hostname, port, database, username, currentpassword, newpassword string) (db *sql.DB) {
-	connectionString := "HOSTNAME=" + hostname + ";PORT=" + port + ";DATABASE=" + database + ";UID=" + username + ";PWD=" + currentpassword
-	db, _ = sql.Open("go_ibm_db", connectionString)
-	return db
+// Verify logs in as described by info and runs a harmless probe query to
+// prove that the password authenticates. Nothing is written to DB2.
+func (c *Client) Verify(ctx context.Context, info ConnectionInfo) error {
+	conn, err := c.Connect(ctx, info)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Ping(ctx)
+}
+
+// ChangePassword changes the password of info's user from info.Password to
+// newPassword with the NEWPWD connection attribute, which also replaces an
+// expired password. It then proves that the new password authenticates and
+// the old one no longer does. A *RotationError is returned naming the phase
+// that failed.
+func (c *Client) ChangePassword(ctx context.Context, info ConnectionInfo, newPassword string) error {
+	if newPassword == "" {
+		return &RotationError{Phase: PhaseChange, Err: errors.New("the new password is empty")}
+	}
+	connectionString, err := c.connectionString(info, newPassword)
+	if err != nil {
+		return &RotationError{Phase: PhaseChange, Err: err}
+	}
+	conn, err := c.connect(ctx, connectionString)
+	if err != nil {
+		return &RotationError{Phase: PhaseChange, Err: err}
+	}
+	if err := conn.Close(); err != nil {
+		return &RotationError{Phase: PhaseChange, Err: Classify(err)}
+	}
+
+	return c.VerifyRotation(ctx, info, newPassword)
+}
+
+// VerifyRotation proves that newPassword authenticates as info's user and
+// that the old password in info no longer does. A *RotationError is
+// returned naming the phase that failed.
+func (c *Client) VerifyRotation(ctx context.Context, info ConnectionInfo, newPassword string) error {
+	newInfo := info
+	newInfo.Password = newPassword
+	if err := c.Verify(ctx, newInfo); err != nil {
+		return &RotationError{Phase: PhaseVerifyNew, Err: err}
+	}
+
+	// The old password should no longer authenticate.
+	err := c.Verify(ctx, info)
+	if ctx.Err() != nil {
+		return &RotationError{Phase: PhaseVerifyOldFails, Err: ctx.Err()}
+	}
+	return oldPasswordRejected(err)
+}
+
+// oldPasswordRejected returns nil if err, from logging in with the old
+// password, shows that DB2 rejects it. An expired password is still accepted
+// as the user's password, and any other failure, such as a dropped
+// connection, proves nothing.
+func oldPasswordRejected(err error) error {
+	switch {
+	case errors.Is(err, ErrInvalidCredentials):
+		return nil
+	case err == nil || errors.Is(err, ErrPasswordExpired):
+		return &RotationError{Phase: PhaseVerifyOldFails, Err: errors.New("old password still authenticates")}
+	}
+	return &RotationError{Phase: PhaseVerifyOldFails, Err: fmt.Errorf("unable to check that the old password is rejected: %w", err)}
+}
+
+// Exec runs statements in a single transaction as info's user, on a
+// connection from the pool for info. Either every statement takes effect or
+// none does.
+func (c *Client) Exec(ctx context.Context, info ConnectionInfo, statements []string) error {
+	db, err := c.pool(info)
+	if err != nil {
+		return err
+	}
+	conn, err := c.conn(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Exec(ctx, statements)
+}
+
+// ExecStatements runs statements like Exec, for sites that change passwords
+// through stored procedures or security plugins rather than NEWPWD. A
+// *RotationError is returned if any statement fails.
+func (c *Client) ExecStatements(ctx context.Context, info ConnectionInfo, statements []string) error {
+	if err := c.Exec(ctx, info, statements); err != nil {
+		return &RotationError{Phase: PhaseChange, Err: err}
+	}
+	return nil
 }
@@ -0,0 +1,196 @@
+package db2client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestPing checks that Ping reports an unreachable server as a connection
+// error, gives up as soon as its context is cancelled and refuses to run
+// once the client is closed.
+func TestPing(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+
+	c := NewClient(Config{ConnectTimeout: time.Second})
+	require.NoError(t, c.Ping(context.Background(), host, port))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, c.Ping(ctx, host, port), context.Canceled)
+
+	listener.Close()
+	require.ErrorIs(t, c.Ping(context.Background(), host, port), ErrConnection)
+
+	require.NoError(t, c.Close())
+	require.ErrorIs(t, c.Ping(context.Background(), host, port), ErrClientClosed)
+}
+
+// TestPing_TLS checks that with TLS, Ping only succeeds against a server
+// whose certificate chains to the CA file and, with hostname validation,
+// names the host connected to.
+func TestPing_TLS(t *testing.T) {
+	caCert, caKey := testCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test DB2 CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	serverCert, serverKey := testCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+	})
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), 0600))
+
+	tests := map[string]struct {
+		tls   *TLSConfig
+		host  string
+		valid bool
+	}{
+		"trusted":                               {&TLSConfig{CAFile: caFile, HostnameValidation: true}, "localhost", true},
+		"wrong hostname":                        {&TLSConfig{CAFile: caFile, HostnameValidation: true}, host, false},
+		"without hostname validation":           {&TLSConfig{CAFile: caFile}, host, true},
+		"untrusted":                             {&TLSConfig{HostnameValidation: true}, "localhost", false},
+		"untrusted without hostname validation": {&TLSConfig{}, host, false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := NewClient(Config{ConnectTimeout: 5 * time.Second, TLS: tt.tls}).Ping(context.Background(), tt.host, port)
+			if tt.valid {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, ErrConnection)
+			}
+		})
+	}
+}
+
+// testCertificate creates a certificate from template, signed by parent or
+// self-signed when parent is nil.
+func testCertificate(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+// TestContextError checks how a failed operation is reported depending on
+// whether its request was cancelled or the operation itself timed out.
+func TestContextError(t *testing.T) {
+	driverErr := errors.New("SQL30081N  A communication error has been detected.  SQLSTATE=08001")
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, contextError(cancelled, cancelled, driverErr, time.Second))
+
+	timedOut, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	err := contextError(context.Background(), timedOut, driverErr, time.Second)
+	require.ErrorIs(t, err, ErrConnection)
+	require.Contains(t, err.Error(), "timed out after 1s")
+
+	err = contextError(context.Background(), context.Background(), driverErr, time.Second)
+	var db2Err *Error
+	require.ErrorAs(t, err, &db2Err)
+	require.Equal(t, -30081, db2Err.SQLCode)
+}
+
+// TestOldPasswordRejected checks that a rotation is only verified when DB2
+// rejects the old password, not when the check fails for another reason.
+func TestOldPasswordRejected(t *testing.T) {
+	require.NoError(t, oldPasswordRejected(&Error{Kind: ErrInvalidCredentials, Err: errors.New("SQL30082N")}))
+
+	for name, err := range map[string]error{
+		"accepted":     nil,
+		"expired":      &Error{Kind: ErrPasswordExpired, Err: errors.New("SQL30082N")},
+		"connection":   &Error{Kind: ErrConnection, Err: errors.New("SQL30081N")},
+		"locked":       &Error{Kind: ErrAccountLocked, Err: errors.New("SQL30082N")},
+		"closed":       ErrClientClosed,
+		"unclassified": errors.New("driver failure"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			var rotationErr *RotationError
+			require.ErrorAs(t, oldPasswordRejected(err), &rotationErr)
+			require.Equal(t, PhaseVerifyOldFails, rotationErr.Phase)
+		})
+	}
+}
+
+// TestPool checks that Exec keeps one pool per database and user, and that
+// a password change replaces the user's pool instead of adding another.
+func TestPool(t *testing.T) {
+	c := NewClient(Config{})
+	defer c.Close()
+
+	info := ConnectionInfo{Hostname: "localhost", Port: "50000", Database: "sample", Username: "db2admin", Password: "old"}
+	first, err := c.pool(info)
+	require.NoError(t, err)
+	again, err := c.pool(info)
+	require.NoError(t, err)
+	require.Same(t, first, again)
+
+	other := info
+	other.Username = "db2inst1"
+	_, err = c.pool(other)
+	require.NoError(t, err)
+	require.Len(t, c.pools, 2)
+
+	info.Password = "new"
+	rotated, err := c.pool(info)
+	require.NoError(t, err)
+	require.NotSame(t, first, rotated)
+	require.Len(t, c.pools, 2)
+	for key := range c.pools {
+		require.NotContains(t, key, "old")
+		require.NotContains(t, key, "new")
+	}
+}
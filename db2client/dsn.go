@@ -0,0 +1,128 @@
+package db2client
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// reservedKeys are the connection string keywords set from ConnectionInfo
+// and Config, which connection attributes may not override.
+var reservedKeys = map[string]bool{
+	"DSN":                         true,
+	"PROTOCOL":                    true,
+	"HOSTNAME":                    true,
+	"PORT":                        true,
+	"DATABASE":                    true,
+	"UID":                         true,
+	"PWD":                         true,
+	"NEWPWD":                      true,
+	"CONNECTTIMEOUT":              true,
+	"SECURITY":                    true,
+	"SSLSERVERCERTIFICATE":        true,
+	"SSLCLIENTHOSTNAMEVALIDATION": true,
+}
+
+var keyPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// ValidateAttributes checks that attributes can be added to a connection
+// string: every key is a plain keyword that is not reserved and appears
+// once, ignoring case, and no value contains a NUL character.
+func ValidateAttributes(attributes map[string]string) error {
+	seen := map[string]bool{}
+	for key, value := range attributes {
+		if !keyPattern.MatchString(key) {
+			return fmt.Errorf("invalid connection attribute %q: keys may only contain letters, digits and underscores", key)
+		}
+		upper := strings.ToUpper(key)
+		if reservedKeys[upper] {
+			return fmt.Errorf("connection attribute %q is reserved", key)
+		}
+		if seen[upper] {
+			return fmt.Errorf("connection attribute %q is set more than once", key)
+		}
+		seen[upper] = true
+		if strings.ContainsRune(value, 0) {
+			return fmt.Errorf("connection attribute %q contains a NUL character", key)
+		}
+	}
+	return nil
+}
+
+// dsnBuilder builds a DB2 CLI connection string of KEY=value pairs.
+type dsnBuilder struct {
+	b   strings.Builder
+	err error
+}
+
+// add appends key with value, quoting the value if needed. Values holding a
+// NUL character, which would cut the string short, are refused.
+func (d *dsnBuilder) add(key, value string) {
+	if strings.ContainsRune(value, 0) {
+		if d.err == nil {
+			d.err = fmt.Errorf("value of %s contains a NUL character", key)
+		}
+		return
+	}
+	d.b.WriteString(key)
+	d.b.WriteByte('=')
+	d.b.WriteString(quoteValue(value))
+	d.b.WriteByte(';')
+}
+
+func (d *dsnBuilder) String() (string, error) {
+	return d.b.String(), d.err
+}
+
+// quoteValue returns value as it must appear in a connection string. Values
+// that hold a separator, a brace or surrounding blanks are enclosed in braces,
+// with closing braces doubled, so that they are read back unchanged and
+// cannot add keywords of their own.
+func quoteValue(value string) string {
+	if !strings.ContainsAny(value, ";={}") && strings.TrimSpace(value) == value {
+		return value
+	}
+	return "{" + strings.ReplaceAll(value, "}", "}}") + "}"
+}
+
+// connectionString returns the CLI connection string for info with the
+// client's connect timeout and TLS settings. newPassword, when set, changes
+// the user's password with the NEWPWD keyword.
+func (c *Client) connectionString(info ConnectionInfo, newPassword string) (string, error) {
+	if err := ValidateAttributes(info.Attributes); err != nil {
+		return "", err
+	}
+
+	var d dsnBuilder
+	d.add("HOSTNAME", info.Hostname)
+	d.add("PORT", info.Port)
+	d.add("DATABASE", info.Database)
+	d.add("UID", info.Username)
+	d.add("PWD", info.Password)
+	if newPassword != "" {
+		d.add("NEWPWD", newPassword)
+	}
+	d.add("CONNECTTIMEOUT", strconv.Itoa(int(c.connectTimeout().Seconds())))
+	if tls := c.config.TLS; tls != nil {
+		d.add("Security", "SSL")
+		if tls.CAFile != "" {
+			d.add("SSLServerCertificate", tls.CAFile)
+		}
+		if tls.HostnameValidation {
+			d.add("SSLClientHostnameValidation", "Basic")
+		}
+	}
+
+	keys := make([]string, 0, len(info.Attributes))
+	for key := range info.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		d.add(key, info.Attributes[key])
+	}
+
+	return d.String()
+}
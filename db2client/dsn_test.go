@@ -0,0 +1,168 @@
+package db2client
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// parseConnectionString reads a connection string the way the CLI driver
+// does: KEY=value pairs separated by semicolons, where a value enclosed in
+// braces runs to the matching closing brace and "}}" stands for "}".
+func parseConnectionString(t *testing.T, s string) map[string]string {
+	t.Helper()
+	attributes := map[string]string{}
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		require.NotEqual(t, -1, eq, "missing = in %q", s)
+		key := strings.ToUpper(s[:eq])
+		s = s[eq+1:]
+
+		var value strings.Builder
+		if strings.HasPrefix(s, "{") {
+			s = s[1:]
+			for {
+				end := strings.IndexByte(s, '}')
+				require.NotEqual(t, -1, end, "unterminated brace in %q", s)
+				value.WriteString(s[:end])
+				if strings.HasPrefix(s[end:], "}}") {
+					value.WriteByte('}')
+					s = s[end+2:]
+					continue
+				}
+				s = s[end+1:]
+				break
+			}
+		} else {
+			end := strings.IndexByte(s, ';')
+			require.NotEqual(t, -1, end, "missing ; in %q", s)
+			value.WriteString(s[:end])
+			s = s[end:]
+		}
+		require.True(t, strings.HasPrefix(s, ";"), "missing ; after %s", key)
+		s = s[1:]
+
+		_, dup := attributes[key]
+		require.False(t, dup, "%s is set twice", key)
+		attributes[key] = value.String()
+	}
+	return attributes
+}
+
+// TestConnectionString checks that passwords and attribute values holding
+// separators and braces are read back unchanged and cannot inject keywords.
+func TestConnectionString(t *testing.T) {
+	hostile := map[string]string{
+		"plain":               "Passw0rd",
+		"semicolon":           "pass;word",
+		"injected keyword":    "x;UID=db2admin;PWD=other",
+		"equals":              "a=b",
+		"opening brace":       "{abc",
+		"closing brace":       "abc}",
+		"braced":              "{abc}",
+		"brace injection":     "a};UID=db2admin;PWD={b",
+		"doubled braces":      "a}}b{{c",
+		"only a brace":        "}",
+		"leading blank":       " pass",
+		"trailing blank":      "pass ",
+		"quotes":              `'"pass"'`,
+		"backslash":           `pa\ss`,
+		"unicode":             "pässwörd;日本",
+		"empty":               "",
+		"keyword lookalike":   "NEWPWD=x",
+		"trailing semicolon":  "pass;",
+		"trailing open brace": "pass{",
+	}
+
+	for name, password := range hostile {
+		t.Run(name, func(t *testing.T) {
+			info := ConnectionInfo{
+				Hostname:   "db2.example.com",
+				Port:       "50000",
+				Database:   "SAMPLE",
+				Username:   "app",
+				Password:   password,
+				Attributes: map[string]string{"CurrentSchema": password},
+			}
+			c := NewClient(Config{ConnectTimeout: 15 * time.Second})
+			s, err := c.connectionString(info, password+"!")
+			require.NoError(t, err)
+
+			require.Equal(t, map[string]string{
+				"HOSTNAME":       "db2.example.com",
+				"PORT":           "50000",
+				"DATABASE":       "SAMPLE",
+				"UID":            "app",
+				"PWD":            password,
+				"NEWPWD":         password + "!",
+				"CONNECTTIMEOUT": "15",
+				"CURRENTSCHEMA":  password,
+			}, parseConnectionString(t, s))
+		})
+	}
+
+	t.Run("Without New Password", func(t *testing.T) {
+		s, err := NewClient(Config{}).connectionString(ConnectionInfo{Username: "app", Password: "x;NEWPWD=y"}, "")
+		require.NoError(t, err)
+		require.NotContains(t, parseConnectionString(t, s), "NEWPWD")
+	})
+
+	t.Run("NUL", func(t *testing.T) {
+		_, err := NewClient(Config{}).connectionString(ConnectionInfo{Username: "app", Password: "pass\x00word"}, "")
+		require.Error(t, err)
+	})
+
+	t.Run("TLS", func(t *testing.T) {
+		c := NewClient(Config{TLS: &TLSConfig{
+			CAFile:             "/tmp/vault db2;ca.pem",
+			HostnameValidation: true,
+		}})
+		s, err := c.connectionString(ConnectionInfo{Hostname: "db2.example.com", Username: "app", Password: "pass"}, "")
+		require.NoError(t, err)
+
+		attributes := parseConnectionString(t, s)
+		require.Equal(t, "SSL", attributes["SECURITY"])
+		require.Equal(t, "/tmp/vault db2;ca.pem", attributes["SSLSERVERCERTIFICATE"])
+		require.Equal(t, "Basic", attributes["SSLCLIENTHOSTNAMEVALIDATION"])
+
+		s, err = NewClient(Config{}).connectionString(ConnectionInfo{Username: "app", Password: "pass"}, "")
+		require.NoError(t, err)
+		require.NotContains(t, parseConnectionString(t, s), "SECURITY")
+	})
+}
+
+// TestValidateAttributes checks which connection attributes are accepted.
+func TestValidateAttributes(t *testing.T) {
+	tests := map[string]struct {
+		attributes map[string]string
+		valid      bool
+	}{
+		"none":            {nil, true},
+		"schema":          {map[string]string{"CurrentSchema": "APP", "Authentication": "SERVER_ENCRYPT"}, true},
+		"hostile value":   {map[string]string{"CurrentSchema": "x;PWD=y"}, true},
+		"reserved":        {map[string]string{"PWD": "x"}, false},
+		"reserved case":   {map[string]string{"Uid": "db2admin"}, false},
+		"connect timeout": {map[string]string{"ConnectTimeout": "5"}, false},
+		"security":        {map[string]string{"Security": "NONE"}, false},
+		"keystore":        {map[string]string{"SSLClientKeystoredb": "/etc/db2/key.kdb"}, true},
+		"duplicate":       {map[string]string{"CurrentSchema": "A", "CURRENTSCHEMA": "B"}, false},
+		"key separator":   {map[string]string{"CurrentSchema;PWD": "x"}, false},
+		"key equals":      {map[string]string{"A=B": "x"}, false},
+		"key brace":       {map[string]string{"{A}": "x"}, false},
+		"empty key":       {map[string]string{"": "x"}, false},
+		"NUL value":       {map[string]string{"CurrentSchema": "A\x00"}, false},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := ValidateAttributes(tt.attributes)
+			if tt.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package db2client
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+)
+
+// Kinds of DB2 error, matched with errors.Is against the errors returned by
+// Client.
+var (
+	ErrInvalidCredentials = errors.New("username or password invalid")
+	ErrPasswordExpired    = errors.New("password expired")
+	ErrAccountLocked      = errors.New("account locked, disabled or revoked")
+	ErrNewPasswordInvalid = errors.New("new password does not meet the password rules")
+	ErrConnection         = errors.New("unable to connect to the DB2 server")
+	ErrDatabaseNotFound   = errors.New("database not found")
+	ErrPrivilegeNotHeld   = errors.New("privilege not held")
+)
+
+var (
+	sqlCodePattern  = regexp.MustCompile(`SQL(\d{4,5})([NWC])\b`)
+	sqlStatePattern = regexp.MustCompile(`SQLSTATE=(\w{5})`)
+	reasonPattern   = regexp.MustCompile(`reason (?:code )?"?(\d+)"?`)
+)
+
+// Error is an error reported by DB2, with the SQLCODE and SQLSTATE parsed
+// from the driver's message. Reason is the reason code of a security
+// failure (SQL30082N). Kind is one of the Err values above, or nil when the
+// error is not one the backend treats specially.
+type Error struct {
+	SQLCode  int
+	SQLState string
+	Reason   int
+	Kind     error
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the kind of the error.
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+// Classify parses the SQLCODE, SQLSTATE and reason code from a driver error
+// and returns it as an *Error. Errors without a SQLCODE or SQLSTATE, and
+// errors that are already classified, are returned unchanged.
+func Classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified *Error
+	if errors.As(err, &classified) {
+		return err
+	}
+
+	msg := err.Error()
+	e := &Error{Err: err}
+	if m := sqlCodePattern.FindStringSubmatch(msg); m != nil {
+		e.SQLCode, _ = strconv.Atoi(m[1])
+		if m[2] == "N" {
+			e.SQLCode = -e.SQLCode
+		}
+	}
+	if m := sqlStatePattern.FindStringSubmatch(msg); m != nil {
+		e.SQLState = m[1]
+	}
+	if e.SQLCode == 0 && e.SQLState == "" {
+		return err
+	}
+	if m := reasonPattern.FindStringSubmatch(msg); m != nil && e.SQLCode == -30082 {
+		e.Reason, _ = strconv.Atoi(m[1])
+	}
+	e.Kind = kind(e)
+	return e
+}
+
+// kind maps a DB2 error to the kind the backend acts on.
+func kind(e *Error) error {
+	switch e.SQLCode {
+	case -30082:
+		// security processing failed, see the reason codes of SQL30082N
+		switch e.Reason {
+		case 1:
+			return ErrPasswordExpired
+		case 2, 3, 5, 6, 24:
+			return ErrInvalidCredentials
+		case 7, 9, 19:
+			return ErrAccountLocked
+		case 16:
+			return ErrNewPasswordInvalid
+		}
+		// Other reasons, such as a processing failure or a resource being
+		// temporarily unavailable, say nothing about the password.
+		return nil
+	case -30081, -1336:
+		// communication error, unknown host
+		return ErrConnection
+	case -1013, -1031, -30061:
+		return ErrDatabaseNotFound
+	case -556:
+		return ErrPrivilegeNotHeld
+	}
+	if len(e.SQLState) == 5 && e.SQLState[:2] == "08" {
+		return ErrConnection
+	}
+	return nil
+}
+
+// IsPrivilegeNotHeld reports whether err is DB2 refusing to revoke a
+// privilege or authority the user does not hold (SQL0556N).
+func IsPrivilegeNotHeld(err error) bool {
+	return errors.Is(err, ErrPrivilegeNotHeld)
+}
@@ -0,0 +1,142 @@
+package db2client
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestClassify checks that driver errors are parsed into the error kinds
+// the backend acts on.
+func TestClassify(t *testing.T) {
+	kinds := []error{
+		ErrInvalidCredentials,
+		ErrPasswordExpired,
+		ErrAccountLocked,
+		ErrNewPasswordInvalid,
+		ErrConnection,
+		ErrDatabaseNotFound,
+		ErrPrivilegeNotHeld,
+	}
+
+	tests := map[string]struct {
+		msg      string
+		sqlCode  int
+		sqlState string
+		reason   int
+		kind     error
+	}{
+		"invalid password": {
+			msg:      `SQLDriverConnect: {08001} [IBM][CLI Driver] SQL30082N  Security processing failed with reason "24" ("USERNAME AND/OR PASSWORD INVALID").  SQLSTATE=08001`,
+			sqlCode:  -30082,
+			sqlState: "08001",
+			reason:   24,
+			kind:     ErrInvalidCredentials,
+		},
+		"expired password": {
+			msg:      `SQLDriverConnect: {08001} [IBM][CLI Driver] SQL30082N  Security processing failed with reason "1" ("PASSWORD EXPIRED").  SQLSTATE=08001`,
+			sqlCode:  -30082,
+			sqlState: "08001",
+			reason:   1,
+			kind:     ErrPasswordExpired,
+		},
+		"revoked user": {
+			msg:      `SQL30082N  Security processing failed with reason "19" ("USERID DISABLED or RESTRICTED").  SQLSTATE=08001`,
+			sqlCode:  -30082,
+			sqlState: "08001",
+			reason:   19,
+			kind:     ErrAccountLocked,
+		},
+		"new password rejected": {
+			msg:      `SQL30082N  Security processing failed with reason "16" ("NEW PASSWORD INVALID").  SQLSTATE=08001`,
+			sqlCode:  -30082,
+			sqlState: "08001",
+			reason:   16,
+			kind:     ErrNewPasswordInvalid,
+		},
+		"security reason 0": {
+			msg:      `SQL30082N  Security processing failed with reason "0" ("NOT SPECIFIED").  SQLSTATE=08001`,
+			sqlCode:  -30082,
+			sqlState: "08001",
+			reason:   0,
+		},
+		"security reason 15": {
+			msg:      `SQL30082N  Security processing failed with reason "15" ("PROCESSING FAILURE").  SQLSTATE=08001`,
+			sqlCode:  -30082,
+			sqlState: "08001",
+			reason:   15,
+		},
+		"security reason 17": {
+			msg:      `SQL30082N  Security processing failed with reason "17" ("UNSUPPORTED FUNCTION").  SQLSTATE=08001`,
+			sqlCode:  -30082,
+			sqlState: "08001",
+			reason:   17,
+		},
+		"security reason 21": {
+			msg:      `SQL30082N  Security processing failed with reason "21" ("RESOURCE TEMPORARILY UNAVAILABLE").  SQLSTATE=08001`,
+			sqlCode:  -30082,
+			sqlState: "08001",
+			reason:   21,
+		},
+		"communication error": {
+			msg:      `SQL30081N  A communication error has been detected. Communication protocol being used: "TCP/IP".  SQLSTATE=08001`,
+			sqlCode:  -30081,
+			sqlState: "08001",
+			kind:     ErrConnection,
+		},
+		"unknown database": {
+			msg:      `SQL1013N  The database alias name or database name "NOPE" could not be found.  SQLSTATE=42705`,
+			sqlCode:  -1013,
+			sqlState: "42705",
+			kind:     ErrDatabaseNotFound,
+		},
+		"connection state only": {
+			msg:      `[IBM][CLI Driver] connection failed.  SQLSTATE=08004`,
+			sqlState: "08004",
+			kind:     ErrConnection,
+		},
+		"privilege not held": {
+			msg:     `SQL0556N  An attempt to revoke a privilege from "APP" was denied because "APP" does not hold this privilege.`,
+			sqlCode: -556,
+			kind:    ErrPrivilegeNotHeld,
+		},
+		"other statement error": {
+			msg:      `SQL0104N  An unexpected token "FOO" was found.  SQLSTATE=42601`,
+			sqlCode:  -104,
+			sqlState: "42601",
+		},
+		"warning": {
+			msg:     `SQL0100W  No row was found for FETCH, UPDATE or DELETE.`,
+			sqlCode: 100,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			driverErr := errors.New(tt.msg)
+			err := Classify(fmt.Errorf("statement 1: %w", driverErr))
+
+			var db2Err *Error
+			require.ErrorAs(t, err, &db2Err)
+			require.Equal(t, tt.sqlCode, db2Err.SQLCode)
+			require.Equal(t, tt.sqlState, db2Err.SQLState)
+			require.Equal(t, tt.reason, db2Err.Reason)
+			require.ErrorIs(t, err, driverErr)
+			for _, kind := range kinds {
+				require.Equal(t, kind == tt.kind, errors.Is(err, kind), kind.Error())
+			}
+
+			// an error that is already classified is left alone
+			wrapped := &RotationError{Phase: PhaseChange, Err: err}
+			require.Same(t, wrapped, Classify(wrapped))
+		})
+	}
+
+	t.Run("Unrecognized", func(t *testing.T) {
+		err := errors.New("sql: database is closed")
+		require.Same(t, err, Classify(err))
+		require.NoError(t, Classify(nil))
+	})
+}
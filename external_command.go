@@ -0,0 +1,248 @@
+package db2secretengine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"vault-plugin-secrets-hashicups/db2client"
+)
+
+const (
+	// defaultExternalCommandTimeout is how long the external command may run
+	// when the config does not set external_command_timeout.
+	defaultExternalCommandTimeout = 30 * time.Second
+
+	// maxExternalCommandOutput is the most the external command may write to
+	// stdout or to stderr.
+	maxExternalCommandOutput = 64 * 1024
+
+	// externalCommandWaitDelay is how long the output of the external
+	// command is still read once it has exited. A process it started in the
+	// background may hold stdout or stderr open for much longer.
+	externalCommandWaitDelay = time.Second
+)
+
+// externalCommandInput is written as JSON to the external command's stdin.
+type externalCommandInput struct {
+	Username    string `json:"username"`
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+	Hostname    string `json:"hostname"`
+	Port        string `json:"port"`
+	Database    string `json:"database"`
+}
+
+// externalCommandOutput is the optional JSON the external command writes to
+// stdout. A command that exits with status 0 and writes nothing succeeded.
+type externalCommandOutput struct {
+	Success *bool  `json:"success"`
+	Error   string `json:"error"`
+}
+
+// limitedBuffer keeps the first limit bytes written to it and records
+// whether more were written. The buffer is not embedded, so that io.Copy
+// cannot bypass Write through bytes.Buffer's ReadFrom.
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	limit    int
+	exceeded bool
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	if room := l.limit - l.buf.Len(); len(p) > room {
+		l.exceeded = true
+		if room > 0 {
+			l.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return l.buf.Write(p)
+}
+
+func (l *limitedBuffer) Bytes() []byte {
+	return l.buf.Bytes()
+}
+
+func (l *limitedBuffer) String() string {
+	return l.buf.String()
+}
+
+// runExternalCommand changes a password by running the config's external
+// command. The passwords are only ever sent on stdin: the command gets no
+// arguments and an empty environment. The command reports failure with a
+// non-zero exit status or with {"success": false, "error": "..."} on stdout.
+//
+// A *db2client.RotationError in PhaseChange is returned when the command
+// reported that it failed. Any other error, such as a timeout, a canceled
+// request or unreadable output, leaves it unknown whether the password
+// changed.
+func runExternalCommand(ctx context.Context, config *db2Config, input *externalCommandInput) error {
+	if config.ExternalCommand == "" {
+		return &db2client.RotationError{
+			Phase: db2client.PhaseChange,
+			Err:   &refusedError{errors.New("the external_command rotation mechanism requires external_command in the config")},
+		}
+	}
+
+	stdin, err := json.Marshal(input)
+	if err != nil {
+		return &db2client.RotationError{Phase: db2client.PhaseChange, Err: &refusedError{err}}
+	}
+
+	timeout := config.ExternalCommandTimeout
+	if timeout == 0 {
+		timeout = defaultExternalCommandTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stdout := &limitedBuffer{limit: maxExternalCommandOutput}
+	stderr := &limitedBuffer{limit: maxExternalCommandOutput}
+
+	cmd := exec.CommandContext(ctx, config.ExternalCommand)
+	cmd.Env = []string{}
+	cmd.Stdin = bytes.NewReader(stdin)
+
+	orphaned, err := runWithOutput(cmd, stdout, stderr)
+	// The command is killed when the context ends, so its exit status says
+	// nothing about whether the password changed.
+	switch ctx.Err() {
+	case nil:
+	case context.DeadlineExceeded:
+		return fmt.Errorf("external command timed out after %s", timeout)
+	default:
+		return fmt.Errorf("external command was interrupted: %w", ctx.Err())
+	}
+	if orphaned {
+		return fmt.Errorf("external command exited but its output was held open for more than %s, likely by a process it left running", externalCommandWaitDelay)
+	}
+	if stdout.exceeded || stderr.exceeded {
+		return fmt.Errorf("external command wrote more than %d bytes of output", maxExternalCommandOutput)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &db2client.RotationError{
+			Phase: db2client.PhaseChange,
+			Err:   &refusedError{fmt.Errorf("external command exited with status %d: %s", exitErr.ExitCode(), commandMessage(input, stdout, stderr))},
+		}
+	}
+	if err != nil {
+		// the command could not be started
+		return &db2client.RotationError{Phase: db2client.PhaseChange, Err: &refusedError{fmt.Errorf("unable to run external command: %w", err)}}
+	}
+
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return nil
+	}
+	var output externalCommandOutput
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil || output.Success == nil {
+		return errors.New(`external command exited with status 0 but its output is not {"success": true|false}`)
+	}
+	if !*output.Success {
+		return &db2client.RotationError{Phase: db2client.PhaseChange, Err: &refusedError{fmt.Errorf("external command failed: %s", redactPasswords(input, output.Error))}}
+	}
+	return nil
+}
+
+// runWithOutput runs cmd, copying its stdout and stderr into the given
+// writers. The output is read for at most externalCommandWaitDelay after cmd
+// exits, so that a process left running with the output open cannot block
+// the rotation; orphaned reports that reading was cut short.
+func runWithOutput(cmd *exec.Cmd, stdout, stderr io.Writer) (orphaned bool, err error) {
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return false, err
+	}
+	defer stdoutR.Close()
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdoutW.Close()
+		return false, err
+	}
+	defer stderrR.Close()
+
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+	err = cmd.Start()
+	// the command has its own copies of the write ends
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		return false, err
+	}
+
+	copied := make(chan struct{}, 2)
+	go func() {
+		io.Copy(stdout, stdoutR)
+		copied <- struct{}{}
+	}()
+	go func() {
+		io.Copy(stderr, stderrR)
+		copied <- struct{}{}
+	}()
+
+	err = cmd.Wait()
+
+	waitDelay := time.NewTimer(externalCommandWaitDelay)
+	defer waitDelay.Stop()
+	for pending := 2; pending > 0; {
+		select {
+		case <-copied:
+			pending--
+		case <-waitDelay.C:
+			orphaned = true
+			stdoutR.Close()
+			stderrR.Close()
+		}
+	}
+	return orphaned, err
+}
+
+// verifyExternalCommand checks that the config's external command is set
+// and is an executable file.
+func verifyExternalCommand(config *db2Config) error {
+	if config.ExternalCommand == "" {
+		return errors.New("the external_command rotation mechanism requires external_command in the config")
+	}
+	info, err := os.Stat(config.ExternalCommand)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+		return fmt.Errorf("%s is not an executable file", config.ExternalCommand)
+	}
+	return nil
+}
+
+// commandMessage returns what the command reported about a failure,
+// preferring the error in its JSON output.
+func commandMessage(input *externalCommandInput, stdout, stderr *limitedBuffer) string {
+	var output externalCommandOutput
+	msg := strings.TrimSpace(stdout.String())
+	if err := json.Unmarshal(stdout.Bytes(), &output); err == nil && output.Error != "" {
+		msg = output.Error
+	} else if s := strings.TrimSpace(stderr.String()); s != "" {
+		msg = s
+	}
+	return redactPasswords(input, msg)
+}
+
+// redactPasswords removes the passwords from a message written by the
+// command, since it ends up in logs and in the role's last_rotation_error.
+func redactPasswords(input *externalCommandInput, msg string) string {
+	for _, password := range []string{input.OldPassword, input.NewPassword} {
+		if password != "" {
+			msg = strings.ReplaceAll(msg, password, "[redacted]")
+		}
+	}
+	return msg
+}
@@ -0,0 +1,254 @@
+package db2secretengine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+
+	"vault-plugin-secrets-hashicups/db2client"
+)
+
+// TestRotateRole_ExternalCommand checks that a role with the external_command
+// mechanism hands the passwords to the command on stdin only, honours its
+// exit status, output, timeout and output limit, and verifies the result.
+func TestRotateRole_ExternalCommand(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	db.setPassword(testRotationUsername, testRotationPassword)
+
+	dir := t.TempDir()
+	db.externalInput = filepath.Join(dir, "input.json")
+	testRotationSetup(t, b, s, map[string]interface{}{
+		"rotation_mechanism": mechanismExternalCommand,
+	})
+
+	// command points the config at a script running body, after it has
+	// saved its input, arguments and environment.
+	command := func(t *testing.T, body string) {
+		t.Helper()
+		script := filepath.Join(dir, "rotate.sh")
+		require.NoError(t, ioutil.WriteFile(script, []byte("#!/bin/sh\n"+
+			"echo \"$@\" > "+filepath.Join(dir, "args")+"\n"+
+			"env > "+filepath.Join(dir, "env")+"\n"+
+			body+"\n"), 0o700))
+		require.NoError(t, testConfigUpdate(t, b, s, map[string]interface{}{
+			"external_command":         script,
+			"external_command_timeout": "1s",
+		}))
+	}
+	saveInput := "cat > " + db.externalInput
+
+	// rotateFails rotates the role expecting a failure, and checks that the
+	// role is unchanged and whether the WAL entry was kept for rollback.
+	rotateFails := func(t *testing.T, keepsWAL bool) error {
+		t.Helper()
+		before, err := b.staticRole(ctx, s, testRotationRole)
+		require.NoError(t, err)
+
+		_, rotateErr := testRotateRole(t, b, s, testRotationRole)
+		require.Error(t, rotateErr)
+
+		after, err := b.staticRole(ctx, s, testRotationRole)
+		require.NoError(t, err)
+		require.Equal(t, before.CurrentPassword, after.CurrentPassword)
+		require.Equal(t, before.CurrentPassword, db.password(testRotationUsername))
+
+		wals, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Equal(t, keepsWAL, len(wals) != 0)
+		for _, id := range wals {
+			require.NoError(t, framework.DeleteWAL(ctx, s, id))
+		}
+		return rotateErr
+	}
+
+	t.Run("Unconfigured", func(t *testing.T) {
+		err := rotateFails(t, false)
+		require.Contains(t, err.Error(), "external_command")
+	})
+
+	t.Run("Dry Run", func(t *testing.T) {
+		dryRun := func() interface{} {
+			resp, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      rotateRolePath + testRotationRole + "/dry-run",
+				Storage:   s,
+			})
+			require.NoError(t, err)
+			return resp.Data["success"]
+		}
+		require.Equal(t, false, dryRun())
+		command(t, saveInput)
+		require.Equal(t, true, dryRun())
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		command(t, saveInput)
+		oldPassword := db.password(testRotationUsername)
+
+		resp, err := testRotateRole(t, b, s, testRotationRole)
+		require.NoError(t, err)
+		newPassword := resp.Data["current_password"].(string)
+		require.Equal(t, newPassword, db.password(testRotationUsername))
+
+		args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+		require.NoError(t, err)
+		require.Equal(t, "\n", string(args))
+		env, err := ioutil.ReadFile(filepath.Join(dir, "env"))
+		require.NoError(t, err)
+		require.NotContains(t, string(env), oldPassword)
+		require.NotContains(t, string(env), newPassword)
+	})
+
+	t.Run("Input", func(t *testing.T) {
+		command(t, "tee "+filepath.Join(dir, "input.copy")+" > "+db.externalInput)
+		oldPassword := db.password(testRotationUsername)
+
+		_, err := testRotateRole(t, b, s, testRotationRole)
+		require.NoError(t, err)
+
+		raw, err := ioutil.ReadFile(filepath.Join(dir, "input.copy"))
+		require.NoError(t, err)
+		var input externalCommandInput
+		require.NoError(t, json.Unmarshal(raw, &input))
+		require.Equal(t, externalCommandInput{
+			Username:    testRotationUsername,
+			OldPassword: oldPassword,
+			NewPassword: db.password(testRotationUsername),
+			Hostname:    "localhost",
+			Port:        "50000",
+			Database:    "sample",
+		}, input)
+	})
+
+	t.Run("Exit Status", func(t *testing.T) {
+		command(t, `cat > /dev/null; echo "cannot change password for $(id -un)" >&2; exit 3`)
+		err := rotateFails(t, false)
+		require.Contains(t, err.Error(), "status 3")
+		require.Contains(t, err.Error(), "cannot change password")
+	})
+
+	t.Run("Failure Output", func(t *testing.T) {
+		command(t, `cat > /dev/null; echo '{"success": false, "error": "account locked"}'`)
+		err := rotateFails(t, false)
+		require.Contains(t, err.Error(), "account locked")
+	})
+
+	t.Run("Output Redacted", func(t *testing.T) {
+		command(t, `cat; exit 1`)
+		err := rotateFails(t, false)
+		require.NotContains(t, err.Error(), db.password(testRotationUsername))
+		require.Contains(t, err.Error(), "[redacted]")
+	})
+
+	t.Run("Unreadable Output", func(t *testing.T) {
+		command(t, saveInput+"; echo done")
+		err := rotateFails(t, true)
+		require.Contains(t, err.Error(), "output")
+		os.Remove(db.externalInput)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		command(t, "exec sleep 10")
+		err := rotateFails(t, true)
+		require.Contains(t, err.Error(), "timed out")
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		command(t, "exec sleep 10")
+		config, err := getConnectionConfig(ctx, s, defaultConnectionName)
+		require.NoError(t, err)
+
+		cancelCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		err = runExternalCommand(cancelCtx, config, &externalCommandInput{Username: testRotationUsername})
+		require.Error(t, err)
+		var rotationErr *db2client.RotationError
+		require.False(t, errors.As(err, &rotationErr), "%v", err)
+	})
+
+	t.Run("Output Held Open", func(t *testing.T) {
+		command(t, saveInput+"; sleep 10 &")
+		require.NoError(t, testConfigUpdate(t, b, s, map[string]interface{}{"external_command_timeout": "5s"}))
+		start := time.Now()
+		err := rotateFails(t, true)
+		require.Contains(t, err.Error(), "held open")
+		require.Less(t, int64(time.Since(start)), int64(5*time.Second))
+		os.Remove(db.externalInput)
+	})
+
+	t.Run("Output Limit", func(t *testing.T) {
+		command(t, "cat > /dev/null; head -c 100000 /dev/zero")
+		err := rotateFails(t, true)
+		require.Contains(t, err.Error(), "bytes of output")
+	})
+
+	t.Run("Verification", func(t *testing.T) {
+		// the command claims success without changing the password
+		command(t, "cat > /dev/null")
+		clock := withTestClock(b)
+		oldPassword := db.password(testRotationUsername)
+
+		_, err := testRotateRole(t, b, s, testRotationRole)
+		var rotationErr *db2client.RotationError
+		require.ErrorAs(t, err, &rotationErr)
+		require.Equal(t, db2client.PhaseVerifyNew, rotationErr.Phase)
+
+		// the claimed password is stored until the rollback finds that DB2
+		// still has the old one
+		role, err := b.staticRole(ctx, s, testRotationRole)
+		require.NoError(t, err)
+		require.NotEqual(t, oldPassword, role.CurrentPassword)
+
+		clock.Add(maxRotationRetryBackoff)
+		testWALRollback(t, b, s)
+		role, err = b.staticRole(ctx, s, testRotationRole)
+		require.NoError(t, err)
+		require.Equal(t, oldPassword, role.CurrentPassword)
+		wals, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Empty(t, wals)
+	})
+}
+
+// TestRotationMechanism checks validation of a role's rotation_mechanism.
+func TestRotationMechanism(t *testing.T) {
+	b, s := getTestBackend(t)
+	testRotationSetup(t, b, s, nil)
+
+	role, err := b.staticRole(context.Background(), s, testRotationRole)
+	require.NoError(t, err)
+	require.Equal(t, mechanismNewPwd, role.mechanism())
+
+	for _, d := range []map[string]interface{}{
+		{"rotation_mechanism": "ssh"},
+		{"rotation_mechanism": mechanismStatements},
+		{"rotation_mechanism": mechanismExternalCommand, "rotation_statements": "CALL SYSPROC.SET_PASSWORD('{{username}}', '{{password}}')"},
+	} {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      staticRolePath + testRotationRole,
+			Data:      d,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError(), "%v", d)
+	}
+
+	testRotationRoleUpdate(t, b, s, map[string]interface{}{
+		"rotation_statements": "CALL SYSPROC.SET_PASSWORD('{{username}}', '{{password}}')",
+	})
+	role, err = b.staticRole(context.Background(), s, testRotationRole)
+	require.NoError(t, err)
+	require.Equal(t, mechanismStatements, role.mechanism())
+}
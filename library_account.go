@@ -0,0 +1,98 @@
+package db2secretengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	libraryAccountType = "db2_library_account"
+)
+
+// libraryAccount defines the secret returned by a library check-out and how
+// it is checked back in or renewed.
+func (b *db2Backend) libraryAccount() *framework.Secret {
+	return &framework.Secret{
+		Type: libraryAccountType,
+		Fields: map[string]*framework.FieldSchema{
+			"service_account_name": {
+				Type:        framework.TypeString,
+				Description: "Name of the static role that was checked out",
+			},
+			"username": {
+				Type:        framework.TypeString,
+				Description: "DB2 username of the account",
+			},
+			"password": {
+				Type:        framework.TypeString,
+				Description: "Password of the account, rotated at check-in",
+			},
+		},
+		Revoke: b.libraryAccountRevoke,
+		Renew:  b.libraryAccountRenew,
+	}
+}
+
+// libraryAccountRevoke checks the account back in once its password has been
+// rotated. If the rotation fails an error is returned, so that Vault retries
+// the revocation and the account is never lent out with a password a
+// previous borrower knows.
+func (b *db2Backend) libraryAccountRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleName, ok := req.Secret.InternalData["role_name"].(string)
+	if !ok {
+		return nil, errors.New("secret is missing role internal data")
+	}
+
+	lock := b.roleLock(roleName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := b.staticRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if role != nil {
+		input := &setStaticAccountInput{
+			RoleName: roleName,
+			Role:     role,
+			Trigger:  triggerCheckIn,
+			EntityID: req.EntityID,
+		}
+		if _, err := b.setStaticAccountPassword(ctx, req.Storage, input); err != nil {
+			return nil, fmt.Errorf("unable to rotate credentials for role %q on check-in: %w", roleName, err)
+		}
+		if err := b.scheduleRotation(roleName, input.Role); err != nil {
+			b.Logger().Warn("unable to reschedule role after check-in", "role", roleName, "error", err)
+		}
+	}
+
+	if err := req.Storage.Delete(ctx, checkOutPath+roleName); err != nil {
+		return nil, fmt.Errorf("error checking in account: %w", err)
+	}
+	return nil, nil
+}
+
+// libraryAccountRenew extends the check-out within the set's TTLs.
+func (b *db2Backend) libraryAccountRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	setName, ok := req.Secret.InternalData["set_name"].(string)
+	if !ok {
+		return nil, errors.New("secret is missing set internal data")
+	}
+
+	set, err := getLibrarySet(ctx, req.Storage, setName)
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		return nil, fmt.Errorf("library set %q no longer exists", setName)
+	}
+
+	resp := &logical.Response{Secret: req.Secret}
+	resp.Secret.TTL = set.TTL
+	resp.Secret.MaxTTL = set.MaxTTL
+	return resp, nil
+}
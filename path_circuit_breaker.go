@@ -0,0 +1,151 @@
+package db2secretengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"vault-plugin-secrets-hashicups/db2client"
+)
+
+// defaultLockoutCooldown is how long a circuit breaker stays open when the
+// config does not set lockout_cooldown.
+const defaultLockoutCooldown = 30 * time.Minute
+
+// errCircuitOpen is returned when a rotation or verification is refused
+// because the role's circuit breaker is open.
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// circuitOpen reports whether the role's circuit breaker is open at now.
+func (r *db2RoleEntry) circuitOpen(now time.Time) bool {
+	return now.Before(r.CircuitOpenUntil)
+}
+
+// circuitError returns an error wrapping errCircuitOpen if the role's
+// circuit breaker is open at now, and nil otherwise.
+func (r *db2RoleEntry) circuitError(name string, now time.Time) error {
+	if !r.circuitOpen(now) {
+		return nil
+	}
+	return fmt.Errorf("%w for role %q after %d authentication failures: refusing to log in as %q until %s, or until the breaker is reset with a delete of %s%s/circuit-breaker",
+		errCircuitOpen, name, r.AuthFailures, r.Username, r.CircuitOpenUntil.Format(time.RFC3339), staticRolePath, name)
+}
+
+// recordAuthResult updates the role's circuit breaker with the outcome of an
+// attempt to log in as its user, err being nil on success. Only DB2
+// rejecting the password or refusing a locked account counts as a failure;
+// an expired password is still the right one. Once the failures reach the
+// config's lockout threshold the breaker opens, and it opens again on the
+// first failure after its cool-down. It reports whether the breaker opened.
+func (r *db2RoleEntry) recordAuthResult(config *db2Config, err error, now time.Time) bool {
+	if err == nil {
+		r.resetCircuitBreaker()
+		return false
+	}
+	if !errors.Is(err, db2client.ErrInvalidCredentials) && !errors.Is(err, db2client.ErrAccountLocked) {
+		return false
+	}
+
+	r.AuthFailures++
+	if config == nil || config.LockoutThreshold == 0 || r.AuthFailures < config.LockoutThreshold {
+		return false
+	}
+	r.CircuitOpenUntil = now.Add(config.lockoutCooldown())
+	return true
+}
+
+// resetCircuitBreaker closes the role's circuit breaker and forgets its
+// authentication failures.
+func (r *db2RoleEntry) resetCircuitBreaker() {
+	r.AuthFailures = 0
+	r.CircuitOpenUntil = time.Time{}
+}
+
+func pathRoleCircuitBreaker(b *db2Backend) *framework.Path {
+	return &framework.Path{
+		Pattern: staticRolePath + framework.GenericNameRegex("name") + "/circuit-breaker",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the role",
+				Required:    true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathRoleCircuitBreakerRead,
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.pathRoleCircuitBreakerDelete,
+			},
+		},
+		HelpSynopsis:    pathRoleCircuitBreakerHelpSynopsis,
+		HelpDescription: pathRoleCircuitBreakerHelpDescription,
+	}
+}
+
+func (b *db2Backend) pathRoleCircuitBreakerRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	role, err := b.getRole(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"open":               role.circuitOpen(b.now()),
+			"auth_failures":      role.AuthFailures,
+			"circuit_open_until": role.CircuitOpenUntil,
+		},
+	}, nil
+}
+
+// pathRoleCircuitBreakerDelete closes the role's circuit breaker, once the
+// operator has fixed whatever made DB2 reject its password.
+func (b *db2Backend) pathRoleCircuitBreakerDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := b.roleLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := b.getRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse("role doesn't exist: %s", name), nil
+	}
+
+	role.resetCircuitBreaker()
+	if err := setRole(ctx, req.Storage, name, role); err != nil {
+		return nil, err
+	}
+
+	if err := b.scheduleRotation(name, role); err != nil {
+		return nil, fmt.Errorf("unable to schedule rotation for role: %w", err)
+	}
+
+	return nil, nil
+}
+
+const pathRoleCircuitBreakerHelpSynopsis = `Read or reset the circuit breaker guarding a static role's DB2 account.`
+
+const pathRoleCircuitBreakerHelpDescription = `
+DB2 accounts may be locked after a number of failed logins. When the config
+sets lockout_threshold, Vault counts the consecutive logins as a static
+role's user that DB2 rejected, such as rotations attempted with a stale
+current password. Once the threshold is reached the role's circuit breaker
+opens and its rotations and verifications are refused until lockout_cooldown
+has passed. After the cool-down one more attempt is allowed; if it fails the
+breaker opens again.
+
+Deleting this path closes the breaker and clears the failures. Writing a new
+current_password to the role does the same.
+`
@@ -0,0 +1,148 @@
+package db2secretengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCircuitBreaker checks that repeated authentication failures of a role
+// open its circuit breaker, which refuses rotations and verifications until
+// the cool-down passes or an operator resets it.
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	clock := withTestClock(b)
+	db.setPassword(testRotationUsername, testRotationPassword)
+	testRotationSetup(t, b, s, map[string]interface{}{
+		"rotation_period": "24h",
+	})
+	require.NoError(t, testConfigUpdate(t, b, s, map[string]interface{}{
+		"lockout_threshold": 2,
+		"lockout_cooldown":  "1h",
+	}))
+
+	circuitRead := func(t *testing.T) map[string]interface{} {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      staticRolePath + testRotationRole + "/circuit-breaker",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		return resp.Data
+	}
+	requireRefused := func(t *testing.T, resp *logical.Response, err error) {
+		t.Helper()
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Error().Error(), errCircuitOpen.Error())
+	}
+
+	// the password was reset outside Vault, so every login is rejected
+	db.setPassword(testRotationUsername, "changed-outside-vault")
+
+	t.Run("Opens At Threshold", func(t *testing.T) {
+		_, err := testRotateRole(t, b, s, testRotationRole)
+		require.Error(t, err)
+		require.Equal(t, false, circuitRead(t)["open"])
+
+		_, err = testRotateRole(t, b, s, testRotationRole)
+		require.Error(t, err)
+
+		data := circuitRead(t)
+		require.Equal(t, true, data["open"])
+		require.Equal(t, 2, data["auth_failures"])
+		require.Equal(t, clock.Now().Add(time.Hour), data["circuit_open_until"])
+	})
+
+	t.Run("Refuses Rotations And Verifications", func(t *testing.T) {
+		resp, err := testRotateRole(t, b, s, testRotationRole)
+		requireRefused(t, resp, err)
+
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      staticRolePath + testRotationRole + "/verify",
+			Storage:   s,
+		})
+		requireRefused(t, resp, err)
+
+		// refused attempts never reached DB2 and are not in the history
+		require.Len(t, testRoleHistoryRead(t, b, s, testRotationRole), 2)
+		require.Equal(t, 2, circuitRead(t)["auth_failures"])
+
+		// scheduled rotations wait for the breaker to close
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      staticRolePath + testRotationRole + "/rotation-status",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, clock.Now().Add(time.Hour), resp.Data["next_rotation_attempt"])
+	})
+
+	t.Run("Reopens After Cool-down", func(t *testing.T) {
+		clock.Add(time.Hour)
+		require.Equal(t, false, circuitRead(t)["open"])
+
+		_, err := testRotateRole(t, b, s, testRotationRole)
+		require.Error(t, err)
+
+		data := circuitRead(t)
+		require.Equal(t, true, data["open"])
+		require.Equal(t, 3, data["auth_failures"])
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      staticRolePath + testRotationRole + "/circuit-breaker",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		data := circuitRead(t)
+		require.Equal(t, false, data["open"])
+		require.Equal(t, 0, data["auth_failures"])
+
+		db.setPassword(testRotationUsername, testRotationPassword)
+		_, err = testRotateRole(t, b, s, testRotationRole)
+		require.NoError(t, err)
+	})
+
+	t.Run("Reset By Current Password", func(t *testing.T) {
+		db.setPassword(testRotationUsername, "changed-outside-vault")
+		for i := 0; i < 2; i++ {
+			_, err := testRotateRole(t, b, s, testRotationRole)
+			require.Error(t, err)
+		}
+		require.Equal(t, true, circuitRead(t)["open"])
+
+		testRotationRoleUpdate(t, b, s, map[string]interface{}{
+			"current_password": "changed-outside-vault",
+		})
+		require.Equal(t, false, circuitRead(t)["open"])
+
+		_, err := testRotateRole(t, b, s, testRotationRole)
+		require.NoError(t, err)
+	})
+
+	t.Run("Other Failures Do Not Count", func(t *testing.T) {
+		require.NoError(t, testConfigUpdate(t, b, s, map[string]interface{}{
+			"external_command": "/nonexistent/db2-passwd",
+		}))
+		testRotationRoleUpdate(t, b, s, map[string]interface{}{
+			"rotation_mechanism": mechanismExternalCommand,
+		})
+		for i := 0; i < 3; i++ {
+			_, err := testRotateRole(t, b, s, testRotationRole)
+			require.Error(t, err)
+		}
+		require.Equal(t, 0, circuitRead(t)["auth_failures"])
+	})
+}
@@ -4,9 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+
+	"vault-plugin-secrets-hashicups/db2client"
 )
 
 const (
@@ -14,10 +19,83 @@ const (
 )
 
 // db2Config includes the minimum configuration
-// required to instantiate a new HashiCups client.
+// required to instantiate a new DB2 client.
 type db2Config struct {
 	Hostname string `json:"hostname"`
-	Port string `json:"port"`
+	Port     string `json:"port"`
+
+	// Username and Password are the administrative credentials rotated by
+	// rotate-root. Password is never returned on read.
+	Username       string `json:"username,omitempty"`
+	Password       string `json:"password,omitempty"`
+	Database       string `json:"database,omitempty"`
+	PasswordPolicy string `json:"password_policy,omitempty"`
+
+	// ExternalCommand is the executable run by roles using the
+	// external_command rotation mechanism.
+	ExternalCommand        string        `json:"external_command,omitempty"`
+	ExternalCommandTimeout time.Duration `json:"external_command_timeout,omitempty"`
+
+	// DriftCheckInterval is how often the periodic function checks that the
+	// stored password of every static role still authenticates. Zero
+	// disables the check.
+	DriftCheckInterval time.Duration `json:"drift_check_interval,omitempty"`
+
+	// MaxPasswordAge, when set, reports any static role whose password is
+	// older than this as overdue in the status report, whatever its own
+	// rotation period.
+	MaxPasswordAge time.Duration `json:"max_password_age,omitempty"`
+
+	// LockoutThreshold is the number of consecutive authentication failures
+	// of a static role that opens its circuit breaker, refusing rotations
+	// and verifications for LockoutCooldown. Zero disables the breaker.
+	LockoutThreshold int           `json:"lockout_threshold,omitempty"`
+	LockoutCooldown  time.Duration `json:"lockout_cooldown,omitempty"`
+
+	// ConnectTimeout and StatementTimeout limit how long connecting to DB2
+	// and running a statement may take. Zero means the db2client default.
+	ConnectTimeout   time.Duration `json:"connect_timeout,omitempty"`
+	StatementTimeout time.Duration `json:"statement_timeout,omitempty"`
+
+	// MaxOpenConnections, MaxIdleConnections and MaxConnectionLifetime size
+	// the pool of administrative connections that rotation statements and
+	// jit grants run on. Zero means the db2client default.
+	MaxOpenConnections    int           `json:"max_open_connections,omitempty"`
+	MaxIdleConnections    int           `json:"max_idle_connections,omitempty"`
+	MaxConnectionLifetime time.Duration `json:"max_connection_lifetime,omitempty"`
+
+	// ConnectionAttributes are further CLI keywords, such as CurrentSchema,
+	// added to every connection string.
+	ConnectionAttributes map[string]string `json:"connection_attributes,omitempty"`
+
+	// TLSEnabled encrypts connections to DB2. TLSCAPEM holds the
+	// certificates the server's certificate must chain to and
+	// TLSServerHostname, which must be Hostname, turns on checking that it
+	// is issued for that name.
+	TLSEnabled        bool   `json:"tls_enabled,omitempty"`
+	TLSCAPEM          string `json:"tls_ca_pem,omitempty"`
+	TLSServerHostname string `json:"tls_server_hostname,omitempty"`
+}
+
+// connectionInfo returns how to log in to database on the configured DB2
+// server as username.
+func (c *db2Config) connectionInfo(database, username, password string) db2client.ConnectionInfo {
+	return db2client.ConnectionInfo{
+		Hostname:   c.Hostname,
+		Port:       c.Port,
+		Database:   database,
+		Username:   username,
+		Password:   password,
+		Attributes: c.ConnectionAttributes,
+	}
+}
+
+// lockoutCooldown returns how long an open circuit breaker stays open.
+func (c *db2Config) lockoutCooldown() time.Duration {
+	if c.LockoutCooldown == 0 {
+		return defaultLockoutCooldown
+	}
+	return c.LockoutCooldown
 }
 
 // pathConfig extends the Vault API with a `/config`
@@ -29,26 +107,56 @@ type db2Config struct {
 func pathConfig(b *db2Backend) *framework.Path {
 	return &framework.Path{
 		Pattern: configStoragePath,
-		Fields: map[string]*framework.FieldSchema{
-			"hostname": {
+		Fields: withConnectionFields(map[string]*framework.FieldSchema{
+			"external_command": {
 				Type:        framework.TypeString,
-				Description: "The username to access HashiCups Product API",
-				Required:    true,
+				Description: "Absolute path of the executable run by roles with the external_command rotation mechanism",
 				DisplayAttrs: &framework.DisplayAttributes{
-					Name:      "Username",
+					Name:      "External Command",
 					Sensitive: false,
 				},
 			},
-			"port": {
-				Type:        framework.TypeString,
-				Description: "The user's password to access HashiCups Product API",
-				Required:    true,
+			"external_command_timeout": {
+				Type:        framework.TypeDurationSecond,
+				Description: fmt.Sprintf("How long the external command may run before it is killed. Defaults to %s.", defaultExternalCommandTimeout),
 				DisplayAttrs: &framework.DisplayAttributes{
-					Name:      "Password",
-					Sensitive: true,
+					Name:      "External Command Timeout",
+					Sensitive: false,
 				},
 			},
-		},
+			"drift_check_interval": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How often to check that the stored password of every static role still authenticates. Roles whose password was changed outside Vault are marked out_of_sync. 0 disables the check.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "Drift Check Interval",
+					Sensitive: false,
+				},
+			},
+			"max_password_age": {
+				Type:        framework.TypeDurationSecond,
+				Description: "The oldest a static role's password may be before the status endpoint reports it as overdue, in addition to the role's own rotation period. 0 disables the limit.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "Max Password Age",
+					Sensitive: false,
+				},
+			},
+			"lockout_threshold": {
+				Type:        framework.TypeInt,
+				Description: "The number of consecutive authentication failures of a static role after which its rotations and verifications are refused, so that Vault does not lock the DB2 account. 0 disables the limit.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "Lockout Threshold",
+					Sensitive: false,
+				},
+			},
+			"lockout_cooldown": {
+				Type:        framework.TypeDurationSecond,
+				Description: fmt.Sprintf("How long rotations and verifications of a static role are refused once lockout_threshold is reached. Defaults to %s.", defaultLockoutCooldown),
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "Lockout Cooldown",
+					Sensitive: false,
+				},
+			},
+		}),
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ReadOperation: &framework.PathOperation{
 				Callback: b.pathConfigRead,
@@ -86,17 +194,35 @@ func (b *db2Backend) pathConfigRead(ctx context.Context, req *logical.Request, d
 		return nil, err
 	}
 
-	return &logical.Response{
-		Data: map[string]interface{}{
-			"hostname": config.Hostname,
-			"port":      config.Port,
+	if config == nil {
+		// the mount-wide settings may be set without a default connection
+		config, err = getSettings(ctx, req.Storage)
+		if err != nil || config == nil {
+			return nil, err
+		}
+	}
 
-		},
+	respData, err := connectionResponseData(config)
+	if err != nil {
+		return nil, err
+	}
+	respData["external_command"] = config.ExternalCommand
+	respData["external_command_timeout"] = config.ExternalCommandTimeout.Seconds()
+	respData["drift_check_interval"] = config.DriftCheckInterval.Seconds()
+	respData["max_password_age"] = config.MaxPasswordAge.Seconds()
+	respData["lockout_threshold"] = config.LockoutThreshold
+	respData["lockout_cooldown"] = config.LockoutCooldown.Seconds()
+
+	return &logical.Response{
+		Data: respData,
 	}, nil
 }
 
 // pathConfigWrite updates the configuration for the backend
 func (b *db2Backend) pathConfigWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
 	config, err := getConfig(ctx, req.Storage)
 	if err != nil {
 		return nil, err
@@ -105,52 +231,194 @@ func (b *db2Backend) pathConfigWrite(ctx context.Context, req *logical.Request,
 	createOperation := (req.Operation == logical.CreateOperation)
 
 	if config == nil {
-		if !createOperation {
-			return nil, errors.New("config not found during update operation")
+		config, err = getSettings(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		if config == nil {
+			if !createOperation {
+				return nil, errors.New("config not found during update operation")
+			}
+			config = new(db2Config)
 		}
-		config = new(db2Config)
 	}
 
-	if hostname, ok := data.GetOk("hostname"); ok {
-		config.Hostname = hostname.(string)
-	} else if !ok && createOperation {
-		return nil, fmt.Errorf("missing hostname in configuration")
+	// The mount-wide settings can be written alone. The default connection is
+	// only required to be complete once one of its fields is given.
+	hasConnection := config.Hostname != ""
+	if hasConnection || setsConnection(data) {
+		if resp, err := updateConnection(config, data, !hasConnection); resp != nil || err != nil {
+			return resp, err
+		}
 	}
 
-	if port, ok := data.GetOk("port"); ok {
-		config.Port = port.(string)
-	} else if !ok && createOperation {
-		return nil, fmt.Errorf("missing port in configuration")
+	if externalCommand, ok := data.GetOk("external_command"); ok {
+		config.ExternalCommand = externalCommand.(string)
 	}
 
-	entry, err := logical.StorageEntryJSON(configStoragePath, config)
-	if err != nil {
-		return nil, err
+	if timeout, ok := data.GetOk("external_command_timeout"); ok {
+		config.ExternalCommandTimeout = time.Duration(timeout.(int)) * time.Second
+	}
+
+	if interval, ok := data.GetOk("drift_check_interval"); ok {
+		config.DriftCheckInterval = time.Duration(interval.(int)) * time.Second
+	}
+
+	if maxPasswordAge, ok := data.GetOk("max_password_age"); ok {
+		config.MaxPasswordAge = time.Duration(maxPasswordAge.(int)) * time.Second
+	}
+
+	if threshold, ok := data.GetOk("lockout_threshold"); ok {
+		config.LockoutThreshold = threshold.(int)
+	}
+
+	if cooldown, ok := data.GetOk("lockout_cooldown"); ok {
+		config.LockoutCooldown = time.Duration(cooldown.(int)) * time.Second
+	}
+
+	if config.ExternalCommand != "" && !filepath.IsAbs(config.ExternalCommand) {
+		return logical.ErrorResponse("external_command must be an absolute path"), nil
+	}
+
+	if config.ExternalCommandTimeout < 0 {
+		return logical.ErrorResponse("external_command_timeout cannot be negative"), nil
+	}
+
+	if config.DriftCheckInterval != 0 && config.DriftCheckInterval < minRotationPeriod {
+		return logical.ErrorResponse("drift_check_interval must be %d seconds or more", int(minRotationPeriod.Seconds())), nil
+	}
+
+	if config.MaxPasswordAge < 0 {
+		return logical.ErrorResponse("max_password_age cannot be negative"), nil
+	}
+
+	if config.LockoutThreshold < 0 {
+		return logical.ErrorResponse("lockout_threshold cannot be negative"), nil
+	}
+
+	if config.LockoutCooldown < 0 {
+		return logical.ErrorResponse("lockout_cooldown cannot be negative"), nil
+	}
+
+	if config.Hostname == "" {
+		if err := putConfigEntry(ctx, req.Storage, configStoragePath, config.settings()); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	if data.Get("verify_connection").(bool) {
+		if err := b.verifyConnection(ctx, config); err != nil {
+			return logical.ErrorResponse("unable to verify the connection: %s", describeDB2Error(err)), nil
+		}
 	}
 
-	if err := req.Storage.Put(ctx, entry); err != nil {
+	if err := putConfig(ctx, req.Storage, config); err != nil {
 		return nil, err
 	}
 
 	// reset the client so the next invocation will pick up the new configuration
-	b.reset()
+	b.reset(defaultConnectionName)
 
 	return nil, nil
 }
 
 // pathConfigDelete removes the configuration for the backend
 func (b *db2Backend) pathConfigDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	err := req.Storage.Delete(ctx, configStoragePath)
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
 
-	if err == nil {
-		b.reset()
+	roles, err := b.rolesUsingConnection(ctx, req.Storage, defaultConnectionName)
+	if err != nil {
+		return nil, err
+	}
+	if len(roles) != 0 {
+		return logical.ErrorResponse("the default connection is used by static roles: %s", strings.Join(roles, ", ")), nil
+	}
+
+	jitRoles, err := jitRolesUsingConnection(ctx, req.Storage, defaultConnectionName)
+	if err != nil {
+		return nil, err
+	}
+	if len(jitRoles) != 0 {
+		return logical.ErrorResponse("the default connection is used by jit roles: %s", strings.Join(jitRoles, ", ")), nil
 	}
 
-	return nil, err
+	if err := req.Storage.Delete(ctx, configStoragePath); err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Delete(ctx, connectionPath+defaultConnectionName); err != nil {
+		return nil, err
+	}
+
+	b.reset(defaultConnectionName)
+
+	return nil, nil
 }
 
+// verifyConnection checks that the DB2 server in config accepts connections
+// and, if the config has administrative credentials, that they authenticate.
+func (b *db2Backend) verifyConnection(ctx context.Context, config *db2Config) error {
+	db2Client, err := b.clientFactory(config)
+	if err != nil {
+		return err
+	}
+	defer db2Client.Close()
+
+	if err := db2Client.Ping(ctx, config.Hostname, config.Port); err != nil {
+		return err
+	}
+	if config.Username == "" {
+		return nil
+	}
+	return db2Client.Verify(ctx, config.connectionInfo(config.Database, config.Username, config.Password))
+}
+
+// getConfig returns the config with the settings of the default connection,
+// or nil if it is unset.
 func getConfig(ctx context.Context, s logical.Storage) (*db2Config, error) {
-	entry, err := s.Get(ctx, configStoragePath)
+	config, err := readConfigEntry(ctx, s, configStoragePath)
+	if err != nil || config == nil {
+		return nil, err
+	}
+
+	conn, err := readConfigEntry(ctx, s, connectionPath+defaultConnectionName)
+	if err != nil {
+		return nil, err
+	}
+	if conn == nil {
+		if config.Hostname == "" {
+			// only the mount-wide settings are set
+			return nil, nil
+		}
+		// written before named connections, config holds the connection
+		return config, nil
+	}
+
+	return config.withConnection(conn), nil
+}
+
+// getSettings returns the mount-wide settings stored at config, which may be
+// set without a default connection, or nil if they are unset.
+func getSettings(ctx context.Context, s logical.Storage) (*db2Config, error) {
+	config, err := readConfigEntry(ctx, s, configStoragePath)
+	if err != nil || config == nil {
+		return nil, err
+	}
+	return config.settings(), nil
+}
+
+// putConfig stores the mount-wide settings of config at config and its
+// connection settings as the default connection.
+func putConfig(ctx context.Context, s logical.Storage, config *db2Config) error {
+	if err := putConfigEntry(ctx, s, connectionPath+defaultConnectionName, config.connection()); err != nil {
+		return err
+	}
+	return putConfigEntry(ctx, s, configStoragePath, config.settings())
+}
+
+func readConfigEntry(ctx context.Context, s logical.Storage, key string) (*db2Config, error) {
+	entry, err := s.Get(ctx, key)
 	if err != nil {
 		return nil, err
 	}
@@ -161,17 +429,37 @@ func getConfig(ctx context.Context, s logical.Storage) (*db2Config, error) {
 
 	config := new(db2Config)
 	if err := entry.DecodeJSON(&config); err != nil {
-		return nil, fmt.Errorf("error reading root configuration: %w", err)
+		return nil, fmt.Errorf("error reading %s: %w", key, err)
 	}
 
-	// return the config, we are done
 	return config, nil
 }
 
+func putConfigEntry(ctx context.Context, s logical.Storage, key string, config *db2Config) error {
+	entry, err := logical.StorageEntryJSON(key, config)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
 // pathConfigHelpSynopsis summarizes the help text for the configuration
 const pathConfigHelpSynopsis = `Configure DB2 Backend.`
 
 // pathConfigHelpDescription describes the help text for the configuration
 const pathConfigHelpDescription = `
-To be updated
+The DB2 secrets backend requires the hostname and port of the DB2 server.
+An administrative username and password may also be provided, in which
+case the "rotate-root" endpoint can rotate that password so only Vault
+knows it. The password is never returned when reading the configuration.
+Set verify_connection to check the server and credentials before saving.
+Set tls_enabled, with tls_ca_pem when the server's certificate is not in
+the driver's trust store, to encrypt connections to DB2.
+
+The connection configured here is the "default" connection. Further DB2
+servers are configured with the "connection/" endpoints. The mount-wide
+settings, such as drift_check_interval, max_password_age and the lockout
+limits, may be written without a default connection by leaving out all of
+its fields. The config cannot be deleted while static or jit roles use the
+default connection.
 `
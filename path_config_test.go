@@ -2,50 +2,116 @@ package db2secretengine
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vault-plugin-secrets-hashicups/db2client"
 )
 
 const (
 	username = "vault-plugin-testing"
 	password = "Testing!123"
-	url      = "http://localhost:19090"
+	hostname = "localhost"
+	port     = "50000"
+	database = "sample"
 )
 
 // TestConfig mocks the creation, read, update, and delete
-// of the backend configuration for HashiCups.
+// of the backend configuration for DB2.
 func TestConfig(t *testing.T) {
 	b, reqStorage := getTestBackend(t)
 
 	t.Run("Test Configuration", func(t *testing.T) {
 		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"hostname": hostname,
+			"port":     port,
 			"username": username,
 			"password": password,
-			"url":      url,
+			"database": database,
 		})
 
 		assert.NoError(t, err)
 
 		err = testConfigRead(t, b, reqStorage, map[string]interface{}{
-			"username": username,
-			"url":      url,
+			"hostname":                 hostname,
+			"port":                     port,
+			"username":                 username,
+			"database":                 database,
+			"password_policy":          "",
+			"external_command":         "",
+			"external_command_timeout": float64(0),
+			"drift_check_interval":     float64(0),
+			"max_password_age":         float64(0),
+			"lockout_threshold":        0,
+			"lockout_cooldown":         float64(0),
+			"connect_timeout":          float64(0),
+			"statement_timeout":        float64(0),
+			"max_open_connections":     0,
+			"max_idle_connections":     0,
+			"max_connection_lifetime":  float64(0),
+			"connection_attributes":    map[string]string(nil),
+			"tls_enabled":              false,
+			"tls_ca_certificates":      []map[string]interface{}{},
+			"tls_server_hostname":      "",
 		})
 
 		assert.NoError(t, err)
 
 		err = testConfigUpdate(t, b, reqStorage, map[string]interface{}{
-			"username": username,
-			"url":      "http://hashicups:19090",
+			"hostname":                 "db2.example.com",
+			"external_command":         "/usr/local/bin/db2-passwd",
+			"external_command_timeout": "10s",
+			"drift_check_interval":     "1h",
+			"max_password_age":         "2160h",
+			"lockout_threshold":        3,
+			"lockout_cooldown":         "1h",
+			"connect_timeout":          "5s",
+			"statement_timeout":        "30s",
+			"max_open_connections":     8,
+			"max_idle_connections":     2,
+			"max_connection_lifetime":  "30m",
+			"connection_attributes":    map[string]interface{}{"CurrentSchema": "APP"},
 		})
 
 		assert.NoError(t, err)
 
 		err = testConfigRead(t, b, reqStorage, map[string]interface{}{
-			"username": username,
-			"url":      "http://hashicups:19090",
+			"hostname":                 "db2.example.com",
+			"port":                     port,
+			"username":                 username,
+			"database":                 database,
+			"password_policy":          "",
+			"external_command":         "/usr/local/bin/db2-passwd",
+			"external_command_timeout": float64(10),
+			"drift_check_interval":     float64(3600),
+			"max_password_age":         float64(7776000),
+			"lockout_threshold":        3,
+			"lockout_cooldown":         float64(3600),
+			"connect_timeout":          float64(5),
+			"statement_timeout":        float64(30),
+			"max_open_connections":     8,
+			"max_idle_connections":     2,
+			"max_connection_lifetime":  float64(1800),
+			"connection_attributes":    map[string]string{"CurrentSchema": "APP"},
+			"tls_enabled":              false,
+			"tls_ca_certificates":      []map[string]interface{}{},
+			"tls_server_hostname":      "",
 		})
 
 		assert.NoError(t, err)
@@ -54,6 +120,223 @@ func TestConfig(t *testing.T) {
 
 		assert.NoError(t, err)
 	})
+
+	t.Run("Username Without Password", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"hostname": hostname,
+			"port":     port,
+			"username": username,
+		})
+
+		assert.Error(t, err)
+	})
+
+	t.Run("Relative External Command", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"hostname":         hostname,
+			"port":             port,
+			"external_command": "db2-passwd",
+		})
+
+		assert.Error(t, err)
+	})
+
+	t.Run("Verify Connection", func(t *testing.T) {
+		db := withFakeDB2(b)
+		db.setPassword(username, password)
+		config := map[string]interface{}{
+			"hostname":          hostname,
+			"port":              port,
+			"username":          username,
+			"password":          "wrong",
+			"verify_connection": true,
+		}
+
+		err := testConfigCreate(t, b, reqStorage, config)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "DB2 rejected the username or password")
+
+		db.pingErr = &db2client.Error{Kind: db2client.ErrConnection, Err: errors.New("connection refused")}
+		config["password"] = password
+		err = testConfigCreate(t, b, reqStorage, config)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "check the hostname and port")
+
+		db.pingErr = nil
+		assert.NoError(t, testConfigCreate(t, b, reqStorage, config))
+		assert.NoError(t, testConfigDelete(t, b, reqStorage))
+	})
+
+	t.Run("More Idle Than Open Connections", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"hostname":             hostname,
+			"port":                 port,
+			"max_open_connections": 2,
+			"max_idle_connections": 4,
+		})
+
+		assert.Error(t, err)
+	})
+
+	t.Run("Reserved Connection Attribute", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"hostname":              hostname,
+			"port":                  port,
+			"connection_attributes": map[string]interface{}{"PWD": "injected"},
+		})
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "reserved")
+	})
+
+	t.Run("Short Drift Check Interval", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"hostname":             hostname,
+			"port":                 port,
+			"drift_check_interval": "10s",
+		})
+
+		assert.Error(t, err)
+	})
+}
+
+// TestConfig_ClientLifecycle checks that the DB2 client, and with it its
+// pooled connections, is closed when the config changes, when the config is
+// invalidated and when the backend is cleaned up.
+func TestConfig_ClientLifecycle(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+
+	openClient := func() {
+		t.Helper()
+		client, err := b.getClient(ctx, s, defaultConnectionName)
+		assert.NoError(t, err)
+		b.releaseClient(client)
+	}
+
+	assert.NoError(t, testConfigCreate(t, b, s, map[string]interface{}{
+		"hostname": hostname,
+		"port":     port,
+	}))
+	openClient()
+	assert.Equal(t, 0, db.closed)
+
+	assert.NoError(t, testConfigUpdate(t, b, s, map[string]interface{}{
+		"max_open_connections": 2,
+	}))
+	assert.Equal(t, 1, db.closed)
+
+	openClient()
+	b.invalidate(ctx, "webhook/example")
+	assert.Equal(t, 1, db.closed)
+	b.invalidate(ctx, configStoragePath)
+	assert.Equal(t, 2, db.closed)
+
+	openClient()
+	b.clean(ctx)
+	assert.Equal(t, 3, db.closed)
+
+	// nothing is left to close
+	b.clean(ctx)
+	assert.Equal(t, 3, db.closed)
+
+	// a client still in use when the config changes is closed by its last
+	// user, and the next caller gets a new one
+	inUse, err := b.getClient(ctx, s, defaultConnectionName)
+	assert.NoError(t, err)
+	assert.NoError(t, testConfigUpdate(t, b, s, map[string]interface{}{
+		"max_open_connections": 3,
+	}))
+	assert.Equal(t, 3, db.closed)
+
+	client, err := b.getClient(ctx, s, defaultConnectionName)
+	assert.NoError(t, err)
+	assert.NotSame(t, inUse, client)
+	b.releaseClient(inUse)
+	assert.Equal(t, 4, db.closed)
+	b.releaseClient(client)
+	assert.Equal(t, 4, db.closed)
+}
+
+// TestConfig_TLS checks that the TLS settings are validated, described on
+// read and that the CA is handed to the driver in a private file that is
+// removed with the client.
+func TestConfig_TLS(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	notAfter := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test DB2 CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+
+	invalid := map[string]map[string]interface{}{
+		"Not PEM":             {"tls_enabled": true, "tls_ca_pem": "not a certificate"},
+		"Private Key":         {"tls_enabled": true, "tls_ca_pem": caPEM + keyPEM},
+		"Trailing Data":       {"tls_enabled": true, "tls_ca_pem": caPEM + "garbage"},
+		"CA Without TLS":      {"tls_ca_pem": caPEM},
+		"Server Without TLS":  {"tls_server_hostname": "db2.example.com"},
+		"Server Not Hostname": {"tls_enabled": true, "tls_server_hostname": "db2.example.com"},
+	}
+	for name, d := range invalid {
+		t.Run(name, func(t *testing.T) {
+			d["hostname"] = hostname
+			d["port"] = port
+			require.Error(t, testConfigCreate(t, b, s, d))
+		})
+	}
+
+	require.NoError(t, testConfigCreate(t, b, s, map[string]interface{}{
+		"hostname":            "db2.example.com",
+		"port":                "50001",
+		"tls_enabled":         true,
+		"tls_ca_pem":          caPEM,
+		"tls_server_hostname": "db2.example.com",
+	}))
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      configStoragePath,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, true, resp.Data["tls_enabled"])
+	require.Equal(t, "db2.example.com", resp.Data["tls_server_hostname"])
+	require.Equal(t, []map[string]interface{}{{
+		"subject":   "CN=Test DB2 CA",
+		"not_after": notAfter,
+	}}, resp.Data["tls_ca_certificates"])
+	require.NotContains(t, resp.Data, "tls_ca_pem")
+
+	config, err := getConfig(ctx, s)
+	require.NoError(t, err)
+	client, err := newClient(config)
+	require.NoError(t, err)
+
+	info, err := os.Stat(client.caFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	written, err := ioutil.ReadFile(client.caFile)
+	require.NoError(t, err)
+	require.Equal(t, caPEM, string(written))
+
+	require.NoError(t, client.Close())
+	_, err = os.Stat(client.caFile)
+	require.True(t, os.IsNotExist(err))
 }
 
 func testConfigDelete(t *testing.T, b logical.Backend, s logical.Storage) error {
@@ -137,7 +420,7 @@ func testConfigRead(t *testing.T, b logical.Backend, s logical.Storage, expected
 
 		if !ok {
 			return fmt.Errorf(`expected data["%s"] = %v but was not included in read output"`, k, expectedV)
-		} else if expectedV != actualV {
+		} else if !reflect.DeepEqual(expectedV, actualV) {
 			return fmt.Errorf(`expected data["%s"] = %v, instead got %v"`, k, expectedV, actualV)
 		}
 	}
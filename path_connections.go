@@ -0,0 +1,663 @@
+package db2secretengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"vault-plugin-secrets-hashicups/db2client"
+)
+
+const (
+	connectionPath = "connection/"
+
+	// defaultConnectionName is the connection configured at config, used by
+	// static roles that do not name one.
+	defaultConnectionName = "default"
+)
+
+// withConnection returns a copy of c that connects as conn does, keeping
+// c's mount-wide settings such as the external command and lockout limits.
+func (c *db2Config) withConnection(conn *db2Config) *db2Config {
+	merged := *c
+	merged.Hostname = conn.Hostname
+	merged.Port = conn.Port
+	merged.Username = conn.Username
+	merged.Password = conn.Password
+	merged.Database = conn.Database
+	merged.PasswordPolicy = conn.PasswordPolicy
+	merged.ConnectTimeout = conn.ConnectTimeout
+	merged.StatementTimeout = conn.StatementTimeout
+	merged.MaxOpenConnections = conn.MaxOpenConnections
+	merged.MaxIdleConnections = conn.MaxIdleConnections
+	merged.MaxConnectionLifetime = conn.MaxConnectionLifetime
+	merged.ConnectionAttributes = conn.ConnectionAttributes
+	merged.TLSEnabled = conn.TLSEnabled
+	merged.TLSCAPEM = conn.TLSCAPEM
+	merged.TLSServerHostname = conn.TLSServerHostname
+	return &merged
+}
+
+// connection returns only the connection settings of c, as stored under
+// connection/.
+func (c *db2Config) connection() *db2Config {
+	return new(db2Config).withConnection(c)
+}
+
+// settings returns c without its connection settings, as stored at config.
+func (c *db2Config) settings() *db2Config {
+	return c.withConnection(new(db2Config))
+}
+
+// setsConnection reports whether data gives any of the connection fields.
+func setsConnection(data *framework.FieldData) bool {
+	for name := range connectionFields() {
+		if _, ok := data.Raw[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// withConnectionFields adds the fields describing a connection to fields.
+func withConnectionFields(fields map[string]*framework.FieldSchema) map[string]*framework.FieldSchema {
+	for name, field := range connectionFields() {
+		fields[name] = field
+	}
+	return fields
+}
+
+// connectionFields returns the fields shared by config and connection/.
+func connectionFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"hostname": {
+			Type:        framework.TypeString,
+			Description: "The hostname of the DB2 server",
+			Required:    true,
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name:      "Hostname",
+				Sensitive: false,
+			},
+		},
+		"port": {
+			Type:        framework.TypeString,
+			Description: "The port the DB2 server listens on",
+			Required:    true,
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name:      "Port",
+				Sensitive: false,
+			},
+		},
+		"username": {
+			Type:        framework.TypeString,
+			Description: "The administrative DB2 user whose password is rotated by rotate-root",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name:      "Username",
+				Sensitive: false,
+			},
+		},
+		"password": {
+			Type:        framework.TypeString,
+			Description: "The password of the administrative DB2 user",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name:      "Password",
+				Sensitive: true,
+			},
+		},
+		"database": {
+			Type:        framework.TypeString,
+			Description: "The database the administrative DB2 user connects to",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name:      "Database",
+				Sensitive: false,
+			},
+		},
+		"password_policy": {
+			Type:        framework.TypeString,
+			Description: "Password policy used to generate the administrative password on rotate-root",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name:      "Password Policy",
+				Sensitive: false,
+			},
+		},
+		"connect_timeout": {
+			Type:        framework.TypeDurationSecond,
+			Description: fmt.Sprintf("How long connecting to DB2 may take before it is abandoned. Defaults to %s.", db2client.DefaultConnectTimeout),
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name:      "Connect Timeout",
+				Sensitive: false,
+			},
+		},
+		"statement_timeout": {
+			Type:        framework.TypeDurationSecond,
+			Description: fmt.Sprintf("How long a statement run against DB2 may take before it is cancelled. Defaults to %s.", db2client.DefaultStatementTimeout),
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name:      "Statement Timeout",
+				Sensitive: false,
+			},
+		},
+		"max_open_connections": {
+			Type:        framework.TypeInt,
+			Description: fmt.Sprintf("The most administrative connections to DB2 kept open at once, per database. Defaults to %d.", db2client.DefaultMaxOpenConnections),
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name:      "Max Open Connections",
+				Sensitive: false,
+			},
+		},
+		"max_idle_connections": {
+			Type:        framework.TypeInt,
+			Description: "The most idle administrative connections to DB2 kept for reuse, per database. Defaults to max_open_connections.",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name:      "Max Idle Connections",
+				Sensitive: false,
+			},
+		},
+		"max_connection_lifetime": {
+			Type:        framework.TypeDurationSecond,
+			Description: "How long an administrative connection to DB2 may be reused before it is closed. 0 reuses connections for as long as they work.",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name:      "Max Connection Lifetime",
+				Sensitive: false,
+			},
+		},
+		"connection_attributes": {
+			Type:        framework.TypeKVPairs,
+			Description: "Further DB2 CLI keywords added to every connection string, such as CurrentSchema or Authentication. The hostname, port, database, credentials and connect timeout are set from their own fields and may not be given here.",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name:      "Connection Attributes",
+				Sensitive: false,
+			},
+		},
+		"tls_enabled": {
+			Type:        framework.TypeBool,
+			Description: "If true, connect to DB2 over TLS (Security=SSL), so that passwords never cross the network in the clear. The port must be the server's SSL port.",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name:      "TLS Enabled",
+				Sensitive: false,
+			},
+		},
+		"tls_ca_pem": {
+			Type:        framework.TypeString,
+			Description: "PEM encoded certificates the DB2 server's certificate must chain to. When unset the driver's own trust store is used.",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name:      "TLS CA PEM",
+				Sensitive: false,
+			},
+		},
+		"tls_server_hostname": {
+			Type:        framework.TypeString,
+			Description: "If set, the name the DB2 server's certificate must be issued for, turning on hostname validation in the driver. The driver validates the hostname it connects to, so this must be the same as hostname.",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name:      "TLS Server Hostname",
+				Sensitive: false,
+			},
+		},
+		"verify_connection": {
+			Type:        framework.TypeBool,
+			Description: "If true, check that the DB2 server is reachable and that the administrative credentials authenticate before the connection is saved.",
+			Default:     false,
+		},
+	}
+}
+
+// updateConnection sets the connection fields in data on config and checks
+// the result, returning an error response if it is invalid.
+func updateConnection(config *db2Config, data *framework.FieldData, createOperation bool) (*logical.Response, error) {
+	if hostname, ok := data.GetOk("hostname"); ok {
+		config.Hostname = hostname.(string)
+	} else if !ok && createOperation {
+		return nil, fmt.Errorf("missing hostname in configuration")
+	}
+
+	if port, ok := data.GetOk("port"); ok {
+		config.Port = port.(string)
+	} else if !ok && createOperation {
+		return nil, fmt.Errorf("missing port in configuration")
+	}
+
+	if username, ok := data.GetOk("username"); ok {
+		config.Username = username.(string)
+	}
+
+	if password, ok := data.GetOk("password"); ok {
+		config.Password = password.(string)
+	}
+
+	if database, ok := data.GetOk("database"); ok {
+		config.Database = database.(string)
+	}
+
+	if passwordPolicy, ok := data.GetOk("password_policy"); ok {
+		config.PasswordPolicy = passwordPolicy.(string)
+	}
+
+	if timeout, ok := data.GetOk("connect_timeout"); ok {
+		config.ConnectTimeout = time.Duration(timeout.(int)) * time.Second
+	}
+
+	if timeout, ok := data.GetOk("statement_timeout"); ok {
+		config.StatementTimeout = time.Duration(timeout.(int)) * time.Second
+	}
+
+	if maxOpen, ok := data.GetOk("max_open_connections"); ok {
+		config.MaxOpenConnections = maxOpen.(int)
+	}
+
+	if maxIdle, ok := data.GetOk("max_idle_connections"); ok {
+		config.MaxIdleConnections = maxIdle.(int)
+	}
+
+	if lifetime, ok := data.GetOk("max_connection_lifetime"); ok {
+		config.MaxConnectionLifetime = time.Duration(lifetime.(int)) * time.Second
+	}
+
+	if attributes, ok := data.GetOk("connection_attributes"); ok {
+		config.ConnectionAttributes = attributes.(map[string]string)
+	}
+
+	if tlsEnabled, ok := data.GetOk("tls_enabled"); ok {
+		config.TLSEnabled = tlsEnabled.(bool)
+	}
+
+	if caPEM, ok := data.GetOk("tls_ca_pem"); ok {
+		config.TLSCAPEM = caPEM.(string)
+	}
+
+	if serverHostname, ok := data.GetOk("tls_server_hostname"); ok {
+		config.TLSServerHostname = serverHostname.(string)
+	}
+
+	if (config.Username == "") != (config.Password == "") {
+		return logical.ErrorResponse("username and password must be set together"), nil
+	}
+
+	if config.ConnectTimeout < 0 {
+		return logical.ErrorResponse("connect_timeout cannot be negative"), nil
+	}
+
+	if config.StatementTimeout < 0 {
+		return logical.ErrorResponse("statement_timeout cannot be negative"), nil
+	}
+
+	if config.MaxOpenConnections < 0 {
+		return logical.ErrorResponse("max_open_connections cannot be negative"), nil
+	}
+
+	if config.MaxIdleConnections < 0 {
+		return logical.ErrorResponse("max_idle_connections cannot be negative"), nil
+	}
+
+	if config.MaxOpenConnections != 0 && config.MaxIdleConnections > config.MaxOpenConnections {
+		return logical.ErrorResponse("max_idle_connections cannot be more than max_open_connections"), nil
+	}
+
+	if config.MaxConnectionLifetime < 0 {
+		return logical.ErrorResponse("max_connection_lifetime cannot be negative"), nil
+	}
+
+	if err := db2client.ValidateAttributes(config.ConnectionAttributes); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if !config.TLSEnabled && (config.TLSCAPEM != "" || config.TLSServerHostname != "") {
+		return logical.ErrorResponse("tls_ca_pem and tls_server_hostname require tls_enabled"), nil
+	}
+
+	// the driver can only check the certificate against the name it connects to
+	if config.TLSServerHostname != "" && !strings.EqualFold(config.TLSServerHostname, config.Hostname) {
+		return logical.ErrorResponse("tls_server_hostname %q must be the same as hostname %q, which is the name the driver validates the certificate against", config.TLSServerHostname, config.Hostname), nil
+	}
+
+	if config.TLSCAPEM != "" {
+		if _, err := parseCACertificates(config.TLSCAPEM); err != nil {
+			return logical.ErrorResponse("invalid tls_ca_pem: %s", err), nil
+		}
+	}
+
+	return nil, nil
+}
+
+// connectionResponseData returns the non-sensitive settings of the
+// connection in config.
+func connectionResponseData(config *db2Config) (map[string]interface{}, error) {
+	// the CA is described rather than returned
+	caCertificates := []map[string]interface{}{}
+	if config.TLSCAPEM != "" {
+		certificates, err := parseCACertificates(config.TLSCAPEM)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stored tls_ca_pem: %w", err)
+		}
+		for _, certificate := range certificates {
+			caCertificates = append(caCertificates, map[string]interface{}{
+				"subject":   certificate.Subject.String(),
+				"not_after": certificate.NotAfter,
+			})
+		}
+	}
+
+	return map[string]interface{}{
+		"hostname":                config.Hostname,
+		"port":                    config.Port,
+		"username":                config.Username,
+		"database":                config.Database,
+		"password_policy":         config.PasswordPolicy,
+		"connect_timeout":         config.ConnectTimeout.Seconds(),
+		"statement_timeout":       config.StatementTimeout.Seconds(),
+		"max_open_connections":    config.MaxOpenConnections,
+		"max_idle_connections":    config.MaxIdleConnections,
+		"max_connection_lifetime": config.MaxConnectionLifetime.Seconds(),
+		"connection_attributes":   config.ConnectionAttributes,
+		"tls_enabled":             config.TLSEnabled,
+		"tls_ca_certificates":     caCertificates,
+		"tls_server_hostname":     config.TLSServerHostname,
+	}, nil
+}
+
+// pathConnections extends the Vault API with `/connection` endpoints that
+// configure further DB2 servers for static roles to use. The connection in
+// config is available as "default".
+func pathConnections(b *db2Backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: connectionPath + framework.GenericNameRegex("name"),
+			Fields: withConnectionFields(map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the connection",
+					Required:    true,
+				},
+			}),
+			ExistenceCheck: b.pathConnectionExistenceCheck,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathConnectionRead,
+				},
+				logical.CreateOperation: &framework.PathOperation{
+					Callback: b.pathConnectionWrite,
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathConnectionWrite,
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathConnectionDelete,
+				},
+			},
+			HelpSynopsis:    pathConnectionHelpSynopsis,
+			HelpDescription: pathConnectionHelpDescription,
+		},
+		{
+			Pattern: connectionPath + "?$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathConnectionsList,
+				},
+			},
+			HelpSynopsis:    pathConnectionListHelpSynopsis,
+			HelpDescription: pathConnectionListHelpDescription,
+		},
+	}
+}
+
+func (b *db2Backend) pathConnectionExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
+	config, err := getConnectionConfig(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return false, fmt.Errorf("existence check failed: %w", err)
+	}
+	return config != nil, nil
+}
+
+func (b *db2Backend) pathConnectionRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := getConnectionConfig(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, nil
+	}
+
+	respData, err := connectionResponseData(config)
+	if err != nil {
+		return nil, err
+	}
+	return &logical.Response{Data: respData}, nil
+}
+
+func (b *db2Backend) pathConnectionWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	config, err := getConnectionConfig(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	createOperation := (req.Operation == logical.CreateOperation)
+
+	if config == nil {
+		if !createOperation {
+			return nil, errors.New("connection not found during update operation")
+		}
+		// keep the mount-wide settings of an existing config
+		config, err = getSettings(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		if config == nil {
+			config = new(db2Config)
+		}
+	}
+
+	if resp, err := updateConnection(config, data, createOperation); resp != nil || err != nil {
+		return resp, err
+	}
+
+	if data.Get("verify_connection").(bool) {
+		if err := b.verifyConnection(ctx, config); err != nil {
+			return logical.ErrorResponse("unable to verify the connection: %s", describeDB2Error(err)), nil
+		}
+	}
+
+	if err := putConnectionConfig(ctx, req.Storage, name, config); err != nil {
+		return nil, err
+	}
+
+	// reset the client so the next invocation will pick up the new connection
+	b.reset(name)
+
+	return nil, nil
+}
+
+func (b *db2Backend) pathConnectionDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	if name == defaultConnectionName {
+		return logical.ErrorResponse("the default connection is removed by deleting config"), nil
+	}
+
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	roles, err := b.rolesUsingConnection(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(roles) != 0 {
+		return logical.ErrorResponse("connection %q is used by static roles: %s", name, strings.Join(roles, ", ")), nil
+	}
+
+	jitRoles, err := jitRolesUsingConnection(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(jitRoles) != 0 {
+		return logical.ErrorResponse("connection %q is used by jit roles: %s", name, strings.Join(jitRoles, ", ")), nil
+	}
+
+	if err := req.Storage.Delete(ctx, connectionPath+name); err != nil {
+		return nil, err
+	}
+
+	b.reset(name)
+
+	return nil, nil
+}
+
+func (b *db2Backend) pathConnectionsList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	names, err := listConnections(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(names), nil
+}
+
+// rolesUsingConnection returns the static roles that connect with the named
+// connection.
+func (b *db2Backend) rolesUsingConnection(ctx context.Context, s logical.Storage, name string) ([]string, error) {
+	names, err := s.List(ctx, staticRolePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var roles []string
+	for _, roleName := range names {
+		role, err := b.staticRole(ctx, s, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role != nil && role.connectionName() == name {
+			roles = append(roles, roleName)
+		}
+	}
+	return roles, nil
+}
+
+// jitRolesUsingConnection returns the jit roles that run their statements
+// over the named connection.
+func jitRolesUsingConnection(ctx context.Context, s logical.Storage, name string) ([]string, error) {
+	names, err := s.List(ctx, jitRolePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var roles []string
+	for _, roleName := range names {
+		role, err := getJITRole(ctx, s, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role != nil && role.connectionName() == name {
+			roles = append(roles, roleName)
+		}
+	}
+	return roles, nil
+}
+
+// listConnections returns the names of the configured connections, including
+// the default connection when config is set.
+func listConnections(ctx context.Context, s logical.Storage) ([]string, error) {
+	names, err := s.List(ctx, connectionPath)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil && !strutil.StrListContains(names, defaultConnectionName) {
+		// config was written before named connections and is not migrated yet
+		names = append(names, defaultConnectionName)
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// getConnectionConfig returns the config with the connection settings of the
+// named connection, or nil if there is no such connection.
+func getConnectionConfig(ctx context.Context, s logical.Storage, name string) (*db2Config, error) {
+	if name == defaultConnectionName {
+		return getConfig(ctx, s)
+	}
+
+	conn, err := readConfigEntry(ctx, s, connectionPath+name)
+	if err != nil || conn == nil {
+		return nil, err
+	}
+
+	config, err := getSettings(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = new(db2Config)
+	}
+	return config.withConnection(conn), nil
+}
+
+// connectionUnsetError returns the error for using the named connection when
+// it is not configured.
+func connectionUnsetError(name string) error {
+	if name == defaultConnectionName {
+		return errors.New("the config is currently unset")
+	}
+	return fmt.Errorf("connection %q does not exist", name)
+}
+
+// putConnectionConfig stores the connection settings of config as the named
+// connection. The default connection is stored with the rest of config.
+func putConnectionConfig(ctx context.Context, s logical.Storage, name string, config *db2Config) error {
+	if name == defaultConnectionName {
+		return putConfig(ctx, s, config)
+	}
+	return putConfigEntry(ctx, s, connectionPath+name, config.connection())
+}
+
+// migrateConfig moves the connection settings of a config written before
+// named connections to the default connection.
+func (b *db2Backend) migrateConfig(ctx context.Context, s logical.Storage) error {
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	conn, err := s.Get(ctx, connectionPath+defaultConnectionName)
+	if err != nil || conn != nil {
+		return err
+	}
+
+	config, err := readConfigEntry(ctx, s, configStoragePath)
+	if err != nil || config == nil || config.Hostname == "" {
+		return err
+	}
+
+	if err := putConfig(ctx, s, config); err != nil {
+		return err
+	}
+	b.Logger().Info("moved the config's connection to the default connection")
+	return nil
+}
+
+const pathConnectionHelpSynopsis = `Configure a named DB2 connection.`
+
+const pathConnectionHelpDescription = `
+A connection holds the hostname, port and administrative credentials of a
+DB2 server, with the same fields as config. Static roles select one with
+their "connection" field. The connection in config is available as
+"default", which is used by roles that do not name a connection. Jit roles
+select the connection their statements run over in the same way. A
+connection cannot be deleted while static or jit roles use it.
+`
+
+const pathConnectionListHelpSynopsis = `List the configured DB2 connections.`
+
+const pathConnectionListHelpDescription = `
+Lists the names of the configured DB2 connections, including "default"
+when the config is set.
+`
@@ -0,0 +1,339 @@
+package db2secretengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// TestConnections checks that static and jit roles use the connection they
+// name, that each connection has its own client and that a connection in
+// use cannot be deleted.
+func TestConnections(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	db.setPassword(testRotationUsername, testRotationPassword)
+
+	// record the host of every client built
+	var hostnames []string
+	newFakeClient := b.clientFactory
+	b.clientFactory = func(config *db2Config) (*db2Client, error) {
+		hostnames = append(hostnames, config.Hostname)
+		return newFakeClient(config)
+	}
+
+	connectionRequest := func(t *testing.T, operation logical.Operation, name string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: operation,
+			Path:      connectionPath + name,
+			Data:      data,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		resp := connectionRequest(t, logical.ListOperation, "", nil)
+		require.Empty(t, resp.Data["keys"])
+	})
+
+	t.Run("Settings Without Default Connection", func(t *testing.T) {
+		require.NoError(t, testConfigCreate(t, b, s, map[string]interface{}{
+			"lockout_threshold": 3,
+		}))
+
+		config, err := getConfig(ctx, s)
+		require.NoError(t, err)
+		require.Nil(t, config)
+
+		settings, err := getSettings(ctx, s)
+		require.NoError(t, err)
+		require.Equal(t, 3, settings.LockoutThreshold)
+
+		resp := connectionRequest(t, logical.ListOperation, "", nil)
+		require.Empty(t, resp.Data["keys"])
+
+		// a default connection must be complete
+		require.Error(t, testConfigUpdate(t, b, s, map[string]interface{}{
+			"hostname": "west.example.com",
+		}))
+	})
+
+	require.NoError(t, testConfigCreate(t, b, s, map[string]interface{}{
+		"hostname": "west.example.com",
+		"port":     "50000",
+	}))
+
+	t.Run("Create", func(t *testing.T) {
+		resp := connectionRequest(t, logical.CreateOperation, "east", map[string]interface{}{
+			"hostname": "east.example.com",
+			"port":     "50001",
+			"username": "db2admin",
+			"password": "secret",
+		})
+		require.Nil(t, resp)
+
+		resp = connectionRequest(t, logical.ReadOperation, "east", nil)
+		require.Equal(t, "east.example.com", resp.Data["hostname"])
+		require.Equal(t, "db2admin", resp.Data["username"])
+		require.NotContains(t, resp.Data, "password")
+		require.NotContains(t, resp.Data, "lockout_threshold")
+
+		resp = connectionRequest(t, logical.ReadOperation, defaultConnectionName, nil)
+		require.Equal(t, "west.example.com", resp.Data["hostname"])
+
+		resp = connectionRequest(t, logical.ListOperation, "", nil)
+		require.Equal(t, []string{defaultConnectionName, "east"}, resp.Data["keys"])
+
+		// the mount-wide settings apply to every connection
+		config, err := getConnectionConfig(ctx, s, "east")
+		require.NoError(t, err)
+		require.Equal(t, 3, config.LockoutThreshold)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		resp := connectionRequest(t, logical.CreateOperation, "invalid", map[string]interface{}{
+			"hostname": "invalid.example.com",
+			"port":     "50000",
+			"username": "db2admin",
+		})
+		require.True(t, resp.IsError())
+
+		config, err := getConnectionConfig(ctx, s, "invalid")
+		require.NoError(t, err)
+		require.Nil(t, config)
+	})
+
+	t.Run("Role With Unknown Connection", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, "unknown", map[string]interface{}{
+			"username":         testRotationUsername,
+			"current_password": testRotationPassword,
+			"password_policy":  testPasswordPolicy,
+			"database":         "sample",
+			"connection":       "north",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Rotate Over Connection", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, testRotationRole, map[string]interface{}{
+			"username":         testRotationUsername,
+			"current_password": testRotationPassword,
+			"password_policy":  testPasswordPolicy,
+			"database":         "sample",
+			"connection":       "east",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testRotateRole(t, b, s, testRotationRole)
+		require.NoError(t, err)
+		require.Equal(t, db.password(testRotationUsername), resp.Data["current_password"])
+		require.Equal(t, []string{"east.example.com"}, hostnames)
+
+		// the client is reused until the connection changes
+		_, err = testRotateRole(t, b, s, testRotationRole)
+		require.NoError(t, err)
+		require.Equal(t, []string{"east.example.com"}, hostnames)
+
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      staticRolePath + testRotationRole,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, "east", resp.Data["connection"])
+	})
+
+	t.Run("JIT Role", func(t *testing.T) {
+		grant := map[string]interface{}{
+			"grant_statements":  "GRANT DBADM ON DATABASE TO USER {{username}}",
+			"revoke_statements": "REVOKE DBADM ON DATABASE FROM USER {{username}}",
+			"allowed_usernames": "alice",
+			"database":          "sample",
+			"connection":        "north",
+		}
+		resp, err := testJITRoleWrite(t, b, s, grant)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		grant["connection"] = "East"
+		resp, err = testJITRoleWrite(t, b, s, grant)
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		// the default connection has no administrative user, so the grant
+		// only succeeds over east
+		db.setPassword("db2admin", "secret")
+		resp, err = testJITCredRead(t, b, s, "alice")
+		require.NoError(t, err)
+		require.True(t, db.granted("alice", "DBADM"))
+		require.Equal(t, "east", resp.Secret.InternalData["connection"])
+
+		_, err = testJITRevoke(t, b, s, resp.Secret)
+		require.NoError(t, err)
+		require.False(t, db.granted("alice", "DBADM"))
+	})
+
+	t.Run("Invalidate", func(t *testing.T) {
+		client, err := b.getClient(ctx, s, defaultConnectionName)
+		require.NoError(t, err)
+		b.releaseClient(client)
+		closed := db.closed
+
+		b.invalidate(ctx, connectionPath+"east")
+		require.Equal(t, closed+1, db.closed)
+		require.NotContains(t, b.clients, "east")
+		require.Contains(t, b.clients, defaultConnectionName)
+
+		b.invalidate(ctx, configStoragePath)
+		require.Equal(t, closed+2, db.closed)
+		require.Empty(t, b.clients)
+	})
+
+	t.Run("Status", func(t *testing.T) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      statusPath,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+
+		connections := resp.Data["connections"].([]map[string]interface{})
+		require.Len(t, connections, 2)
+		require.Equal(t, defaultConnectionName, connections[0]["name"])
+		require.Equal(t, "east", connections[1]["name"])
+		require.Equal(t, "east.example.com", connections[1]["hostname"])
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		resp := connectionRequest(t, logical.DeleteOperation, "east", nil)
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Error().Error(), testRotationRole)
+
+		resp = connectionRequest(t, logical.DeleteOperation, defaultConnectionName, nil)
+		require.True(t, resp.IsError())
+
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      jitRolePath + "west",
+			Data: map[string]interface{}{
+				"grant_statements":  "GRANT DBADM ON DATABASE TO USER {{username}}",
+				"revoke_statements": "REVOKE DBADM ON DATABASE FROM USER {{username}}",
+				"allowed_usernames": "alice",
+			},
+			Storage: s,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		err = testConfigDelete(t, b, s)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "west")
+		_, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      jitRolePath + "west",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+
+		_, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      staticRolePath + testRotationRole,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+
+		resp = connectionRequest(t, logical.DeleteOperation, "east", nil)
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Error().Error(), testJITRole)
+
+		_, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      jitRolePath + testJITRole,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+
+		resp = connectionRequest(t, logical.DeleteOperation, "east", nil)
+		require.Nil(t, resp)
+
+		resp = connectionRequest(t, logical.ListOperation, "", nil)
+		require.Equal(t, []string{defaultConnectionName}, resp.Data["keys"])
+
+		_, err = b.getClient(ctx, s, "east")
+		require.Error(t, err)
+	})
+}
+
+// TestConnections_Migration checks that a config written before named
+// connections keeps working and is split into the mount-wide settings and
+// the default connection when the backend is initialized.
+func TestConnections_Migration(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	db.setPassword(testRotationUsername, testRotationPassword)
+
+	legacy := &db2Config{
+		Hostname:           "localhost",
+		Port:               "50000",
+		Username:           "db2admin",
+		Password:           "secret",
+		DriftCheckInterval: time.Hour,
+	}
+	entry, err := logical.StorageEntryJSON(configStoragePath, legacy)
+	require.NoError(t, err)
+	require.NoError(t, s.Put(ctx, entry))
+
+	config, err := getConfig(ctx, s)
+	require.NoError(t, err)
+	require.Equal(t, legacy, config)
+
+	names, err := listConnections(ctx, s)
+	require.NoError(t, err)
+	require.Equal(t, []string{defaultConnectionName}, names)
+
+	testRotationSetupRole(t, b, s)
+	_, err = testRotateRole(t, b, s, testRotationRole)
+	require.NoError(t, err)
+
+	require.NoError(t, b.Initialize(ctx, &logical.InitializationRequest{Storage: s}))
+
+	settings, err := readConfigEntry(ctx, s, configStoragePath)
+	require.NoError(t, err)
+	require.Equal(t, &db2Config{DriftCheckInterval: time.Hour}, settings)
+
+	conn, err := readConfigEntry(ctx, s, connectionPath+defaultConnectionName)
+	require.NoError(t, err)
+	require.Equal(t, "localhost", conn.Hostname)
+	require.Equal(t, "secret", conn.Password)
+	require.Zero(t, conn.DriftCheckInterval)
+
+	config, err = getConfig(ctx, s)
+	require.NoError(t, err)
+	require.Equal(t, legacy, config)
+
+	_, err = testRotateRole(t, b, s, testRotationRole)
+	require.NoError(t, err)
+}
+
+// testRotationSetupRole creates the rotation test role on the default
+// connection without writing the config.
+func testRotationSetupRole(t *testing.T, b *db2Backend, s logical.Storage) {
+	t.Helper()
+	resp, err := testTokenRoleCreate(t, b, s, testRotationRole, map[string]interface{}{
+		"username":         testRotationUsername,
+		"current_password": testRotationPassword,
+		"password_policy":  testPasswordPolicy,
+		"database":         "sample",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+}
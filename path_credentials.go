@@ -13,7 +13,6 @@ const (
 	staticCredPath = "static-cred/"
 )
 
-
 // pathCredentials extends the Vault API with a `/creds`
 // endpoint for a role. You can choose whether
 // or not certain attributes should be displayed,
@@ -27,10 +26,9 @@ func pathCredentials(b *db2Backend) *framework.Path {
 				Description: "Name of the role",
 				Required:    true,
 			},
-
 		},
 		Callbacks: map[logical.Operation]framework.OperationFunc{
-			logical.ReadOperation:   b.pathCredentialsRead,
+			logical.ReadOperation: b.pathCredentialsRead,
 		},
 		HelpSynopsis:    pathCredentialsHelpSyn,
 		HelpDescription: pathCredentialsHelpDesc,
@@ -51,18 +49,34 @@ func (b *db2Backend) pathCredentialsRead(ctx context.Context, req *logical.Reque
 		return logical.ErrorResponse("unknown role: %s", name), nil
 	}
 
-	return &logical.Response{
+	out, err := getCheckOut(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if out != nil {
+		return logical.ErrorResponse("role %s is checked out from library set %s", name, out.SetName), nil
+	}
+
+	resp := &logical.Response{
 		Data: map[string]interface{}{
 			"username":            role.Username,
 			"current_password":    role.CurrentPassword,
 			"ttl":                 role.TTL,
 			"rotation_period":     role.RotationPeriod.Seconds(),
+			"rotation_schedule":   role.RotationSchedule,
 			"last_vault_rotation": role.LastVaultRotation,
 		},
-	}, nil
-}
-
+	}
+	if role.autoRotates() {
+		resp.Data["next_vault_rotation"] = role.NextRotationTime()
+	}
+	if role.previousPasswordValid(b.now()) {
+		resp.Data["previous_password"] = role.PreviousPassword
+		resp.Data["previous_password_expires_at"] = role.previousPasswordExpiresAt()
+	}
 
+	return resp, nil
+}
 
 func (s *staticAccount) PasswordTTL() time.Duration {
 	next := s.NextRotationTime()
@@ -0,0 +1,193 @@
+package db2secretengine
+
+import (
+	"context"
+	"errors"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hashicorp/vault/sdk/queue"
+
+	"vault-plugin-secrets-hashicups/db2client"
+)
+
+func pathRoleVerify(b *db2Backend) *framework.Path {
+	return &framework.Path{
+		Pattern: staticRolePath + framework.GenericNameRegex("name") + "/verify",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the role",
+				Required:    true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:                    b.pathRoleVerifyUpdate,
+				ForwardPerformanceStandby:   true,
+				ForwardPerformanceSecondary: true,
+			},
+		},
+		HelpSynopsis:    pathRoleVerifyHelpSynopsis,
+		HelpDescription: pathRoleVerifyHelpDescription,
+	}
+}
+
+func (b *db2Backend) pathRoleVerifyUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	role, err := b.verifyRole(ctx, req.Storage, name)
+	if errors.Is(err, errRoleNotFound) {
+		return logical.ErrorResponse("role doesn't exist: %s", name), nil
+	}
+	if errors.Is(err, errCircuitOpen) {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"out_of_sync":       role.OutOfSync,
+			"last_drift_check":  role.LastDriftCheck,
+			"drift_check_error": role.DriftCheckError,
+		},
+	}, nil
+}
+
+// checkDrift verifies the stored password of every static role when the
+// config's drift_check_interval has elapsed since the last check.
+func (b *db2Backend) checkDrift(ctx context.Context, s logical.Storage) {
+	config, err := getSettings(ctx, s)
+	if err != nil {
+		b.Logger().Warn("unable to load config", "error", err)
+		return
+	}
+	if config == nil || config.DriftCheckInterval == 0 {
+		return
+	}
+
+	now := b.now()
+	if now.Before(b.lastDriftCheck.Add(config.DriftCheckInterval)) {
+		return
+	}
+	b.lastDriftCheck = now
+
+	roles, err := s.List(ctx, staticRolePath)
+	if err != nil {
+		b.Logger().Warn("unable to list static roles", "error", err)
+		return
+	}
+
+	for _, name := range roles {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		_, err := b.verifyRole(ctx, s, name)
+		switch {
+		case err == nil, errors.Is(err, errRoleNotFound):
+		case errors.Is(err, errCircuitOpen):
+			b.Logger().Debug("skipping drift check, the circuit breaker is open", "role", name)
+		default:
+			b.Logger().Warn("unable to check role for drift", "role", name, "error", err)
+		}
+	}
+}
+
+// verifyRole checks under the role's lock whether its stored password still
+// authenticates and records the result on the role. Only DB2 rejecting the
+// password marks the role out of sync; other errors, such as the server
+// being unreachable, are recorded without changing it. A role found to be
+// in sync again is rescheduled for rotation, and one whose password has
+// expired is rotated at the next opportunity.
+func (b *db2Backend) verifyRole(ctx context.Context, s logical.Storage, name string) (*db2RoleEntry, error) {
+	lock := b.roleLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := b.staticRole(ctx, s, name)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, errRoleNotFound
+	}
+	if err := role.circuitError(name, b.now()); err != nil {
+		return nil, err
+	}
+
+	config, err := getConnectionConfig(ctx, s, role.connectionName())
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, connectionUnsetError(role.connectionName())
+	}
+
+	db2Client, err := b.getClient(ctx, s, role.connectionName())
+	if err != nil {
+		return nil, err
+	}
+	defer b.releaseClient(db2Client)
+
+	wasOutOfSync := role.OutOfSync
+	err = db2Client.Verify(ctx, config.connectionInfo(role.Database, role.Username, role.CurrentPassword))
+	role.LastDriftCheck = b.now()
+	role.DriftCheckError = ""
+	expired := errors.Is(err, db2client.ErrPasswordExpired)
+	switch {
+	case err == nil, expired:
+		// an expired password is still the one DB2 has
+		role.OutOfSync = false
+	case errors.Is(err, db2client.ErrInvalidCredentials):
+		role.OutOfSync = true
+	}
+	if err != nil {
+		role.DriftCheckError = describeDB2Error(err)
+	}
+	if role.recordAuthResult(config, err, role.LastDriftCheck) {
+		b.Logger().Warn("authentication failures reached the lockout threshold, opening the circuit breaker", "role", name, "failures", role.AuthFailures, "until", role.CircuitOpenUntil)
+	}
+
+	if err := setRole(ctx, s, name, role); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case role.OutOfSync && !wasOutOfSync:
+		b.Logger().Warn("stored password no longer authenticates, automatic rotation is suspended", "role", name)
+	case !role.OutOfSync && wasOutOfSync:
+		b.Logger().Info("stored password authenticates again, resuming automatic rotation", "role", name)
+	}
+	if err := b.scheduleRotation(name, role); err != nil {
+		return nil, err
+	}
+	if expired && role.autoRotates() {
+		// rotate at the next opportunity rather than leave the user unable
+		// to log in until the role is due
+		b.Logger().Info("stored password has expired, rotating it early", "role", name)
+		if _, err := b.popByKey(name); err != nil {
+			return nil, err
+		}
+		if err := b.pushItem(&queue.Item{Key: name, Priority: b.now().Unix()}); err != nil {
+			return nil, err
+		}
+	}
+
+	return role, nil
+}
+
+const pathRoleVerifyHelpSynopsis = `Check that the stored password of a static role still authenticates.`
+
+const pathRoleVerifyHelpDescription = `
+Connects to DB2 as the role's user with the password Vault has stored. If DB2
+rejects it, the password was changed outside Vault and the role is marked
+out_of_sync: it is no longer rotated automatically. The role is back in sync
+once a check succeeds, a rotation succeeds, or a new current_password is
+written to the role. The same check runs periodically when the config sets
+drift_check_interval.
+`
@@ -0,0 +1,122 @@
+package db2secretengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDrift checks that a role whose password was changed outside Vault is
+// marked out of sync, is skipped by automatic rotation, and resumes once the
+// operator resolves it.
+func TestDrift(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	clock := withTestClock(b)
+	db.setPassword(testRotationUsername, testRotationPassword)
+	testRotationSetup(t, b, s, map[string]interface{}{
+		"rotation_period": "1h",
+	})
+
+	verify := func(t *testing.T) map[string]interface{} {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      staticRolePath + testRotationRole + "/verify",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), resp.Error())
+		return resp.Data
+	}
+	roleRead := func(t *testing.T) map[string]interface{} {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      staticRolePath + testRotationRole,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		return resp.Data
+	}
+
+	t.Run("In Sync", func(t *testing.T) {
+		data := verify(t)
+		require.Equal(t, false, data["out_of_sync"])
+		require.Equal(t, clock.Now(), data["last_drift_check"])
+		require.Equal(t, "", data["drift_check_error"])
+	})
+
+	t.Run("Periodic Check Disabled", func(t *testing.T) {
+		db.setPassword(testRotationUsername, "changed-outside-vault")
+		clock.Add(time.Minute)
+		testTick(t, b, s)
+		require.Equal(t, false, roleRead(t)["out_of_sync"])
+	})
+
+	t.Run("Periodic Check", func(t *testing.T) {
+		require.NoError(t, testConfigUpdate(t, b, s, map[string]interface{}{
+			"drift_check_interval": "10m",
+		}))
+		testTick(t, b, s)
+
+		data := roleRead(t)
+		require.Equal(t, true, data["out_of_sync"])
+		require.Equal(t, clock.Now(), data["last_drift_check"])
+		require.Contains(t, data["drift_check_error"], "SQL30082N")
+
+		// the check is not repeated until the interval has elapsed
+		db.setPassword(testRotationUsername, testRotationPassword)
+		clock.Add(5 * time.Minute)
+		testTick(t, b, s)
+		require.Equal(t, true, roleRead(t)["out_of_sync"])
+		db.setPassword(testRotationUsername, "changed-outside-vault")
+	})
+
+	t.Run("Skipped By Automatic Rotation", func(t *testing.T) {
+		clock.Add(2 * time.Hour)
+		testTick(t, b, s)
+		require.Zero(t, db.rotations)
+		require.Equal(t, "changed-outside-vault", db.password(testRotationUsername))
+		require.Equal(t, true, verify(t)["out_of_sync"])
+	})
+
+	t.Run("Resolved By Current Password", func(t *testing.T) {
+		testRotationRoleUpdate(t, b, s, map[string]interface{}{
+			"current_password": "changed-outside-vault",
+		})
+		data := roleRead(t)
+		require.Equal(t, false, data["out_of_sync"])
+		require.Equal(t, "", data["drift_check_error"])
+
+		testTick(t, b, s)
+		require.Equal(t, 1, db.rotations)
+	})
+
+	t.Run("Resolved By Verify", func(t *testing.T) {
+		current := db.password(testRotationUsername)
+		db.setPassword(testRotationUsername, "changed-again")
+		require.Equal(t, true, verify(t)["out_of_sync"])
+
+		db.setPassword(testRotationUsername, current)
+		require.Equal(t, false, verify(t)["out_of_sync"])
+
+		clock.Add(2 * time.Hour)
+		testTick(t, b, s)
+		require.Equal(t, 2, db.rotations)
+	})
+
+	t.Run("Unknown Role", func(t *testing.T) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      staticRolePath + "missing/verify",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+}
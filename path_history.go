@@ -0,0 +1,179 @@
+package db2secretengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"vault-plugin-secrets-hashicups/db2client"
+)
+
+const (
+	historyPath = "history/"
+
+	// maxRotationHistory is the number of rotation events kept for a role;
+	// older events are dropped as new ones are recorded.
+	maxRotationHistory = 50
+)
+
+// Triggers of a rotation, recorded in a rotationEvent.
+const (
+	triggerManual    = "manual"
+	triggerScheduled = "scheduled"
+	triggerBulk      = "bulk"
+	triggerRecovery  = "recovery"
+	triggerCheckIn   = "check-in"
+)
+
+// Categories of a failed rotation, recorded in a rotationEvent.
+const (
+	errorCategoryConfig             = "config"
+	errorCategoryPasswordGeneration = "password_generation"
+	errorCategoryConnection         = "connection"
+	errorCategoryChange             = "change"
+	errorCategoryVerifyNew          = "verify_new_password"
+	errorCategoryVerifyOldRejected  = "verify_old_password_rejected"
+	errorCategoryStorage            = "storage"
+)
+
+// rotationEvent records one attempt to rotate a static role's password. It
+// never holds a password.
+type rotationEvent struct {
+	Time          time.Time     `json:"time"`
+	Trigger       string        `json:"trigger"`
+	EntityID      string        `json:"entity_id,omitempty"`
+	Username      string        `json:"username"`
+	Success       bool          `json:"success"`
+	ErrorCategory string        `json:"error_category,omitempty"`
+	Duration      time.Duration `json:"duration"`
+}
+
+func (e *rotationEvent) toResponseData() map[string]interface{} {
+	return map[string]interface{}{
+		"time":           e.Time,
+		"trigger":        e.Trigger,
+		"entity_id":      e.EntityID,
+		"username":       e.Username,
+		"success":        e.Success,
+		"error_category": e.ErrorCategory,
+		"duration_ms":    e.Duration.Milliseconds(),
+	}
+}
+
+func pathRoleHistory(b *db2Backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: staticRolePath + framework.GenericNameRegex("name") + "/history",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the role",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathRoleHistoryRead,
+				},
+			},
+			HelpSynopsis:    "Read the rotation history of a static role.",
+			HelpDescription: fmt.Sprintf("This path returns up to the last %d rotation attempts of the role, newest first, with their trigger, the Vault entity that requested them, the outcome, the category of any error and their duration. Passwords are never recorded.", maxRotationHistory),
+		},
+	}
+}
+
+func (b *db2Backend) pathRoleHistoryRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := b.roleLock(name)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	role, err := b.staticRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	history, err := rotationHistory(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]map[string]interface{}, 0, len(history))
+	for i := len(history) - 1; i >= 0; i-- {
+		events = append(events, history[i].toResponseData())
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"events": events,
+		},
+	}, nil
+}
+
+// rotationHistory returns the rotation events of the named role, oldest
+// first.
+func rotationHistory(ctx context.Context, s logical.Storage, name string) ([]*rotationEvent, error) {
+	entry, err := s.Get(ctx, historyPath+name)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving rotation history: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var history []*rotationEvent
+	if err := entry.DecodeJSON(&history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// recordRotationEvent appends event to the history of the named role,
+// dropping the oldest events beyond maxRotationHistory. Callers must hold the
+// role lock. Failures are logged rather than returned so that they never
+// fail a rotation that has already changed the password.
+func (b *db2Backend) recordRotationEvent(ctx context.Context, s logical.Storage, name string, event *rotationEvent) {
+	history, err := rotationHistory(ctx, s, name)
+	if err == nil {
+		history = append(history, event)
+		if len(history) > maxRotationHistory {
+			history = history[len(history)-maxRotationHistory:]
+		}
+
+		var entry *logical.StorageEntry
+		entry, err = logical.StorageEntryJSON(historyPath+name, history)
+		if err == nil {
+			err = s.Put(ctx, entry)
+		}
+	}
+	if err != nil {
+		b.Logger().Warn("unable to record rotation history", "role", name, "error", err)
+	}
+}
+
+// rotationErrorCategory returns the category recorded for a rotation that
+// failed with err during stage, one of the errorCategory constants. A
+// *db2client.RotationError names the phase of the change that failed.
+func rotationErrorCategory(stage string, err error) string {
+	var rotationErr *db2client.RotationError
+	if !errors.As(err, &rotationErr) {
+		return stage
+	}
+
+	switch rotationErr.Phase {
+	case db2client.PhaseVerifyNew:
+		return errorCategoryVerifyNew
+	case db2client.PhaseVerifyOldFails:
+		return errorCategoryVerifyOldRejected
+	default:
+		return errorCategoryChange
+	}
+}
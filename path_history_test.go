@@ -0,0 +1,158 @@
+package db2secretengine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+
+	"vault-plugin-secrets-hashicups/db2client"
+)
+
+// TestRoleHistory checks that every rotation of a static role is recorded
+// with its trigger, entity and outcome, newest first, without passwords.
+func TestRoleHistory(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	clock := withTestClock(b)
+	db.setPassword(testRotationUsername, testRotationPassword)
+	testRotationSetup(t, b, s, map[string]interface{}{
+		"tags": "env:test",
+	})
+
+	var passwords []string
+	remember := func() { passwords = append(passwords, db.password(testRotationUsername)) }
+	remember()
+
+	_, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      rotateRolePath + testRotationRole,
+		Storage:   s,
+		EntityID:  "entity-manual",
+	})
+	require.NoError(t, err)
+	remember()
+
+	clock.Add(time.Minute)
+	_, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "rotate-cred",
+		Data:      map[string]interface{}{"tags": "env:test"},
+		Storage:   s,
+		EntityID:  "entity-bulk",
+	})
+	require.NoError(t, err)
+	remember()
+
+	clock.Add(time.Minute)
+	db.failPhase = db2client.PhaseVerifyNew
+	_, err = testRotateRole(t, b, s, testRotationRole)
+	require.Error(t, err)
+	db.failPhase = ""
+	remember()
+
+	testRotationRoleUpdate(t, b, s, map[string]interface{}{"rotation_period": "1h"})
+	clock.Add(time.Hour)
+	testTick(t, b, s)
+	remember()
+
+	events := testRoleHistoryRead(t, b, s, testRotationRole)
+	require.Len(t, events, 4)
+
+	require.Equal(t, triggerScheduled, events[0]["trigger"])
+	require.Equal(t, true, events[0]["success"])
+	require.Equal(t, "", events[0]["entity_id"])
+
+	require.Equal(t, triggerManual, events[1]["trigger"])
+	require.Equal(t, false, events[1]["success"])
+	require.Equal(t, errorCategoryVerifyNew, events[1]["error_category"])
+
+	require.Equal(t, triggerBulk, events[2]["trigger"])
+	require.Equal(t, "entity-bulk", events[2]["entity_id"])
+	require.Equal(t, true, events[2]["success"])
+
+	require.Equal(t, triggerManual, events[3]["trigger"])
+	require.Equal(t, "entity-manual", events[3]["entity_id"])
+	require.Equal(t, testRotationUsername, events[3]["username"])
+	require.Equal(t, "", events[3]["error_category"])
+
+	raw, err := s.Get(ctx, historyPath+testRotationRole)
+	require.NoError(t, err)
+	for _, password := range passwords {
+		require.NotContains(t, string(raw.Value), password)
+	}
+
+	t.Run("Bounded", func(t *testing.T) {
+		for i := 0; i < maxRotationHistory; i++ {
+			_, err := testRotateRole(t, b, s, testRotationRole)
+			require.NoError(t, err)
+		}
+		events := testRoleHistoryRead(t, b, s, testRotationRole)
+		require.Len(t, events, maxRotationHistory)
+		for _, event := range events {
+			require.Equal(t, triggerManual, event["trigger"])
+		}
+	})
+
+	t.Run("Deleted With Role", func(t *testing.T) {
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      staticRolePath + testRotationRole,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+
+		history, err := rotationHistory(ctx, s, testRotationRole)
+		require.NoError(t, err)
+		require.Empty(t, history)
+
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      staticRolePath + testRotationRole + "/history",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	})
+}
+
+// TestRotationErrorCategory checks how failed rotations are categorized.
+func TestRotationErrorCategory(t *testing.T) {
+	for _, tc := range []struct {
+		stage string
+		err   error
+		want  string
+	}{
+		{errorCategoryConfig, errors.New("the config is currently unset"), errorCategoryConfig},
+		{errorCategoryChange, errors.New("SQL30082N"), errorCategoryChange},
+		{errorCategoryChange, &db2client.RotationError{Phase: db2client.PhaseChange}, errorCategoryChange},
+		{errorCategoryChange, &db2client.RotationError{Phase: db2client.PhaseVerifyNew}, errorCategoryVerifyNew},
+		{errorCategoryChange, fmt.Errorf("wrapped: %w", &db2client.RotationError{Phase: db2client.PhaseVerifyOldFails}), errorCategoryVerifyOldRejected},
+	} {
+		require.Equal(t, tc.want, rotationErrorCategory(tc.stage, tc.err), tc.err.Error())
+	}
+}
+
+func testRoleHistoryRead(t *testing.T, b *db2Backend, s logical.Storage, name string) []map[string]interface{} {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      staticRolePath + name + "/history",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+
+	// round-trip through JSON as the API would
+	raw, err := json.Marshal(resp.Data["events"])
+	require.NoError(t, err)
+	var events []map[string]interface{}
+	require.NoError(t, json.Unmarshal(raw, &events))
+	return events
+}
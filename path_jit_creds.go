@@ -0,0 +1,290 @@
+package db2secretengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"vault-plugin-secrets-hashicups/db2client"
+)
+
+const (
+	jitCredPath  = "jit-cred/"
+	jitGrantType = "db2_jit_grant"
+
+	// jitGrantWALKey is the WAL kind used to record grants whose lease has
+	// not been returned yet.
+	jitGrantWALKey = "jitGrantKey"
+)
+
+// jitGrantWAL records a privilege being granted by a jit role. It is written
+// before the grant statements run and deleted once the lease is returned, so
+// that walRollback revokes a privilege that would otherwise never expire.
+// The grant is cancelled at Deadline, and walRollback leaves the entry alone
+// until then so that it never races with a grant still running.
+type jitGrantWAL struct {
+	Role             string    `json:"role"`
+	Connection       string    `json:"connection,omitempty"`
+	Username         string    `json:"username"`
+	Database         string    `json:"database"`
+	RevokeStatements []string  `json:"revoke_statements"`
+	Deadline         time.Time `json:"deadline"`
+}
+
+// jitGrantTimeout returns the longest a grant over the connection in config
+// may take: connecting and then running its statements.
+func jitGrantTimeout(config *db2Config) time.Duration {
+	connectTimeout := config.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = db2client.DefaultConnectTimeout
+	}
+	statementTimeout := config.StatementTimeout
+	if statementTimeout == 0 {
+		statementTimeout = db2client.DefaultStatementTimeout
+	}
+	return connectTimeout + statementTimeout
+}
+
+func pathJITCredentials(b *db2Backend) *framework.Path {
+	return &framework.Path{
+		Pattern: jitCredPath + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the jit role",
+				Required:    true,
+			},
+			"username": {
+				Type:        framework.TypeString,
+				Description: "The DB2 user to grant the privilege to. May be omitted when the role allows a single user.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback:                    b.pathJITCredentialsRead,
+				ForwardPerformanceStandby:   true,
+				ForwardPerformanceSecondary: true,
+			},
+		},
+		HelpSynopsis:    "Grant the privilege of a jit role to a DB2 user under a lease.",
+		HelpDescription: "Runs the role's grant statements for the user and returns a lease. The privilege is revoked when the lease is revoked or expires.",
+	}
+}
+
+func (b *db2Backend) pathJITCredentialsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	role, err := getJITRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse("unknown jit role: %s", name), nil
+	}
+
+	username := d.Get("username").(string)
+	if username == "" && len(role.AllowedUsernames) == 1 {
+		username = role.AllowedUsernames[0]
+	}
+	if username == "" {
+		return logical.ErrorResponse("missing username"), nil
+	}
+	if !strutil.StrListContains(role.AllowedUsernames, username) {
+		return logical.ErrorResponse("username %q is not allowed by jit role %s", username, name), nil
+	}
+
+	connection := role.connectionName()
+	config, db2Client, err := b.adminConnection(ctx, req.Storage, connection)
+	if err != nil {
+		return nil, err
+	}
+	defer b.releaseClient(db2Client)
+	database := role.Database
+	if database == "" {
+		database = config.Database
+	}
+
+	timeout := jitGrantTimeout(config)
+	walID, err := framework.PutWAL(ctx, req.Storage, jitGrantWALKey, &jitGrantWAL{
+		Role:             name,
+		Connection:       connection,
+		Username:         username,
+		Database:         database,
+		RevokeStatements: role.RevokeStatements,
+		Deadline:         b.now().Add(timeout),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to write WAL entry: %w", err)
+	}
+
+	// On failure the WAL entry is kept: the grant may have taken effect
+	// before the error, and walRollback revokes it.
+	grantCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	statements := renderStatements(role.GrantStatements, username, "")
+	if err := db2Client.Exec(grantCtx, config.connectionInfo(database, config.Username, config.Password), statements); err != nil {
+		return nil, fmt.Errorf("unable to grant jit role %q to %q: %w", name, username, err)
+	}
+
+	resp := b.Secret(jitGrantType).Response(map[string]interface{}{
+		"username": username,
+		"database": database,
+	}, map[string]interface{}{
+		"role":              name,
+		"connection":        connection,
+		"username":          username,
+		"database":          database,
+		"revoke_statements": role.RevokeStatements,
+	})
+	resp.Secret.TTL = role.TTL
+	resp.Secret.MaxTTL = role.MaxTTL
+
+	// The lease now revokes the privilege. Should Vault fail to store the
+	// lease, it revokes the secret straight away.
+	b.deleteWAL(ctx, req.Storage, walID)
+
+	return resp, nil
+}
+
+// jitGrant defines the lease on a privilege granted by a jit role and how it
+// is revoked or renewed.
+func (b *db2Backend) jitGrant() *framework.Secret {
+	return &framework.Secret{
+		Type: jitGrantType,
+		Fields: map[string]*framework.FieldSchema{
+			"username": {
+				Type:        framework.TypeString,
+				Description: "DB2 user holding the privilege",
+			},
+			"database": {
+				Type:        framework.TypeString,
+				Description: "Database the privilege was granted on",
+			},
+		},
+		Revoke: b.jitGrantRevoke,
+		Renew:  b.jitGrantRenew,
+	}
+}
+
+// jitGrantRevoke runs the revoke statements recorded when the privilege was
+// granted. Each statement runs on its own, and one revoking a privilege the
+// user no longer holds counts as done, so a revocation that failed part way
+// can be retried. Any other failure is returned so that Vault retries the
+// revocation.
+func (b *db2Backend) jitGrantRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	username, ok := req.Secret.InternalData["username"].(string)
+	if !ok {
+		return nil, errors.New("secret is missing username internal data")
+	}
+	database, _ := req.Secret.InternalData["database"].(string)
+
+	// leases granted before jit roles named a connection used the default
+	connection, _ := req.Secret.InternalData["connection"].(string)
+	if connection == "" {
+		connection = defaultConnectionName
+	}
+
+	// InternalData is decoded from JSON once the lease has been persisted
+	var revokeStatements []string
+	switch raw := req.Secret.InternalData["revoke_statements"].(type) {
+	case []string:
+		revokeStatements = raw
+	case []interface{}:
+		for _, statement := range raw {
+			if statement, ok := statement.(string); ok {
+				revokeStatements = append(revokeStatements, statement)
+			}
+		}
+	}
+	if len(revokeStatements) == 0 {
+		return nil, errors.New("secret is missing revoke_statements internal data")
+	}
+
+	return nil, b.revokeJITGrant(ctx, req.Storage, connection, username, database, revokeStatements)
+}
+
+// revokeJITGrant runs revokeStatements for username on database over the
+// named connection.
+func (b *db2Backend) revokeJITGrant(ctx context.Context, s logical.Storage, connection, username, database string, revokeStatements []string) error {
+	config, db2Client, err := b.adminConnection(ctx, s, connection)
+	if err != nil {
+		return err
+	}
+	defer b.releaseClient(db2Client)
+
+	for i, statement := range renderStatements(revokeStatements, username, "") {
+		err := db2Client.Exec(ctx, config.connectionInfo(database, config.Username, config.Password), []string{statement})
+		if db2client.IsPrivilegeNotHeld(err) {
+			b.Logger().Debug("privilege already revoked", "username", username, "statement", i+1)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to revoke privilege from %q, statement %d: %w", username, i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// rollbackJITGrant revokes a privilege granted by a jit role whose lease was
+// never returned.
+func (b *db2Backend) rollbackJITGrant(ctx context.Context, req *logical.Request, wal *jitGrantWAL) error {
+	if b.now().Before(wal.Deadline) {
+		return fmt.Errorf("jit grant of role %q to %q may still be running until %s", wal.Role, wal.Username, wal.Deadline.Format(time.RFC3339))
+	}
+	b.Logger().Info("revoking jit grant without a lease", "role", wal.Role, "username", wal.Username)
+	connection := wal.Connection
+	if connection == "" {
+		connection = defaultConnectionName
+	}
+	return b.revokeJITGrant(ctx, req.Storage, connection, wal.Username, wal.Database, wal.RevokeStatements)
+}
+
+// jitGrantRenew extends the lease within the role's TTLs, as long as the role
+// still exists.
+func (b *db2Backend) jitGrantRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, ok := req.Secret.InternalData["role"].(string)
+	if !ok {
+		return nil, errors.New("secret is missing role internal data")
+	}
+
+	role, err := getJITRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, fmt.Errorf("jit role %q no longer exists", name)
+	}
+
+	resp := &logical.Response{Secret: req.Secret}
+	resp.Secret.TTL = role.TTL
+	resp.Secret.MaxTTL = role.MaxTTL
+	return resp, nil
+}
+
+// adminConnection returns the config and a client for running statements as
+// the administrative user of the named connection. The caller must hand the
+// client back with releaseClient.
+func (b *db2Backend) adminConnection(ctx context.Context, s logical.Storage, name string) (*db2Config, *db2Client, error) {
+	config, err := getConnectionConfig(ctx, s, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if config == nil {
+		return nil, nil, connectionUnsetError(name)
+	}
+	if config.Username == "" || config.Password == "" {
+		return nil, nil, fmt.Errorf("connection %q has no administrative username and password", name)
+	}
+
+	db2Client, err := b.getClient(ctx, s, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, db2Client, nil
+}
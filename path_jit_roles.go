@@ -0,0 +1,262 @@
+package db2secretengine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	jitRolePath = "jit-role/"
+)
+
+// jitRoleEntry defines a privilege that is granted to a DB2 user for the
+// lifetime of a lease.
+type jitRoleEntry struct {
+	GrantStatements  []string      `json:"grant_statements"`
+	RevokeStatements []string      `json:"revoke_statements"`
+	AllowedUsernames []string      `json:"allowed_usernames"`
+	Connection       string        `json:"connection,omitempty"`
+	Database         string        `json:"database,omitempty"`
+	TTL              time.Duration `json:"ttl"`
+	MaxTTL           time.Duration `json:"max_ttl"`
+}
+
+// connectionName returns the name of the connection the role's statements
+// run over.
+func (r *jitRoleEntry) connectionName() string {
+	if r.Connection == "" {
+		return defaultConnectionName
+	}
+	return r.Connection
+}
+
+func (r *jitRoleEntry) toResponseData() map[string]interface{} {
+	return map[string]interface{}{
+		"grant_statements":  r.GrantStatements,
+		"revoke_statements": r.RevokeStatements,
+		"allowed_usernames": r.AllowedUsernames,
+		"connection":        r.connectionName(),
+		"database":          r.Database,
+		"ttl":               r.TTL.Seconds(),
+		"max_ttl":           r.MaxTTL.Seconds(),
+	}
+}
+
+func pathJITRole(b *db2Backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: jitRolePath + framework.GenericNameRegex("name"),
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the role",
+					Required:    true,
+				},
+				"grant_statements": {
+					Type:        framework.TypeStringSlice,
+					Description: `Statements run over the administrative connection to grant the privilege, with {{username}} replaced by the target user, e.g. "GRANT DBADM ON DATABASE TO USER {{username}}". They run in a single transaction.`,
+				},
+				"revoke_statements": {
+					Type:        framework.TypeStringSlice,
+					Description: `Statements run over the administrative connection to revoke the privilege when the lease ends, e.g. "REVOKE DBADM ON DATABASE FROM USER {{username}}".`,
+				},
+				"allowed_usernames": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "The DB2 users the privilege may be granted to.",
+				},
+				"connection": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the connection whose administrative user runs the statements. Defaults to the connection in the config.",
+				},
+				"database": {
+					Type:        framework.TypeString,
+					Description: "The database the statements run against. Defaults to the database of the connection.",
+				},
+				"ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "How long the privilege is held before it is revoked. Defaults to the mount's default lease TTL.",
+				},
+				"max_ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "The maximum time the privilege can be held for, including renewals. Defaults to the mount's maximum lease TTL.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathJITRoleRead,
+				},
+				logical.CreateOperation: &framework.PathOperation{
+					Callback: b.pathJITRoleWrite,
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathJITRoleWrite,
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathJITRoleDelete,
+				},
+			},
+			ExistenceCheck:  b.pathJITRoleExistenceCheck,
+			HelpSynopsis:    pathJITRoleHelpSynopsis,
+			HelpDescription: pathJITRoleHelpDescription,
+		},
+		{
+			Pattern: jitRolePath + "?$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathJITRolesList,
+				},
+			},
+			HelpSynopsis:    "List the just-in-time privilege roles.",
+			HelpDescription: "List the names of the roles that grant a privilege under a lease.",
+		},
+	}
+}
+
+func (b *db2Backend) pathJITRoleExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	role, err := getJITRole(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+	return role != nil, nil
+}
+
+func (b *db2Backend) pathJITRolesList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entries, err := req.Storage.List(ctx, jitRolePath)
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(entries), nil
+}
+
+func (b *db2Backend) pathJITRoleRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	role, err := getJITRole(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: role.toResponseData(),
+	}, nil
+}
+
+func (b *db2Backend) pathJITRoleWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	role, err := getJITRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		role = new(jitRoleEntry)
+	}
+
+	if statements, ok := d.GetOk("grant_statements"); ok {
+		role.GrantStatements = statements.([]string)
+	}
+	if statements, ok := d.GetOk("revoke_statements"); ok {
+		role.RevokeStatements = statements.([]string)
+	}
+	if usernames, ok := d.GetOk("allowed_usernames"); ok {
+		role.AllowedUsernames = strutil.RemoveDuplicates(usernames.([]string), false)
+	}
+	if connection, ok := d.GetOk("connection"); ok {
+		role.Connection = connection.(string)
+		if role.Connection == defaultConnectionName {
+			role.Connection = ""
+		}
+	}
+	if database, ok := d.GetOk("database"); ok {
+		role.Database = database.(string)
+	}
+	if ttl, ok := d.GetOk("ttl"); ok {
+		role.TTL = time.Duration(ttl.(int)) * time.Second
+	}
+	if maxTTL, ok := d.GetOk("max_ttl"); ok {
+		role.MaxTTL = time.Duration(maxTTL.(int)) * time.Second
+	}
+
+	if len(role.GrantStatements) == 0 {
+		return logical.ErrorResponse("missing grant_statements in role"), nil
+	}
+	if len(role.RevokeStatements) == 0 {
+		return logical.ErrorResponse("missing revoke_statements in role"), nil
+	}
+	for _, statement := range append(role.GrantStatements, role.RevokeStatements...) {
+		if !strings.Contains(statement, "{{username}}") {
+			return logical.ErrorResponse("grant_statements and revoke_statements must use {{username}}: %q", statement), nil
+		}
+	}
+	if len(role.AllowedUsernames) == 0 {
+		return logical.ErrorResponse("missing allowed_usernames in role"), nil
+	}
+	if role.MaxTTL != 0 && role.TTL > role.MaxTTL {
+		return logical.ErrorResponse("ttl cannot be greater than max_ttl"), nil
+	}
+
+	// configLock keeps the connection from being deleted until the role is stored
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	if role.Connection != "" {
+		config, err := getConnectionConfig(ctx, req.Storage, role.Connection)
+		if err != nil {
+			return nil, err
+		}
+		if config == nil {
+			return logical.ErrorResponse("connection %q does not exist", role.Connection), nil
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON(jitRolePath+name, role)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *db2Backend) pathJITRoleDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, jitRolePath+d.Get("name").(string)); err != nil {
+		return nil, fmt.Errorf("error deleting jit role: %w", err)
+	}
+	return nil, nil
+}
+
+func getJITRole(ctx context.Context, s logical.Storage, name string) (*jitRoleEntry, error) {
+	entry, err := s.Get(ctx, jitRolePath+name)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving jit role: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	role := new(jitRoleEntry)
+	if err := entry.DecodeJSON(role); err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+const pathJITRoleHelpSynopsis = `Manage a privilege that is granted to DB2 users under a lease.`
+
+const pathJITRoleHelpDescription = `
+A just-in-time role holds the statements that grant a privilege to a DB2
+user and revoke it again. They run as the administrative user of the role's
+connection, which defaults to the connection in the config. Reading "jit-cred/<name>" grants the privilege to one of the role's
+allowed_usernames under a lease, and the revoke statements run when the lease
+is revoked or expires. Leases that are already granted keep the revoke
+statements, connection and database the role had at the time.
+`
@@ -0,0 +1,216 @@
+package db2secretengine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+
+	"vault-plugin-secrets-hashicups/db2client"
+)
+
+const (
+	testJITRole          = "dba"
+	testJITAdmin         = "admin"
+	testJITAdminPassword = "Admin!123"
+)
+
+// TestJITRole checks validation of jit roles.
+func TestJITRole(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	for _, d := range []map[string]interface{}{
+		{"revoke_statements": "REVOKE DBADM ON DATABASE FROM USER {{username}}", "allowed_usernames": "alice"},
+		{"grant_statements": "GRANT DBADM ON DATABASE TO USER {{username}}", "allowed_usernames": "alice"},
+		{"grant_statements": "GRANT DBADM ON DATABASE TO USER {{username}}", "revoke_statements": "REVOKE DBADM ON DATABASE FROM USER {{username}}"},
+		{"grant_statements": "GRANT DBADM ON DATABASE TO USER alice", "revoke_statements": "REVOKE DBADM ON DATABASE FROM USER {{username}}", "allowed_usernames": "alice"},
+		{"grant_statements": "GRANT DBADM ON DATABASE TO USER {{username}}", "revoke_statements": "REVOKE DBADM ON DATABASE FROM USER {{username}}", "allowed_usernames": "alice", "ttl": "2h", "max_ttl": "1h"},
+	} {
+		resp, err := testJITRoleWrite(t, b, s, d)
+		require.NoError(t, err)
+		require.True(t, resp.IsError(), "%v", d)
+	}
+
+	resp, err := testJITRoleWrite(t, b, s, map[string]interface{}{
+		"grant_statements":  "GRANT DBADM ON DATABASE TO USER {{username}}",
+		"revoke_statements": "REVOKE DBADM ON DATABASE FROM USER {{username}}",
+		"allowed_usernames": "alice,bob,alice",
+		"ttl":               "1h",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      jitRolePath + testJITRole,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice", "bob"}, resp.Data["allowed_usernames"])
+	require.Equal(t, float64(3600), resp.Data["ttl"])
+}
+
+// TestJITCredentials checks that reading jit-cred grants the privilege under
+// a lease and that revoking the lease takes it away again, even when retried.
+func TestJITCredentials(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	clock := withTestClock(b)
+	db.setPassword(testJITAdmin, testJITAdminPassword)
+	require.NoError(t, testConfigCreate(t, b, s, map[string]interface{}{
+		"hostname": "localhost",
+		"port":     "50000",
+		"username": testJITAdmin,
+		"password": testJITAdminPassword,
+		"database": "sample",
+	}))
+	resp, err := testJITRoleWrite(t, b, s, map[string]interface{}{
+		"grant_statements":  []string{"GRANT DBADM ON DATABASE TO USER {{username}}", "GRANT SECADM ON DATABASE TO USER {{username}}"},
+		"revoke_statements": []string{"REVOKE DBADM ON DATABASE FROM USER {{username}}", "REVOKE SECADM ON DATABASE FROM USER {{username}}"},
+		"allowed_usernames": "alice,bob",
+		"ttl":               "15m",
+		"max_ttl":           "1h",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	t.Run("Username Not Allowed", func(t *testing.T) {
+		for _, username := range []string{"", "mallory"} {
+			resp, err := testJITCredRead(t, b, s, username)
+			require.NoError(t, err)
+			require.True(t, resp.IsError())
+		}
+		require.Empty(t, db.statements)
+	})
+
+	t.Run("Grant Failure", func(t *testing.T) {
+		db.execErr = errors.New("SQL30081N A communication error has been detected")
+		defer func() { db.execErr = nil }()
+
+		_, err := testJITCredRead(t, b, s, "alice")
+		require.Error(t, err)
+
+		// the grant may have taken effect before the error, so the WAL
+		// entry is kept and rolling it back revokes the privilege
+		wals, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Len(t, wals, 1)
+
+		db.execErr = nil
+		require.NoError(t, db.Exec(ctx, db2client.ConnectionInfo{Database: "sample", Username: testJITAdmin, Password: testJITAdminPassword}, []string{"GRANT DBADM ON DATABASE TO USER alice"}))
+
+		// a grant that may still be running is left alone
+		testWALRollback(t, b, s)
+		require.True(t, db.granted("alice", "DBADM"))
+
+		clock.Add(db2client.DefaultConnectTimeout + db2client.DefaultStatementTimeout)
+		testWALRollback(t, b, s)
+		require.False(t, db.granted("alice", "DBADM"))
+
+		wals, err = framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Empty(t, wals)
+	})
+
+	resp, err = testJITCredRead(t, b, s, "alice")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Equal(t, "alice", resp.Data["username"])
+	require.Equal(t, "sample", resp.Data["database"])
+	require.Equal(t, 15*time.Minute, resp.Secret.TTL)
+	require.Equal(t, time.Hour, resp.Secret.MaxTTL)
+	require.True(t, db.granted("alice", "DBADM"))
+	require.True(t, db.granted("alice", "SECADM"))
+	require.False(t, db.granted("bob", "DBADM"))
+
+	// the lease revokes the grant from here on
+	wals, err := framework.ListWAL(ctx, s)
+	require.NoError(t, err)
+	require.Empty(t, wals)
+
+	// Vault persists the lease, so revocation sees JSON-decoded internal data
+	raw, err := json.Marshal(resp.Secret)
+	require.NoError(t, err)
+	var secret logical.Secret
+	require.NoError(t, json.Unmarshal(raw, &secret))
+
+	t.Run("Renew", func(t *testing.T) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RenewOperation,
+			Secret:    &secret,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, 15*time.Minute, resp.Secret.TTL)
+	})
+
+	t.Run("Revoke Failure", func(t *testing.T) {
+		db.execErr = errors.New("SQL30081N A communication error has been detected")
+		defer func() { db.execErr = nil }()
+
+		_, err := testJITRevoke(t, b, s, &secret)
+		require.Error(t, err)
+		require.True(t, db.granted("alice", "DBADM"))
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		_, err := testJITRevoke(t, b, s, &secret)
+		require.NoError(t, err)
+		require.False(t, db.granted("alice", "DBADM"))
+		require.False(t, db.granted("alice", "SECADM"))
+	})
+
+	t.Run("Revoke Is Idempotent", func(t *testing.T) {
+		// a revocation that stopped after the first statement is retried
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      jitCredPath + testJITRole,
+			Data:      map[string]interface{}{"username": "alice"},
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.NoError(t, db.Exec(ctx, db2client.ConnectionInfo{Database: "sample", Username: testJITAdmin, Password: testJITAdminPassword}, []string{"REVOKE DBADM ON DATABASE FROM USER alice"}))
+
+		_, err = testJITRevoke(t, b, s, &secret)
+		require.NoError(t, err)
+		require.False(t, db.granted("alice", "SECADM"))
+
+		_, err = testJITRevoke(t, b, s, &secret)
+		require.NoError(t, err)
+	})
+}
+
+func testJITRoleWrite(t *testing.T, b *db2Backend, s logical.Storage, d map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      jitRolePath + testJITRole,
+		Data:      d,
+		Storage:   s,
+	})
+}
+
+func testJITCredRead(t *testing.T, b *db2Backend, s logical.Storage, username string) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      jitCredPath + testJITRole,
+		Data:      map[string]interface{}{"username": username},
+		Storage:   s,
+	})
+}
+
+func testJITRevoke(t *testing.T, b *db2Backend, s logical.Storage, secret *logical.Secret) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    secret,
+		Storage:   s,
+	})
+}
@@ -0,0 +1,423 @@
+package db2secretengine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	libraryPath  = "library/"
+	checkOutPath = "checkout/"
+)
+
+// librarySet is a pool of static roles whose accounts are lent out one
+// borrower at a time.
+type librarySet struct {
+	ServiceAccountNames []string      `json:"service_account_names"`
+	TTL                 time.Duration `json:"ttl"`
+	MaxTTL              time.Duration `json:"max_ttl"`
+}
+
+// checkOut records who has borrowed the account of a static role. An account
+// is available when it has no checkOut.
+type checkOut struct {
+	SetName          string    `json:"set_name"`
+	BorrowerEntityID string    `json:"borrower_entity_id"`
+	CheckedOutAt     time.Time `json:"checked_out_at"`
+}
+
+func pathLibrary(b *db2Backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: libraryPath + framework.GenericNameRegex("name"),
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the set",
+					Required:    true,
+				},
+				"service_account_names": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "The static roles whose accounts are lent out by this set. A role can belong to only one set.",
+				},
+				"ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "How long an account is checked out for before it is checked back in. Defaults to the mount's default lease TTL.",
+				},
+				"max_ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "The maximum time an account can be checked out for, including renewals. Defaults to the mount's maximum lease TTL.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathLibraryRead,
+				},
+				logical.CreateOperation: &framework.PathOperation{
+					Callback: b.pathLibraryWrite,
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathLibraryWrite,
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathLibraryDelete,
+				},
+			},
+			ExistenceCheck:  b.pathLibraryExistenceCheck,
+			HelpSynopsis:    pathLibraryHelpSynopsis,
+			HelpDescription: pathLibraryHelpDescription,
+		},
+		{
+			Pattern: libraryPath + framework.GenericNameRegex("name") + "/check-out",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the set",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:                    b.pathLibraryCheckOut,
+					ForwardPerformanceStandby:   true,
+					ForwardPerformanceSecondary: true,
+				},
+			},
+			HelpSynopsis:    pathLibraryCheckOutHelpSynopsis,
+			HelpDescription: pathLibraryCheckOutHelpDescription,
+		},
+		{
+			Pattern: libraryPath + framework.GenericNameRegex("name") + "/status",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the set",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathLibraryStatus,
+				},
+			},
+			HelpSynopsis:    "Report which accounts of a set are checked out.",
+			HelpDescription: "This path reports, for every account in the set, whether it is available and, if not, who borrowed it and when.",
+		},
+		{
+			Pattern: libraryPath + "?$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathLibraryList,
+				},
+			},
+			HelpSynopsis:    "List the library sets.",
+			HelpDescription: "List the names of the sets of service accounts that can be checked out.",
+		},
+	}
+}
+
+func (b *db2Backend) pathLibraryExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	set, err := getLibrarySet(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+	return set != nil, nil
+}
+
+func (b *db2Backend) pathLibraryList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entries, err := req.Storage.List(ctx, libraryPath)
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(entries), nil
+}
+
+func (b *db2Backend) pathLibraryRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	set, err := getLibrarySet(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"service_account_names": set.ServiceAccountNames,
+			"ttl":                   set.TTL.Seconds(),
+			"max_ttl":               set.MaxTTL.Seconds(),
+		},
+	}, nil
+}
+
+func (b *db2Backend) pathLibraryWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	b.libraryLock.Lock()
+	defer b.libraryLock.Unlock()
+
+	set, err := getLibrarySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		set = new(librarySet)
+	}
+
+	if names, ok := d.GetOk("service_account_names"); ok {
+		set.ServiceAccountNames = strutil.RemoveDuplicates(names.([]string), true)
+	}
+	if ttl, ok := d.GetOk("ttl"); ok {
+		set.TTL = time.Duration(ttl.(int)) * time.Second
+	}
+	if maxTTL, ok := d.GetOk("max_ttl"); ok {
+		set.MaxTTL = time.Duration(maxTTL.(int)) * time.Second
+	}
+
+	if len(set.ServiceAccountNames) == 0 {
+		return logical.ErrorResponse("missing service_account_names in set"), nil
+	}
+	if set.MaxTTL != 0 && set.TTL > set.MaxTTL {
+		return logical.ErrorResponse("ttl cannot be greater than max_ttl"), nil
+	}
+
+	sets, err := req.Storage.List(ctx, libraryPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, roleName := range set.ServiceAccountNames {
+		role, err := b.staticRole(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return logical.ErrorResponse("service account %q is not a static role", roleName), nil
+		}
+
+		for _, other := range sets {
+			if other == name {
+				continue
+			}
+			otherSet, err := getLibrarySet(ctx, req.Storage, other)
+			if err != nil {
+				return nil, err
+			}
+			if otherSet != nil && strutil.StrListContains(otherSet.ServiceAccountNames, roleName) {
+				return logical.ErrorResponse("service account %q already belongs to set %q", roleName, other), nil
+			}
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON(libraryPath+name, set)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *db2Backend) pathLibraryDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	b.libraryLock.Lock()
+	defer b.libraryLock.Unlock()
+
+	set, err := getLibrarySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		return nil, nil
+	}
+
+	// Deleting the set while accounts are lent out would leave their leases
+	// unable to check them back in.
+	for _, roleName := range set.ServiceAccountNames {
+		out, err := getCheckOut(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if out != nil && out.SetName == name {
+			return logical.ErrorResponse("service account %q is checked out; revoke its lease before deleting the set", roleName), nil
+		}
+	}
+
+	if err := req.Storage.Delete(ctx, libraryPath+name); err != nil {
+		return nil, fmt.Errorf("error deleting library set: %w", err)
+	}
+	return nil, nil
+}
+
+// pathLibraryCheckOut lends the first available account of the set to the
+// caller under a lease. The account is checked back in, and its password
+// rotated, when the lease is revoked or expires.
+func (b *db2Backend) pathLibraryCheckOut(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	set, err := getLibrarySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		return logical.ErrorResponse("set doesn't exist: %s", name), nil
+	}
+
+	for _, roleName := range set.ServiceAccountNames {
+		resp, err := b.checkOutAccount(ctx, req, name, set, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if resp != nil {
+			return resp, nil
+		}
+	}
+
+	return logical.ErrorResponse("no accounts are available to check out in set %q", name), nil
+}
+
+// checkOutAccount lends the account of the named role if it is available,
+// returning nil if it is already checked out, or if its stored password is
+// known to be out of sync or its rotations are suspended by the circuit
+// breaker, since the password lent might not work.
+func (b *db2Backend) checkOutAccount(ctx context.Context, req *logical.Request, setName string, set *librarySet, roleName string) (*logical.Response, error) {
+	lock := b.roleLock(roleName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	out, err := getCheckOut(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if out != nil {
+		return nil, nil
+	}
+
+	role, err := b.staticRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		b.Logger().Warn("library set refers to a missing static role", "set", setName, "role", roleName)
+		return nil, nil
+	}
+	if role.OutOfSync || role.circuitOpen(b.now()) {
+		b.Logger().Debug("skipping an account that cannot be lent", "set", setName, "role", roleName)
+		return nil, nil
+	}
+
+	entry, err := logical.StorageEntryJSON(checkOutPath+roleName, &checkOut{
+		SetName:          setName,
+		BorrowerEntityID: req.EntityID,
+		CheckedOutAt:     b.now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	resp := b.Secret(libraryAccountType).Response(map[string]interface{}{
+		"service_account_name": roleName,
+		"username":             role.Username,
+		"password":             role.CurrentPassword,
+	}, map[string]interface{}{
+		"set_name":  setName,
+		"role_name": roleName,
+	})
+	resp.Secret.TTL = set.TTL
+	resp.Secret.MaxTTL = set.MaxTTL
+	return resp, nil
+}
+
+func (b *db2Backend) pathLibraryStatus(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	set, err := getLibrarySet(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		return nil, nil
+	}
+
+	accounts := make(map[string]interface{}, len(set.ServiceAccountNames))
+	for _, roleName := range set.ServiceAccountNames {
+		out, err := getCheckOut(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+
+		status := map[string]interface{}{"available": out == nil}
+		if out != nil {
+			status["borrower_entity_id"] = out.BorrowerEntityID
+			status["checked_out_at"] = out.CheckedOutAt
+		}
+		accounts[roleName] = status
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"accounts": accounts,
+		},
+	}, nil
+}
+
+func getLibrarySet(ctx context.Context, s logical.Storage, name string) (*librarySet, error) {
+	entry, err := s.Get(ctx, libraryPath+name)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving library set: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	set := new(librarySet)
+	if err := entry.DecodeJSON(set); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// getCheckOut returns the check-out of the named role's account, or nil if
+// the account is not checked out.
+func getCheckOut(ctx context.Context, s logical.Storage, roleName string) (*checkOut, error) {
+	entry, err := s.Get(ctx, checkOutPath+roleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving check-out: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	out := new(checkOut)
+	if err := entry.DecodeJSON(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+const pathLibraryHelpSynopsis = `Manage a set of service accounts that can be checked out.`
+
+const pathLibraryHelpDescription = `
+A library set lends the accounts of its static roles to one borrower at a
+time. Accounts are checked out at "library/<set>/check-out" under a lease.
+When the lease is revoked or expires the account is checked back in and its
+password rotated, so the borrower's copy no longer works. While checked out,
+an account is not rotated automatically and its credentials cannot be read
+from "static-cred/".
+`
+
+const pathLibraryCheckOutHelpSynopsis = `Check out an account from a library set.`
+
+const pathLibraryCheckOutHelpDescription = `
+Returns the username and password of an available account in the set under
+a lease. The account is checked back in, and its password rotated, when the
+lease is revoked or expires.
+`
@@ -0,0 +1,253 @@
+package db2secretengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+
+	"vault-plugin-secrets-hashicups/db2client"
+)
+
+// TestLibrary checks that library accounts are lent to one borrower at a
+// time and rotated when their lease is revoked.
+func TestLibrary(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	clock := withTestClock(b)
+	require.NoError(t, testConfigCreate(t, b, s, map[string]interface{}{
+		"hostname": "localhost",
+		"port":     "50000",
+	}))
+	for _, name := range []string{"svc1", "svc2"} {
+		db.setPassword(name, testRotationPassword)
+		_, err := testTokenRoleCreate(t, b, s, name, map[string]interface{}{
+			"username":         name,
+			"current_password": testRotationPassword,
+			"password_policy":  testPasswordPolicy,
+			"database":         "sample",
+			"rotation_period":  "1h",
+		})
+		require.NoError(t, err)
+	}
+	// the first tick rotates both never rotated roles
+	testTick(t, b, s)
+	require.Equal(t, 2, db.rotations)
+
+	t.Run("Invalid Set", func(t *testing.T) {
+		for _, d := range []map[string]interface{}{
+			{},
+			{"service_account_names": "svc1,missing"},
+			{"service_account_names": "svc1", "ttl": "2h", "max_ttl": "1h"},
+		} {
+			resp, err := testLibraryWrite(t, b, s, "invalid", d)
+			require.NoError(t, err)
+			require.True(t, resp.IsError(), "%v", d)
+		}
+	})
+
+	resp, err := testLibraryWrite(t, b, s, "pool", map[string]interface{}{
+		"service_account_names": "svc1,svc2",
+		"ttl":                   "1h",
+		"max_ttl":               "2h",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	t.Run("Account In One Set", func(t *testing.T) {
+		resp, err := testLibraryWrite(t, b, s, "other", map[string]interface{}{
+			"service_account_names": "svc2",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Delete Member", func(t *testing.T) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      staticRolePath + "svc2",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Error().Error(), "pool")
+	})
+
+	t.Run("Unusable Accounts", func(t *testing.T) {
+		role, err := b.staticRole(ctx, s, "svc1")
+		require.NoError(t, err)
+
+		for _, unusable := range []func(role *db2RoleEntry){
+			func(role *db2RoleEntry) { role.OutOfSync = true },
+			func(role *db2RoleEntry) { role.CircuitOpenUntil = b.now().Add(time.Minute) },
+		} {
+			broken := *role
+			unusable(&broken)
+			require.NoError(t, setRole(ctx, s, "svc1", &broken))
+
+			out := testLibraryCheckOut(t, b, s, "pool")
+			require.Equal(t, "svc2", out.Data["username"])
+			require.NoError(t, s.Delete(ctx, checkOutPath+"svc2"))
+		}
+		require.NoError(t, setRole(ctx, s, "svc1", role))
+	})
+
+	first := testLibraryCheckOut(t, b, s, "pool")
+	require.Equal(t, "svc1", first.Data["username"])
+	require.Equal(t, db.password("svc1"), first.Data["password"])
+	require.Equal(t, time.Hour, first.Secret.TTL)
+	require.Equal(t, 2*time.Hour, first.Secret.MaxTTL)
+
+	second := testLibraryCheckOut(t, b, s, "pool")
+	require.Equal(t, "svc2", second.Data["username"])
+
+	t.Run("Exhausted", func(t *testing.T) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      libraryPath + "pool/check-out",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Checked Out", func(t *testing.T) {
+		status := testLibraryStatus(t, b, s, "pool")
+		require.Equal(t, false, status["svc1"].(map[string]interface{})["available"])
+		require.Equal(t, "entity-1", status["svc1"].(map[string]interface{})["borrower_entity_id"])
+
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      staticCredPath + "svc1",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		resp, err = testLibraryDelete(t, b, s, "pool")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      staticRolePath + "svc1",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Error().Error(), "checked out")
+
+		// neither does an operator rotation, which would also return the
+		// borrower's password
+		resp, err = testRotateRole(t, b, s, "svc1")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.NotContains(t, resp.Data, "current_password")
+
+		resp, err = testRotateBulk(t, b, s, map[string]interface{}{"all": true})
+		require.NoError(t, err)
+		require.Equal(t, 0, resp.Data["rotated"])
+		require.Equal(t, 2, resp.Data["skipped"])
+		require.Equal(t, true, resp.Data["roles"].(map[string]interface{})["svc1"].(map[string]interface{})["skipped"])
+		require.Equal(t, first.Data["password"], db.password("svc1"))
+		require.Equal(t, second.Data["password"], db.password("svc2"))
+
+		// auto-rotation waits for the check-in
+		clock.Add(2 * time.Hour)
+		testTick(t, b, s)
+		require.Equal(t, first.Data["password"], db.password("svc1"))
+	})
+
+	t.Run("Renew", func(t *testing.T) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RenewOperation,
+			Secret:    first.Secret,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, time.Hour, resp.Secret.TTL)
+	})
+
+	t.Run("Failed Check-In", func(t *testing.T) {
+		db.failPhase = db2client.PhaseChange
+		defer func() { db.failPhase = "" }()
+
+		_, err := testLibraryRevoke(t, b, s, first)
+		require.Error(t, err)
+		require.Equal(t, false, testLibraryStatus(t, b, s, "pool")["svc1"].(map[string]interface{})["available"])
+	})
+
+	t.Run("Check-In", func(t *testing.T) {
+		resp, err := testLibraryRevoke(t, b, s, first)
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		require.NotEqual(t, first.Data["password"], db.password("svc1"))
+		role, err := b.staticRole(ctx, s, "svc1")
+		require.NoError(t, err)
+		require.Equal(t, db.password("svc1"), role.CurrentPassword)
+
+		require.Equal(t, true, testLibraryStatus(t, b, s, "pool")["svc1"].(map[string]interface{})["available"])
+		require.Equal(t, triggerCheckIn, testRoleHistoryRead(t, b, s, "svc1")[0]["trigger"])
+
+		again := testLibraryCheckOut(t, b, s, "pool")
+		require.Equal(t, "svc1", again.Data["username"])
+		require.Equal(t, role.CurrentPassword, again.Data["password"])
+	})
+}
+
+func testLibraryWrite(t *testing.T, b *db2Backend, s logical.Storage, name string, d map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      libraryPath + name,
+		Data:      d,
+		Storage:   s,
+	})
+}
+
+func testLibraryDelete(t *testing.T, b *db2Backend, s logical.Storage, name string) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      libraryPath + name,
+		Storage:   s,
+	})
+}
+
+func testLibraryCheckOut(t *testing.T, b *db2Backend, s logical.Storage, name string) *logical.Response {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      libraryPath + name + "/check-out",
+		Storage:   s,
+		EntityID:  "entity-1",
+	})
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.NotNil(t, resp.Secret)
+	return resp
+}
+
+func testLibraryRevoke(t *testing.T, b *db2Backend, s logical.Storage, checkOut *logical.Response) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    checkOut.Secret,
+		Storage:   s,
+	})
+}
+
+func testLibraryStatus(t *testing.T, b *db2Backend, s logical.Storage, name string) map[string]interface{} {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      libraryPath + name + "/status",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	return resp.Data["accounts"].(map[string]interface{})
+}
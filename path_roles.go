@@ -3,26 +3,33 @@ package db2secretengine
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/robfig/cron/v3"
 )
 
-
 const (
 	staticRolePath = "static-role/"
 )
 
 // db2RoleEntry defines all the db2 users that are to be managed in the designated db2 database.
 type db2RoleEntry struct {
-	Username string        `json:"username"`
-	TTL      time.Duration `json:"ttl"`
-	PasswordPolicy string `json:"password_policy,omitempty"`
-	PasswordLength int `json:"length,omitempty"`
-	Database string `json:"database"`
-	CurrentPassword string `json:"current_password"`
-	NewPassword string `json:"new_password"`
+	Username        string        `json:"username"`
+	Tags            []string      `json:"tags,omitempty"`
+	TTL             time.Duration `json:"ttl"`
+	PasswordPolicy  string        `json:"password_policy,omitempty"`
+	PasswordLength  int           `json:"length,omitempty"`
+	Database        string        `json:"database"`
+	CurrentPassword string        `json:"current_password"`
+
+	// Connection names the connection to the DB2 server the user is on. If
+	// empty, the default connection in config is used.
+	Connection string `json:"connection,omitempty"`
+
 	// LastVaultRotation represents the last time Vault rotated the password
 	LastVaultRotation time.Time `json:"last_vault_rotation"`
 
@@ -30,24 +37,206 @@ type db2RoleEntry struct {
 	// "time to live". This value is compared to the LastVaultRotation to
 	// determine if a password needs to be rotated
 	RotationPeriod time.Duration `json:"rotation_period"`
+
+	// RotationStatements, when set, are run over the administrative
+	// connection in the config to change the password instead of the NEWPWD
+	// connection attribute. {{username}} and {{password}} are substituted.
+	RotationStatements []string `json:"rotation_statements,omitempty"`
+
+	// RotationMechanism selects how the password is changed, one of the
+	// mechanism constants. If empty, RotationStatements are used when set
+	// and NEWPWD otherwise.
+	RotationMechanism string `json:"rotation_mechanism,omitempty"`
+
+	// RotationSchedule is a standard cron expression, evaluated in
+	// RotationTimezone, used instead of RotationPeriod to decide when the
+	// password is rotated. If RotationWindow is set, scheduled rotations
+	// only happen within that long after each scheduled time.
+	RotationSchedule string        `json:"rotation_schedule,omitempty"`
+	RotationWindow   time.Duration `json:"rotation_window,omitempty"`
+	RotationTimezone string        `json:"rotation_timezone,omitempty"`
+
+	// NextVaultRotation is the next scheduled rotation time of a role with a
+	// RotationSchedule.
+	NextVaultRotation time.Time `json:"next_vault_rotation,omitempty"`
+
+	// GracePeriod is how long the password replaced by a rotation stays
+	// readable as PreviousPassword. PreviousVaultRotation is the time it was
+	// replaced.
+	GracePeriod           time.Duration `json:"grace_period,omitempty"`
+	PreviousPassword      string        `json:"previous_password,omitempty"`
+	PreviousVaultRotation time.Time     `json:"previous_vault_rotation,omitempty"`
+
+	// LastRotationAttempt, LastRotationError and ConsecutiveFailures record
+	// the outcome of the most recent rotations so failures are visible to
+	// operators and retries can back off.
+	LastRotationAttempt time.Time `json:"last_rotation_attempt"`
+	LastRotationError   string    `json:"last_rotation_error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures,omitempty"`
+
+	// OutOfSync is set when CurrentPassword no longer authenticates, because
+	// the password was changed outside Vault. The role is not rotated
+	// automatically while it is set. LastDriftCheck and DriftCheckError
+	// record the most recent check.
+	OutOfSync       bool      `json:"out_of_sync,omitempty"`
+	LastDriftCheck  time.Time `json:"last_drift_check,omitempty"`
+	DriftCheckError string    `json:"drift_check_error,omitempty"`
+
+	// AuthFailures counts consecutive attempts to authenticate as the role's
+	// user that DB2 rejected. Once it reaches the config's lockout_threshold
+	// the role's circuit breaker is open until CircuitOpenUntil.
+	AuthFailures     int       `json:"auth_failures,omitempty"`
+	CircuitOpenUntil time.Time `json:"circuit_open_until,omitempty"`
+}
+
+// NextRotationTime returns the time at which the role is next due for
+// rotation.
+func (r *db2RoleEntry) NextRotationTime() time.Time {
+	if r.RotationSchedule != "" {
+		return r.NextVaultRotation
+	}
+	return r.LastVaultRotation.Add(r.RotationPeriod)
+}
+
+// setRotatedPassword records a successful rotation to password at
+// rotatedAt, keeping the replaced password for the grace period.
+func (r *db2RoleEntry) setRotatedPassword(password string, rotatedAt time.Time) error {
+	r.PreviousPassword = ""
+	r.PreviousVaultRotation = time.Time{}
+	if r.GracePeriod != 0 {
+		r.PreviousPassword = r.CurrentPassword
+		r.PreviousVaultRotation = rotatedAt
+	}
+
+	r.CurrentPassword = password
+	r.OutOfSync = false
+	r.LastVaultRotation = rotatedAt
+	return r.setNextVaultRotation(rotatedAt)
+}
+
+// previousPasswordExpiresAt returns when the previous password stops being
+// readable.
+func (r *db2RoleEntry) previousPasswordExpiresAt() time.Time {
+	return r.PreviousVaultRotation.Add(r.GracePeriod)
+}
+
+// previousPasswordValid reports whether the previous password is still in
+// its grace period at now.
+func (r *db2RoleEntry) previousPasswordValid(now time.Time) bool {
+	return r.PreviousPassword != "" && now.Before(r.previousPasswordExpiresAt())
+}
+
+// connectionName returns the name of the connection the role uses.
+func (r *db2RoleEntry) connectionName() string {
+	if r.Connection == "" {
+		return defaultConnectionName
+	}
+	return r.Connection
+}
+
+// mechanism returns how the role's password is changed.
+func (r *db2RoleEntry) mechanism() string {
+	switch {
+	case r.RotationMechanism != "":
+		return r.RotationMechanism
+	case len(r.RotationStatements) != 0:
+		return mechanismStatements
+	default:
+		return mechanismNewPwd
+	}
+}
+
+// matches reports whether the role has every one of tags and, if database
+// is set, is for that database. DB2 database names are case-insensitive.
+func (r *db2RoleEntry) matches(tags []string, database string) bool {
+	if database != "" && !strings.EqualFold(r.Database, database) {
+		return false
+	}
+	return strutil.StrListSubset(r.Tags, tags)
+}
+
+// autoRotates reports whether the role is rotated automatically, either on
+// a period or on a schedule.
+func (r *db2RoleEntry) autoRotates() bool {
+	return r.RotationPeriod != 0 || r.RotationSchedule != ""
+}
+
+// schedule parses the role's rotation schedule in its timezone.
+func (r *db2RoleEntry) schedule() (cron.Schedule, error) {
+	timezone := r.RotationTimezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	return cron.ParseStandard("CRON_TZ=" + timezone + " " + r.RotationSchedule)
+}
+
+// setNextVaultRotation moves NextVaultRotation to the first scheduled time
+// after from. It does nothing for roles without a schedule.
+func (r *db2RoleEntry) setNextVaultRotation(from time.Time) error {
+	if r.RotationSchedule == "" {
+		r.NextVaultRotation = time.Time{}
+		return nil
+	}
+
+	schedule, err := r.schedule()
+	if err != nil {
+		return err
+	}
+	r.NextVaultRotation = schedule.Next(from)
+	return nil
+}
+
+// inRotationWindow reports whether now falls inside the role's current
+// rotation window. Roles without a window may rotate at any time once due.
+func (r *db2RoleEntry) inRotationWindow(now time.Time) bool {
+	if r.RotationSchedule == "" || r.RotationWindow == 0 {
+		return true
+	}
+	return now.Before(r.NextVaultRotation.Add(r.RotationWindow))
 }
 
 // toResponseData returns response data for a role
 func (r *db2RoleEntry) toResponseData() map[string]interface{} {
 	respData := map[string]interface{}{
-		"ttl":      r.TTL.Seconds(),
-		"username": r.Username,
+		"ttl":             r.TTL.Seconds(),
+		"username":        r.Username,
+		"tags":            r.Tags,
 		"password_policy": r.PasswordPolicy,
-		"database": r.Database,
-		//"new_password": r.NewPassword,
+		"database":        r.Database,
+		"connection":      r.connectionName(),
 		//"current_password": r.CurrentPassword,
 		"rotation_period":     r.RotationPeriod.Seconds(),
+		"rotation_schedule":   r.RotationSchedule,
+		"rotation_window":     r.RotationWindow.Seconds(),
+		"rotation_timezone":   r.RotationTimezone,
+		"rotation_statements": r.RotationStatements,
+		"rotation_mechanism":  r.mechanism(),
+		"grace_period":        r.GracePeriod.Seconds(),
 		"last_vault_rotation": r.LastVaultRotation,
-
+	}
+	if r.autoRotates() {
+		respData["next_vault_rotation"] = r.NextRotationTime()
+	}
+	for k, v := range r.rotationStatusData() {
+		respData[k] = v
 	}
 	return respData
 }
 
+// rotationStatusData returns the outcome of the most recent rotations
+func (r *db2RoleEntry) rotationStatusData() map[string]interface{} {
+	return map[string]interface{}{
+		"last_rotation_attempt": r.LastRotationAttempt,
+		"last_rotation_error":   r.LastRotationError,
+		"consecutive_failures":  r.ConsecutiveFailures,
+		"out_of_sync":           r.OutOfSync,
+		"last_drift_check":      r.LastDriftCheck,
+		"drift_check_error":     r.DriftCheckError,
+		"auth_failures":         r.AuthFailures,
+		"circuit_open_until":    r.CircuitOpenUntil,
+	}
+}
+
 // pathRole extends the Vault API with a `/role`
 // endpoint for the backend. You can choose whether
 // or not certain attributes should be displayed,
@@ -68,6 +257,10 @@ func pathRole(b *db2Backend) []*framework.Path {
 					Description: "The username for the HashiCups product API",
 					Required:    true,
 				},
+				"tags": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Free-form tags used to select roles for bulk rotation, e.g. \"app:payroll,env:prod\".",
+				},
 				"ttl": {
 					Type:        framework.TypeDurationSecond,
 					Description: "Default lease for generated credentials. If not set or set to 0, will use system default.",
@@ -87,6 +280,39 @@ func pathRole(b *db2Backend) []*framework.Path {
 					Description: "database to connect to for DB2 user",
 					Required:    true,
 				},
+				"connection": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the connection to the DB2 server the user is on. Defaults to the connection in the config.",
+				},
+				"rotation_period": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Period for automatic credential rotation of the DB2 user. If not set or set to 0, the password is only rotated on request.",
+				},
+				"rotation_statements": {
+					Type:        framework.TypeStringSlice,
+					Description: "Statements run over the administrative connection in the config to change the password, e.g. \"CALL SYSPROC.SET_PASSWORD('{{username}}', '{{password}}')\". If not set, the password is changed with the NEWPWD connection attribute.",
+				},
+				"rotation_mechanism": {
+					Type:          framework.TypeString,
+					Description:   "How the password is changed: \"newpwd\" with the NEWPWD connection attribute, \"statements\" with rotation_statements, or \"external_command\" with the external_command in the config. Defaults to \"statements\" when rotation_statements are set and \"newpwd\" otherwise.",
+					AllowedValues: []interface{}{mechanismNewPwd, mechanismStatements, mechanismExternalCommand},
+				},
+				"grace_period": {
+					Type:        framework.TypeDurationSecond,
+					Description: "How long the previous password stays readable from static-cred after a rotation. If not set or set to 0, it is discarded immediately.",
+				},
+				"rotation_schedule": {
+					Type:        framework.TypeString,
+					Description: "Cron-style schedule, e.g. \"0 2 * * SUN\", for automatic credential rotation of the DB2 user. Mutually exclusive with rotation_period.",
+				},
+				"rotation_window": {
+					Type:        framework.TypeDurationSecond,
+					Description: "How long after each scheduled time a rotation may still happen. If not set or set to 0, a missed scheduled rotation happens as soon as possible. Requires rotation_schedule.",
+				},
+				"rotation_timezone": {
+					Type:        framework.TypeString,
+					Description: "IANA timezone, e.g. \"Europe/Berlin\", in which rotation_schedule is evaluated. Defaults to UTC.",
+				},
 			},
 			ExistenceCheck: b.pathRoleExistanceCheck,
 			Operations: map[logical.Operation]framework.OperationHandler{
@@ -106,6 +332,26 @@ func pathRole(b *db2Backend) []*framework.Path {
 			HelpSynopsis:    pathRoleHelpSynopsis,
 			HelpDescription: pathRoleHelpDescription,
 		},
+		{
+			Pattern: staticRolePath + framework.GenericNameRegex("name") + "/rotation-status",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the role",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathRoleRotationStatusRead,
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathRoleRotationStatusDelete,
+				},
+			},
+			HelpSynopsis:    pathRoleRotationStatusHelpSynopsis,
+			HelpDescription: pathRoleRotationStatusHelpDescription,
+		},
 		{
 			Pattern: staticRolePath + "?$",
 			Operations: map[logical.Operation]framework.OperationHandler{
@@ -127,11 +373,9 @@ func (b *db2Backend) pathRoleExistanceCheck(ctx context.Context, request *logica
 	return role != nil, nil
 }
 
-
-func (b *db2Backend) staticRole(ctx context.Context, s logical.Storage, roleName string) (*db2RoleEntry,error) {
+func (b *db2Backend) staticRole(ctx context.Context, s logical.Storage, roleName string) (*db2RoleEntry, error) {
 	entry, err := s.Get(ctx, staticRolePath+roleName)
 	if err != nil {
-		println(err.Error())
 		return nil, err
 	}
 	if entry == nil {
@@ -146,8 +390,6 @@ func (b *db2Backend) staticRole(ctx context.Context, s logical.Storage, roleName
 	return &result, nil
 }
 
-
-
 // pathRolesList makes a request to Vault storage to retrieve a list of roles for the backend
 func (b *db2Backend) pathRolesList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	entries, err := req.Storage.List(ctx, staticRolePath)
@@ -181,6 +423,9 @@ func (b *db2Backend) pathRolesWrite(ctx context.Context, req *logical.Request, d
 		return logical.ErrorResponse("missing role name"), nil
 	}
 
+	lock := b.roleLock(name.(string))
+	lock.Lock()
+	defer lock.Unlock()
 
 	roleEntry, err := b.getRole(ctx, req.Storage, name.(string))
 	if err != nil {
@@ -200,7 +445,11 @@ func (b *db2Backend) pathRolesWrite(ctx context.Context, req *logical.Request, d
 	}
 
 	if currentPassword, ok := d.GetOk("current_password"); ok {
+		// the operator supplying the password resolves any drift
 		roleEntry.CurrentPassword = currentPassword.(string)
+		roleEntry.OutOfSync = false
+		roleEntry.DriftCheckError = ""
+		roleEntry.resetCircuitBreaker()
 	} else if !ok && createOperation {
 		return nil, fmt.Errorf("missing current password")
 	}
@@ -217,26 +466,228 @@ func (b *db2Backend) pathRolesWrite(ctx context.Context, req *logical.Request, d
 		return nil, fmt.Errorf("missing database")
 	}
 
+	if connection, ok := d.GetOk("connection"); ok {
+		roleEntry.Connection = connection.(string)
+		if roleEntry.Connection == defaultConnectionName {
+			roleEntry.Connection = ""
+		}
+	}
+
+	// configLock keeps the connection from being deleted until the role is stored
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	if roleEntry.Connection != "" {
+		config, err := getConnectionConfig(ctx, req.Storage, roleEntry.Connection)
+		if err != nil {
+			return nil, err
+		}
+		if config == nil {
+			return logical.ErrorResponse("connection %q does not exist", roleEntry.Connection), nil
+		}
+	}
+
+	if tags, ok := d.GetOk("tags"); ok {
+		roleEntry.Tags = strutil.RemoveDuplicates(tags.([]string), false)
+	}
+
 	if ttlRaw, ok := d.GetOk("ttl"); ok {
 		roleEntry.TTL = time.Duration(ttlRaw.(int)) * time.Second
 	} else if createOperation {
 		roleEntry.TTL = time.Duration(d.Get("ttl").(int)) * time.Second
 	}
 
+	if rotationPeriodRaw, ok := d.GetOk("rotation_period"); ok {
+		rotationPeriod := time.Duration(rotationPeriodRaw.(int)) * time.Second
+		if rotationPeriod != 0 && rotationPeriod < minRotationPeriod {
+			return logical.ErrorResponse("rotation_period must be %d seconds or more", int(minRotationPeriod.Seconds())), nil
+		}
+		roleEntry.RotationPeriod = rotationPeriod
+	}
+
+	if rotationStatements, ok := d.GetOk("rotation_statements"); ok {
+		statements := rotationStatements.([]string)
+		if len(statements) != 0 && !strings.Contains(strings.Join(statements, "\n"), "{{password}}") {
+			return logical.ErrorResponse("rotation_statements must use the {{password}} placeholder"), nil
+		}
+		roleEntry.RotationStatements = statements
+	}
+
+	if mechanism, ok := d.GetOk("rotation_mechanism"); ok {
+		switch mechanism := mechanism.(string); mechanism {
+		case mechanismNewPwd, mechanismStatements, mechanismExternalCommand:
+			roleEntry.RotationMechanism = mechanism
+		default:
+			return logical.ErrorResponse("unknown rotation_mechanism %q", mechanism), nil
+		}
+	}
+	if roleEntry.RotationMechanism == mechanismStatements && len(roleEntry.RotationStatements) == 0 {
+		return logical.ErrorResponse("the statements rotation_mechanism requires rotation_statements"), nil
+	}
+	if roleEntry.RotationMechanism == mechanismExternalCommand && len(roleEntry.RotationStatements) != 0 {
+		return logical.ErrorResponse("rotation_statements cannot be used with the external_command rotation_mechanism"), nil
+	}
+
+	if gracePeriodRaw, ok := d.GetOk("grace_period"); ok {
+		roleEntry.GracePeriod = time.Duration(gracePeriodRaw.(int)) * time.Second
+		if roleEntry.GracePeriod == 0 {
+			roleEntry.PreviousPassword = ""
+			roleEntry.PreviousVaultRotation = time.Time{}
+		}
+	}
+
+	scheduleChanged := false
+	if rotationSchedule, ok := d.GetOk("rotation_schedule"); ok {
+		scheduleChanged = roleEntry.RotationSchedule != rotationSchedule.(string)
+		roleEntry.RotationSchedule = rotationSchedule.(string)
+	}
+
+	if rotationTimezone, ok := d.GetOk("rotation_timezone"); ok {
+		if _, err := time.LoadLocation(rotationTimezone.(string)); err != nil {
+			return logical.ErrorResponse("invalid rotation_timezone: %s", err), nil
+		}
+		scheduleChanged = scheduleChanged || roleEntry.RotationTimezone != rotationTimezone.(string)
+		roleEntry.RotationTimezone = rotationTimezone.(string)
+	}
+
+	if rotationWindowRaw, ok := d.GetOk("rotation_window"); ok {
+		rotationWindow := time.Duration(rotationWindowRaw.(int)) * time.Second
+		if rotationWindow != 0 && rotationWindow < minRotationWindow {
+			return logical.ErrorResponse("rotation_window must be %d seconds or more", int(minRotationWindow.Seconds())), nil
+		}
+		roleEntry.RotationWindow = rotationWindow
+	}
+
+	if roleEntry.RotationSchedule != "" {
+		if roleEntry.RotationPeriod != 0 {
+			return logical.ErrorResponse("rotation_period and rotation_schedule are mutually exclusive"), nil
+		}
+		if _, err := roleEntry.schedule(); err != nil {
+			return logical.ErrorResponse("invalid rotation_schedule: %s", err), nil
+		}
+		if scheduleChanged || roleEntry.NextVaultRotation.IsZero() {
+			if err := roleEntry.setNextVaultRotation(b.now()); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if roleEntry.RotationWindow != 0 {
+			return logical.ErrorResponse("rotation_window requires rotation_schedule"), nil
+		}
+		roleEntry.NextVaultRotation = time.Time{}
+	}
+
 	if err := setRole(ctx, req.Storage, name.(string), roleEntry); err != nil {
 		return nil, err
 	}
 
+	if err := b.scheduleRotation(name.(string), roleEntry); err != nil {
+		return nil, fmt.Errorf("unable to schedule rotation for role: %w", err)
+	}
+
 	return nil, nil
 }
 
 // pathRolesDelete makes a request to Vault storage to delete a role
 func (b *db2Backend) pathRolesDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	err := req.Storage.Delete(ctx, staticRolePath+d.Get("name").(string))
+	name := d.Get("name").(string)
+
+	lock := b.roleLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	b.libraryLock.Lock()
+	defer b.libraryLock.Unlock()
+
+	// A lent account would be left with a lease that cannot check it back in.
+	out, err := getCheckOut(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if out != nil {
+		return logical.ErrorResponse("role %q is checked out from set %q; revoke its lease before deleting the role", name, out.SetName), nil
+	}
+
+	sets, err := req.Storage.List(ctx, libraryPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, setName := range sets {
+		set, err := getLibrarySet(ctx, req.Storage, setName)
+		if err != nil {
+			return nil, err
+		}
+		if set != nil && strutil.StrListContains(set.ServiceAccountNames, name) {
+			return logical.ErrorResponse("role %q belongs to library set %q; remove it from the set before deleting the role", name, setName), nil
+		}
+	}
+
+	err = req.Storage.Delete(ctx, staticRolePath+name)
 	if err != nil {
 		return nil, fmt.Errorf("error deleting hashiCups role: %w", err)
 	}
 
+	if err := req.Storage.Delete(ctx, historyPath+name); err != nil {
+		return nil, fmt.Errorf("error deleting rotation history: %w", err)
+	}
+
+	if _, err := b.popByKey(name); err != nil {
+		return nil, fmt.Errorf("error removing role from rotation queue: %w", err)
+	}
+
+	return nil, nil
+}
+
+// pathRoleRotationStatusRead returns the outcome of the most recent rotations of a role
+func (b *db2Backend) pathRoleRotationStatusRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	role, err := b.getRole(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if role == nil {
+		return nil, nil
+	}
+
+	data := role.rotationStatusData()
+	if role.autoRotates() && !role.OutOfSync {
+		data["next_rotation_attempt"] = b.nextRotationAttempt(role)
+	}
+
+	return &logical.Response{
+		Data: data,
+	}, nil
+}
+
+// pathRoleRotationStatusDelete clears the recorded rotation failures of a role,
+// so the next scheduled rotation is no longer delayed by backoff
+func (b *db2Backend) pathRoleRotationStatusDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := b.roleLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := b.getRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if role == nil {
+		return logical.ErrorResponse("role doesn't exist: %s", name), nil
+	}
+
+	role.LastRotationError = ""
+	role.ConsecutiveFailures = 0
+
+	if err := setRole(ctx, req.Storage, name, role); err != nil {
+		return nil, err
+	}
+
+	if err := b.scheduleRotation(name, role); err != nil {
+		return nil, fmt.Errorf("unable to schedule rotation for role: %w", err)
+	}
+
 	return nil, nil
 }
 
@@ -308,9 +759,16 @@ const (
 	pathRoleHelpSynopsis    = `Manages the Vault role for rotating DB2 user passwords`
 	pathRoleHelpDescription = `
 To be updated
+`
+
+	pathRoleRotationStatusHelpSynopsis    = `Read or clear the rotation failure state of a role`
+	pathRoleRotationStatusHelpDescription = `
+Reading this path returns the time of the last rotation attempt, the error
+it returned, and the number of consecutive failed rotations. Failed
+scheduled rotations are retried with exponential backoff. Deleting this
+path clears the recorded failures and removes the backoff.
 `
 
 	pathRoleListHelpSynopsis    = `List the existing roles in DB2 backend`
 	pathRoleListHelpDescription = `Roles will be listed by the role name.`
 )
-
@@ -25,9 +25,12 @@ func TestUserRole(t *testing.T) {
 			_, err := testTokenRoleCreate(t, b, s,
 				roleName+strconv.Itoa(i),
 				map[string]interface{}{
-					"username": username,
-					"ttl":      testTTL,
-					"max_ttl":  testMaxTTL,
+					"username":         username,
+					"current_password": password,
+					"database":         database,
+					"password_policy":  testPasswordPolicy,
+					"ttl":              testTTL,
+					"max_ttl":          testMaxTTL,
 				})
 			require.NoError(t, err)
 		}
@@ -39,9 +42,12 @@ func TestUserRole(t *testing.T) {
 
 	t.Run("Create User Role - pass", func(t *testing.T) {
 		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
-			"username": username,
-			"ttl":      testTTL,
-			"max_ttl":  testMaxTTL,
+			"username":         username,
+			"current_password": password,
+			"database":         database,
+			"password_policy":  testPasswordPolicy,
+			"ttl":              testTTL,
+			"max_ttl":          testMaxTTL,
 		})
 
 		require.Nil(t, err)
@@ -89,7 +95,7 @@ func testTokenRoleCreate(t *testing.T, b *db2Backend, s logical.Storage, name st
 	t.Helper()
 	resp, err := b.HandleRequest(context.Background(), &logical.Request{
 		Operation: logical.CreateOperation,
-		Path:      "role/" + name,
+		Path:      staticRolePath + name,
 		Data:      d,
 		Storage:   s,
 	})
@@ -106,7 +112,7 @@ func testTokenRoleUpdate(t *testing.T, b *db2Backend, s logical.Storage, d map[s
 	t.Helper()
 	resp, err := b.HandleRequest(context.Background(), &logical.Request{
 		Operation: logical.UpdateOperation,
-		Path:      "role/" + roleName,
+		Path:      staticRolePath + roleName,
 		Data:      d,
 		Storage:   s,
 	})
@@ -126,7 +132,7 @@ func testTokenRoleRead(t *testing.T, b *db2Backend, s logical.Storage) (*logical
 	t.Helper()
 	return b.HandleRequest(context.Background(), &logical.Request{
 		Operation: logical.ReadOperation,
-		Path:      "role/" + roleName,
+		Path:      staticRolePath + roleName,
 		Storage:   s,
 	})
 }
@@ -136,7 +142,7 @@ func testTokenRoleList(t *testing.T, b *db2Backend, s logical.Storage) (*logical
 	t.Helper()
 	return b.HandleRequest(context.Background(), &logical.Request{
 		Operation: logical.ListOperation,
-		Path:      "role/",
+		Path:      staticRolePath,
 		Storage:   s,
 	})
 }
@@ -146,7 +152,7 @@ func testTokenRoleDelete(t *testing.T, b *db2Backend, s logical.Storage) (*logic
 	t.Helper()
 	return b.HandleRequest(context.Background(), &logical.Request{
 		Operation: logical.DeleteOperation,
-		Path:      "role/" + roleName,
+		Path:      staticRolePath + roleName,
 		Storage:   s,
 	})
 }
@@ -7,22 +7,107 @@ import (
 	"errors"
 	"fmt"
 	//"math"
-	"time"
+	"strings"
+	"sync"
 
+	"github.com/hashicorp/go-secure-stdlib/base62"
 	"github.com/hashicorp/vault/sdk/framework"
 	//"github.com/hashicorp/vault/sdk/helper/consts"
 	//"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
 	//"github.com/hashicorp/vault/sdk/queue"
+
+	"vault-plugin-secrets-hashicups/db2client"
 )
 
 const (
 	rotateRootPath = "rotate-root"
 	rotateRolePath = "rotate-cred/"
+
+	// defaultBulkRotationParallel and maxBulkRotationParallel bound how many
+	// roles a bulk rotate-cred request rotates at the same time.
+	defaultBulkRotationParallel = 4
+	maxBulkRotationParallel     = 16
+
+	// Rotation mechanisms a role can select.
+	mechanismNewPwd          = "newpwd"
+	mechanismStatements      = "statements"
+	mechanismExternalCommand = "external_command"
+
+	// defaultPasswordLength is the length of generated passwords when no
+	// password policy is configured.
+	defaultPasswordLength = 20
 )
 
-func pathRotateCredentials(b *db2Backend) *framework.Path {
-	return &framework.Path{
+func pathRotateCredentials(b *db2Backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: rotateRootPath,
+			Fields: map[string]*framework.FieldSchema{
+				"connection": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the connection whose administrative password is rotated.",
+					Default:     defaultConnectionName,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:                    b.pathRotateRootCredentialsUpdate,
+					ForwardPerformanceStandby:   true,
+					ForwardPerformanceSecondary: true,
+				},
+			},
+			HelpSynopsis:    "Request to rotate the administrative credentials in the config.",
+			HelpDescription: "This path attempts to rotate the password of the administrative DB2 user in the config. Once rotated, only Vault knows the new password.",
+		},
+		{
+			Pattern: strings.TrimSuffix(rotateRolePath, "/") + "/?$",
+			Fields: map[string]*framework.FieldSchema{
+				"tags": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Rotate the static roles that have all of these tags.",
+				},
+				"database": {
+					Type:        framework.TypeString,
+					Description: "Rotate the static roles for this database.",
+				},
+				"all": {
+					Type:        framework.TypeBool,
+					Description: "Rotate every static role. Cannot be combined with tags or database.",
+				},
+				"max_parallel": {
+					Type:        framework.TypeInt,
+					Description: fmt.Sprintf("Number of roles rotated at the same time, at most %d.", maxBulkRotationParallel),
+					Default:     defaultBulkRotationParallel,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:                    b.pathRotateBulkCredentialsUpdate,
+					ForwardPerformanceStandby:   true,
+					ForwardPerformanceSecondary: true,
+				},
+			},
+			HelpSynopsis:    "Request to rotate the credentials for every static role matching a selector.",
+			HelpDescription: "This path rotates the credentials of all static roles with the given tags or database, or of all static roles, and reports the outcome for each role. Accounts checked out from a library set are skipped.",
+		},
+		{
+			Pattern: rotateRolePath + framework.GenericNameRegex("name") + "/dry-run",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the static role",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathRotateRoleCredentialsDryRun,
+				},
+			},
+			HelpSynopsis:    "Check whether the credentials for a static role could be rotated.",
+			HelpDescription: "This path runs the checks a rotation of the given static role depends on and reports each result, without changing anything in DB2 or in Vault.",
+		},
+		{
 			Pattern: rotateRolePath + framework.GenericNameRegex("name"),
 			Fields: map[string]*framework.FieldSchema{
 				"name": {
@@ -44,8 +129,77 @@ func pathRotateCredentials(b *db2Backend) *framework.Path {
 			},
 			HelpSynopsis:    "Request to rotate the credentials for a static db2 user account.",
 			HelpDescription: "This path attempts to rotate the credentials for the given DB2 static user account.",
+		},
+	}
+}
 
+func (b *db2Backend) pathRotateRootCredentialsUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("connection").(string)
+
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	config, err := getConnectionConfig(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse(connectionUnsetError(name).Error()), nil
 	}
+	if config.Username == "" || config.Password == "" {
+		return logical.ErrorResponse("the %s connection has no administrative username and password to rotate", name), nil
+	}
+
+	newPassword, err := b.generatePassword(ctx, config.PasswordPolicy, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	db2Client, err := b.getClient(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	defer b.releaseClient(db2Client)
+
+	// Record the new password before DB2 is contacted, so that it can be
+	// recovered by walRollback if it is changed but not stored.
+	walID, err := framework.PutWAL(ctx, req.Storage, rootWALKey, &setRootCredentialsWAL{
+		Connection:  name,
+		Username:    config.Username,
+		OldPassword: config.Password,
+		NewPassword: newPassword,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to write WAL entry: %w", err)
+	}
+
+	changeErr := db2Client.ChangePassword(ctx, config.connectionInfo(config.Database, config.Username, config.Password), newPassword)
+	if changeErr != nil {
+		if changeRefused(changeErr) {
+			b.deleteWAL(ctx, req.Storage, walID)
+		}
+		var rotationErr *db2client.RotationError
+		if !errors.As(changeErr, &rotationErr) || rotationErr.Phase == db2client.PhaseChange {
+			return nil, fmt.Errorf("unable to rotate root credentials: %w", changeErr)
+		}
+		// DB2 accepted the new password before verification failed, so it
+		// is stored and the WAL entry left for walRollback to confirm
+	}
+
+	config.Password = newPassword
+	if err := putConnectionConfig(ctx, req.Storage, name, config); err != nil {
+		return nil, err
+	}
+
+	// reset the client so the next invocation will pick up the new password
+	b.reset(name)
+
+	if changeErr != nil {
+		return nil, fmt.Errorf("unable to rotate root credentials: %w", changeErr)
+	}
+	b.deleteWAL(ctx, req.Storage, walID)
+
+	return nil, nil
 }
 
 func (b *db2Backend) pathRotateRoleCredentialsUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -54,6 +208,36 @@ func (b *db2Backend) pathRotateRoleCredentialsUpdate(ctx context.Context, req *l
 		return logical.ErrorResponse("empty role name attribute given"), nil
 	}
 
+	resp, err := b.rotateRole(ctx, req.Storage, name, triggerManual, req.EntityID)
+	if errors.Is(err, errRoleNotFound) {
+		return logical.ErrorResponse("role doesn't exist: %s", name), nil
+	}
+	if errors.Is(err, errCircuitOpen) || errors.Is(err, errCheckedOut) {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err != nil {
+		b.Logger().Warn("unable to rotate credentials in rotate-role", "error", err)
+		if hint := db2ErrorHint(err); hint != "" {
+			return nil, fmt.Errorf("unable to rotate credentials for role %q: %w (%s)", name, err, hint)
+		}
+		return nil, fmt.Errorf("unable to rotate credentials for role %q: %w", name, err)
+	}
+
+	return resp, nil
+}
+
+// pathRotateRoleCredentialsDryRun reports whether the role could be rotated
+// now: the config is usable, the password policy generates a password and
+// the current password still authenticates. Nothing is written to DB2, but
+// the login with the current password counts towards the role's circuit
+// breaker.
+func (b *db2Backend) pathRotateRoleCredentialsDryRun(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	lock := b.roleLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
 	role, err := b.staticRole(ctx, req.Storage, name)
 	if err != nil {
 		return nil, err
@@ -62,46 +246,233 @@ func (b *db2Backend) pathRotateRoleCredentialsUpdate(ctx context.Context, req *l
 		return logical.ErrorResponse("role doesn't exist: %s", name), nil
 	}
 
+	var checks []map[string]interface{}
+	success := true
+	check := func(name string, err error) bool {
+		result := map[string]interface{}{"name": name, "success": err == nil}
+		if err != nil {
+			result["error"] = describeDB2Error(err)
+			success = false
+		}
+		checks = append(checks, result)
+		return err == nil
+	}
+
+	config, err := getConnectionConfig(ctx, req.Storage, role.connectionName())
+	if err == nil && config == nil {
+		err = connectionUnsetError(role.connectionName())
+	}
+	configured := check("config", err)
+
+	_, err = b.GeneratePassword(ctx, role)
+	check("password_policy", err)
+
+	// a dry run must not add to the failed logins that opened the breaker
+	circuitClosed := check("circuit_breaker", role.circuitError(name, b.now()))
+
+	if configured {
+		db2Client, err := b.getClient(ctx, req.Storage, role.connectionName())
+		if err == nil {
+			defer b.releaseClient(db2Client)
+		}
+		if check("connection", err) && circuitClosed {
+			err := db2Client.Verify(ctx, config.connectionInfo(role.Database, role.Username, role.CurrentPassword))
+			if role.recordAuthResult(config, err, b.now()) {
+				b.Logger().Warn("authentication failures reached the lockout threshold, opening the circuit breaker", "role", name, "failures", role.AuthFailures, "until", role.CircuitOpenUntil)
+			}
+			if err := setRole(ctx, req.Storage, name, role); err != nil {
+				return nil, err
+			}
+			if errors.Is(err, db2client.ErrPasswordExpired) && role.mechanism() == mechanismNewPwd {
+				// NEWPWD replaces an expired password, so the rotation goes ahead
+				check("current_password", nil)
+				checks[len(checks)-1]["warning"] = describeDB2Error(err)
+			} else {
+				check("current_password", err)
+			}
+
+			if role.mechanism() == mechanismStatements {
+				check("admin_credentials", verifyAdminCredentials(ctx, db2Client, config, role))
+			}
+		}
+
+		if role.mechanism() == mechanismExternalCommand {
+			check("external_command", verifyExternalCommand(config))
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"success": success,
+			"checks":  checks,
+		},
+	}, nil
+}
+
+// verifyAdminCredentials checks that the administrative credentials in the
+// config, which rotation statements run as, authenticate.
+func verifyAdminCredentials(ctx context.Context, db2Client *db2Client, config *db2Config, role *db2RoleEntry) error {
+	if config.Username == "" || config.Password == "" {
+		return errors.New("rotation_statements require an administrative username and password in the config")
+	}
+	database := config.Database
+	if database == "" {
+		database = role.Database
+	}
+	return db2Client.Verify(ctx, config.connectionInfo(database, config.Username, config.Password))
+}
+
+// errRoleNotFound is returned by rotateRole when the role does not exist.
+var errRoleNotFound = errors.New("role doesn't exist")
+
+// errCheckedOut is returned by rotateRole when the role's account is lent
+// out by a library set. It is rotated when it is checked in instead.
+var errCheckedOut = errors.New("account is checked out")
+
+// rotateRole rotates the named static role under its lock and reschedules
+// its next automatic rotation. trigger and entityID are recorded in the
+// role's rotation history. Accounts checked out from a library set are not
+// rotated.
+func (b *db2Backend) rotateRole(ctx context.Context, s logical.Storage, name, trigger, entityID string) (*logical.Response, error) {
+	lock := b.roleLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := b.staticRole(ctx, s, name)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, errRoleNotFound
+	}
+
+	out, err := getCheckOut(ctx, s, name)
+	if err != nil {
+		return nil, err
+	}
+	if out != nil {
+		return nil, fmt.Errorf("%w: role %s is checked out from library set %s and is rotated when it is checked in", errCheckedOut, name, out.SetName)
+	}
 
 	input := &setStaticAccountInput{
 		RoleName: name,
 		Role:     role,
+		Trigger:  trigger,
+		EntityID: entityID,
 	}
-	resp, err := b.setStaticAccountPassword(ctx, req.Storage, input)
+	resp, err := b.setStaticAccountPassword(ctx, s, input)
 	if err != nil {
-		b.Logger().Warn("unable to rotate credentials in rotate-role", "error", err)
+		return nil, err
+	}
+	if err := b.scheduleRotation(name, input.Role); err != nil {
+		b.Logger().Warn("unable to reschedule role after rotate-role", "role", name, "error", err)
 	}
 
-	// We're not returning creds here because we do not know if its been processed
-	// by the queue.
 	return resp, nil
 }
 
+func (b *db2Backend) pathRotateBulkCredentialsUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	tags := data.Get("tags").([]string)
+	database := data.Get("database").(string)
+	all := data.Get("all").(bool)
+
+	if all && (len(tags) != 0 || database != "") {
+		return logical.ErrorResponse("all cannot be combined with tags or database"), nil
+	}
+	if !all && len(tags) == 0 && database == "" {
+		return logical.ErrorResponse("one of tags, database or all is required"), nil
+	}
+
+	maxParallel := data.Get("max_parallel").(int)
+	if maxParallel < 1 || maxParallel > maxBulkRotationParallel {
+		return logical.ErrorResponse("max_parallel must be between 1 and %d", maxBulkRotationParallel), nil
+	}
+
+	names, err := req.Storage.List(ctx, staticRolePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []string
+	for _, name := range names {
+		role, err := b.staticRole(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if role != nil && role.matches(tags, database) {
+			matched = append(matched, name)
+		}
+	}
+
+	results := make(map[string]interface{}, len(matched))
+	var resultsLock sync.Mutex
+	var failed, skipped int
+
+	sem := make(chan struct{}, maxParallel)
+	var wg sync.WaitGroup
+	for _, name := range matched {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result := map[string]interface{}{"success": true}
+			_, err := b.rotateRole(ctx, req.Storage, name, triggerBulk, req.EntityID)
+			checkedOut := errors.Is(err, errCheckedOut)
+			switch {
+			case checkedOut:
+				result = map[string]interface{}{"success": false, "skipped": true, "error": err.Error()}
+			case err != nil:
+				b.Logger().Warn("unable to rotate credentials in bulk rotate", "role", name, "error", err)
+				result = map[string]interface{}{"success": false, "error": describeDB2Error(err)}
+			}
+
+			resultsLock.Lock()
+			defer resultsLock.Unlock()
+			results[name] = result
+			switch {
+			case checkedOut:
+				skipped++
+			case err != nil:
+				failed++
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"roles":     results,
+			"rotated":   len(matched) - failed - skipped,
+			"failed":    failed,
+			"skipped":   skipped,
+			"requested": len(matched),
+		},
+	}, nil
+}
+
 type setStaticAccountInput struct {
 	RoleName string
 	Role     *db2RoleEntry
+
+	// Trigger and EntityID are recorded in the role's rotation history.
+	Trigger  string
+	EntityID string
 }
 
 type setStaticAccountOutput struct {
 }
 
-
-func (b *db2Backend) setStaticAccountPassword(ctx context.Context, s logical.Storage, input *setStaticAccountInput) (*logical.Response, error) {
+// setStaticAccountPassword rotates the password of a static role. The role is
+// re-read from storage so that changes made since the caller loaded it are
+// kept, and input.Role is updated to the stored result. Callers must hold the
+// role's lock.
+func (b *db2Backend) setStaticAccountPassword(ctx context.Context, s logical.Storage, input *setStaticAccountInput) (resp *logical.Response, err error) {
 	if input == nil || input.Role == nil || input.RoleName == "" || input.Role.CurrentPassword == "" {
 		return nil, errors.New("input was empty when attempting to set credentials for static account")
 	}
 
-	b.lock.Lock()
-	defer b.lock.Unlock()
-
-	config, err := getConfig(ctx, s)
-	if err != nil {
-		return nil, err
-	}
-	if config == nil {
-		return nil, errors.New("the config is currently unset")
-	}
-
 	role, err := b.staticRole(ctx, s, input.RoleName)
 	if err != nil {
 		return nil, err
@@ -110,57 +481,213 @@ func (b *db2Backend) setStaticAccountPassword(ctx context.Context, s logical.Sto
 		return nil, errors.New("role doesn't exist")
 	}
 
-	newPassword, _ := b.GeneratePassword(ctx, role)
+	// Refused attempts never reach DB2, so they are not recorded as failures
+	if err := role.circuitError(input.RoleName, b.now()); err != nil {
+		return nil, err
+	}
+
+	// stage is the error category recorded in the history if the rotation
+	// fails outside of DB2.
+	stage := errorCategoryConfig
+	start := b.now()
+	var config *db2Config
+	defer func() {
+		event := &rotationEvent{
+			Time:     start,
+			Trigger:  input.Trigger,
+			EntityID: input.EntityID,
+			Username: role.Username,
+			Success:  err == nil,
+			Duration: b.now().Sub(start),
+		}
+		if err != nil {
+			event.ErrorCategory = rotationErrorCategory(stage, err)
+			if role.recordAuthResult(config, err, b.now()) {
+				b.Logger().Warn("authentication failures reached the lockout threshold, opening the circuit breaker", "role", input.RoleName, "failures", role.AuthFailures, "until", role.CircuitOpenUntil)
+			}
+			b.recordRotationFailure(ctx, s, input, role, err)
+		}
+		b.recordRotationEvent(ctx, s, input.RoleName, event)
+		b.notifyWebhooks(ctx, s, input.RoleName, role, event)
+	}()
 
-	db2Client, err := b.getClient(ctx, s)
+	config, err = getConnectionConfig(ctx, s, role.connectionName())
 	if err != nil {
 		return nil, err
 	}
+	if config == nil {
+		return nil, connectionUnsetError(role.connectionName())
+	}
 
-		err = db2Client.UpdatePassword(config.Hostname, config.Port, role.Database, role.Username, role.CurrentPassword, newPassword)
+	stage = errorCategoryPasswordGeneration
+	newPassword, err := b.GeneratePassword(ctx, role)
 	if err != nil {
-		return nil,err
+		return nil, err
 	}
-	//use the hostname, port details in the config and the active password and new password to construct a connection string
 
-	//if successful
-	input.Role.CurrentPassword = newPassword
-	lvr := time.Now()
-	input.Role.LastVaultRotation = lvr
-	//if not successful send back error
+	stage = errorCategoryConnection
+	db2Client, err := b.getClient(ctx, s, role.connectionName())
+	if err != nil {
+		return nil, err
+	}
+	defer b.releaseClient(db2Client)
 
+	stage = errorCategoryStorage
 
+	// Record the new password before DB2 is contacted, so that it can be
+	// recovered by walRollback if Vault stops before the role is updated.
+	walID, err := framework.PutWAL(ctx, s, staticWALKey, &setCredentialsWAL{
+		RoleName:    input.RoleName,
+		Username:    role.Username,
+		OldPassword: role.CurrentPassword,
+		NewPassword: newPassword,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to write WAL entry: %w", err)
+	}
 
-	entry, err := logical.StorageEntryJSON(staticRolePath+input.RoleName, input.Role)
+	stage = errorCategoryChange
+	// Any failure but DB2 refusing the change outright may have changed the
+	// password, so the WAL entry is kept for walRollback to reconcile.
+	err = changePassword(ctx, db2Client, config, role, newPassword)
+	if changeRefused(err) {
+		b.deleteWAL(ctx, s, walID)
+	}
+	var rotationErr *db2client.RotationError
+	if err != nil && (!errors.As(err, &rotationErr) || rotationErr.Phase == db2client.PhaseChange) {
+		return nil, err
+	}
 	if err != nil {
+		// DB2 accepted the new password before verification failed, so it
+		// is stored and only the verification is recorded as the failure.
+		stage = errorCategoryStorage
+		if setErr := role.setRotatedPassword(newPassword, b.now()); setErr != nil {
+			b.Logger().Warn("unable to compute next scheduled rotation", "role", input.RoleName, "error", setErr)
+		}
+		if setErr := setRole(ctx, s, input.RoleName, role); setErr != nil {
+			return nil, setErr
+		}
+		stage = errorCategoryChange
 		return nil, err
 	}
-	if err := s.Put(ctx, entry); err != nil {
+
+	lvr := b.now()
+	role.LastRotationAttempt = lvr
+	role.LastRotationError = ""
+	role.ConsecutiveFailures = 0
+	role.resetCircuitBreaker()
+	if err := role.setRotatedPassword(newPassword, lvr); err != nil {
+		b.Logger().Warn("unable to compute next scheduled rotation", "role", input.RoleName, "error", err)
+	}
+
+	stage = errorCategoryStorage
+	if err := setRole(ctx, s, input.RoleName, role); err != nil {
 		return nil, err
 	}
+	*input.Role = *role
 
+	b.deleteWAL(ctx, s, walID)
 
 	return &logical.Response{
-	Data: map[string]interface{}{
-	"username":            role.Username,
-	"current_password":    input.Role.CurrentPassword,
-	"ttl":                 input.Role.TTL,
-	"rotation_period":     input.Role.RotationPeriod.Seconds(),
-	"last_vault_rotation": input.Role.LastVaultRotation,
-	},
+		Data: map[string]interface{}{
+			"username":            role.Username,
+			"current_password":    input.Role.CurrentPassword,
+			"ttl":                 input.Role.TTL,
+			"rotation_period":     input.Role.RotationPeriod.Seconds(),
+			"last_vault_rotation": input.Role.LastVaultRotation,
+		},
 	}, nil
 
+}
+
+// changePassword changes the role's password in DB2 with the role's
+// rotation mechanism: the NEWPWD connection attribute, the role's rotation
+// statements over the administrative connection, or the external command in
+// the config. The result is then verified.
+func changePassword(ctx context.Context, db2Client *db2Client, config *db2Config, role *db2RoleEntry, newPassword string) error {
+	switch role.mechanism() {
+	case mechanismNewPwd:
+		return db2Client.ChangePassword(ctx, config.connectionInfo(role.Database, role.Username, role.CurrentPassword), newPassword)
+	case mechanismExternalCommand:
+		err := runExternalCommand(ctx, config, &externalCommandInput{
+			Username:    role.Username,
+			OldPassword: role.CurrentPassword,
+			NewPassword: newPassword,
+			Hostname:    config.Hostname,
+			Port:        config.Port,
+			Database:    role.Database,
+		})
+		if err != nil {
+			return err
+		}
+		return db2Client.VerifyRotation(ctx, config.connectionInfo(role.Database, role.Username, role.CurrentPassword), newPassword)
+	}
+
+	if config.Username == "" || config.Password == "" {
+		return &db2client.RotationError{
+			Phase: db2client.PhaseChange,
+			Err:   &refusedError{errors.New("rotation_statements require an administrative username and password in the config")},
+		}
+	}
+
+	database := config.Database
+	if database == "" {
+		database = role.Database
+	}
+
+	statements := renderStatements(role.RotationStatements, role.Username, newPassword)
+	if err := db2Client.ExecStatements(ctx, config.connectionInfo(database, config.Username, config.Password), statements); err != nil {
+		return err
+	}
+
+	return db2Client.VerifyRotation(ctx, config.connectionInfo(role.Database, role.Username, role.CurrentPassword), newPassword)
+}
+
+// renderStatements substitutes the {{username}} and {{password}} placeholders
+// in statements. Single quotes in the values are doubled so they are safe
+// inside quoted SQL string literals.
+func renderStatements(statements []string, username, password string) []string {
+	replacer := strings.NewReplacer(
+		"{{username}}", strings.ReplaceAll(username, "'", "''"),
+		"{{password}}", strings.ReplaceAll(password, "'", "''"),
+	)
+
+	rendered := make([]string, 0, len(statements))
+	for _, statement := range statements {
+		rendered = append(rendered, replacer.Replace(statement))
 	}
+	return rendered
+}
+
+// recordRotationFailure stores the outcome of a failed rotation on the role,
+// keeping input.Role in step so callers can compute the retry backoff.
+func (b *db2Backend) recordRotationFailure(ctx context.Context, s logical.Storage, input *setStaticAccountInput, role *db2RoleEntry, rotationErr error) {
+	role.LastRotationAttempt = b.now()
+	role.LastRotationError = rotationErr.Error()
+	role.ConsecutiveFailures++
+
+	*input.Role = *role
+
+	if err := setRole(ctx, s, input.RoleName, role); err != nil {
+		b.Logger().Warn("unable to record rotation failure", "role", input.RoleName, "error", err)
+	}
+}
 
 func (b *db2Backend) GeneratePassword(ctx context.Context, role *db2RoleEntry) (string, error) {
-	//if role.PasswordPolicy == "" {
-	//	if role.PasswordLength == 0 {
-	//		return base62.Random(defaultPasswordLength)
-	//	}
-	//	return base62.Random(role.PasswordLength)
-	//}
-
-	password, err := b.System().GeneratePasswordFromPolicy(ctx, role.PasswordPolicy)
+	return b.generatePassword(ctx, role.PasswordPolicy, role.PasswordLength)
+}
+
+// generatePassword generates a password from the named policy, falling back
+// to a random base62 string when no policy is given.
+func (b *db2Backend) generatePassword(ctx context.Context, policy string, length int) (string, error) {
+	if policy == "" {
+		if length == 0 {
+			return base62.Random(defaultPasswordLength)
+		}
+		return base62.Random(length)
+	}
+
+	password, err := b.System().GeneratePasswordFromPolicy(ctx, policy)
 	if err != nil {
 		return "", fmt.Errorf("unable to generate password: %w", err)
 	}
@@ -0,0 +1,628 @@
+package db2secretengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+
+	"vault-plugin-secrets-hashicups/db2client"
+)
+
+// TestRotateRoot checks that rotate-root changes the administrative
+// password in DB2 and in the stored config without ever returning it.
+func TestRotateRoot(t *testing.T) {
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+
+	t.Run("Rotate Without Config", func(t *testing.T) {
+		resp, err := testRotateRoot(t, b, s)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Rotate Without Admin Credentials", func(t *testing.T) {
+		require.NoError(t, testConfigCreate(t, b, s, map[string]interface{}{
+			"hostname": hostname,
+			"port":     port,
+		}))
+
+		resp, err := testRotateRoot(t, b, s)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Rotate Root", func(t *testing.T) {
+		db.setPassword(username, password)
+		require.NoError(t, testConfigUpdate(t, b, s, map[string]interface{}{
+			"username": username,
+			"password": password,
+			"database": database,
+		}))
+
+		resp, err := testRotateRoot(t, b, s)
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		config, err := getConfig(context.Background(), s)
+		require.NoError(t, err)
+		require.NotEqual(t, password, config.Password)
+		require.Equal(t, db.password(username), config.Password)
+
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      configStoragePath,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.NotContains(t, resp.Data, "password")
+	})
+
+	t.Run("Rotate Root With Stale Password", func(t *testing.T) {
+		db.setPassword(username, "changed-outside-vault")
+
+		config, err := getConfig(context.Background(), s)
+		require.NoError(t, err)
+
+		_, err = testRotateRoot(t, b, s)
+		require.Error(t, err)
+
+		unchanged, err := getConfig(context.Background(), s)
+		require.NoError(t, err)
+		require.Equal(t, config.Password, unchanged.Password)
+	})
+
+	t.Run("Rotate Root With Failed Verification", func(t *testing.T) {
+		ctx := context.Background()
+		db.setPassword(username, password)
+		require.NoError(t, testConfigUpdate(t, b, s, map[string]interface{}{
+			"password": password,
+		}))
+
+		// DB2 accepted the new password, so it must not be lost
+		db.failPhase = db2client.PhaseVerifyNew
+		_, err := testRotateRoot(t, b, s)
+		db.failPhase = ""
+		require.Error(t, err)
+
+		config, err := getConfig(ctx, s)
+		require.NoError(t, err)
+		require.Equal(t, db.password(username), config.Password)
+
+		wals, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Len(t, wals, 1)
+
+		testWALRollback(t, b, s)
+		wals, err = framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Empty(t, wals)
+	})
+
+	t.Run("Root WAL Rollback", func(t *testing.T) {
+		ctx := context.Background()
+		config, err := getConfig(ctx, s)
+		require.NoError(t, err)
+
+		// the change reached DB2 but Vault stopped before storing it
+		_, err = framework.PutWAL(ctx, s, rootWALKey, &setRootCredentialsWAL{
+			Connection:  defaultConnectionName,
+			Username:    username,
+			OldPassword: config.Password,
+			NewPassword: "New!Root1",
+		})
+		require.NoError(t, err)
+		db.setPassword(username, "New!Root1")
+
+		testWALRollback(t, b, s)
+
+		config, err = getConfig(ctx, s)
+		require.NoError(t, err)
+		require.Equal(t, "New!Root1", config.Password)
+		wals, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Empty(t, wals)
+	})
+}
+
+// TestRotateRole checks that rotate-cred stores a new password once DB2 has
+// accepted it, and reports the phase that failed otherwise.
+func TestRotateRole(t *testing.T) {
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	db.setPassword(testRotationUsername, testRotationPassword)
+	testRotationSetup(t, b, s, nil)
+
+	t.Run("Rotate Role", func(t *testing.T) {
+		resp, err := testRotateRole(t, b, s, testRotationRole)
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		require.Equal(t, db.password(testRotationUsername), resp.Data["current_password"])
+
+		role, err := b.staticRole(context.Background(), s, testRotationRole)
+		require.NoError(t, err)
+		require.Equal(t, db.password(testRotationUsername), role.CurrentPassword)
+	})
+
+	for _, phase := range []string{db2client.PhaseChange, db2client.PhaseVerifyNew, db2client.PhaseVerifyOldFails} {
+		t.Run("Failed "+phase, func(t *testing.T) {
+			before, err := b.staticRole(context.Background(), s, testRotationRole)
+			require.NoError(t, err)
+
+			db.failPhase = phase
+			defer func() { db.failPhase = "" }()
+
+			_, err = testRotateRole(t, b, s, testRotationRole)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), phase)
+
+			after, err := b.staticRole(context.Background(), s, testRotationRole)
+			require.NoError(t, err)
+			if phase == db2client.PhaseChange {
+				require.Equal(t, before.CurrentPassword, after.CurrentPassword)
+				require.Equal(t, before.LastVaultRotation, after.LastVaultRotation)
+			} else {
+				// DB2 accepted the new password before verification failed
+				require.NotEqual(t, before.CurrentPassword, after.CurrentPassword)
+				require.Equal(t, db.password(testRotationUsername), after.CurrentPassword)
+			}
+			require.Contains(t, after.LastRotationError, phase)
+			require.Equal(t, before.ConsecutiveFailures+1, after.ConsecutiveFailures)
+
+			// put the fake back in step with storage for the next phase
+			db.setPassword(testRotationUsername, after.CurrentPassword)
+		})
+	}
+}
+
+func testRotateRole(t *testing.T, b *db2Backend, s logical.Storage, name string) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      rotateRolePath + name,
+		Storage:   s,
+	})
+}
+
+func testRotateRoot(t *testing.T, b *db2Backend, s logical.Storage) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      rotateRootPath,
+		Storage:   s,
+	})
+}
+
+// TestRotateRole_Statements checks that a role with rotation statements
+// changes its password over the administrative connection.
+func TestRotateRole_Statements(t *testing.T) {
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	db.setPassword(testRotationUsername, testRotationPassword)
+	testRotationSetup(t, b, s, map[string]interface{}{
+		"rotation_statements": []string{"CALL SYSPROC.SET_PASSWORD('{{username}}', '{{password}}')"},
+	})
+
+	t.Run("Without Admin Credentials", func(t *testing.T) {
+		_, err := testRotateRole(t, b, s, testRotationRole)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "administrative username and password")
+	})
+
+	t.Run("With Admin Credentials", func(t *testing.T) {
+		db.setPassword(username, password)
+		require.NoError(t, testConfigUpdate(t, b, s, map[string]interface{}{
+			"username": username,
+			"password": password,
+			"database": database,
+		}))
+
+		resp, err := testRotateRole(t, b, s, testRotationRole)
+		require.NoError(t, err)
+		newPassword := resp.Data["current_password"].(string)
+		require.Equal(t, newPassword, db.password(testRotationUsername))
+		require.Equal(t, []string{"CALL SYSPROC.SET_PASSWORD('" + testRotationUsername + "', '" + newPassword + "')"}, db.statements)
+	})
+
+	t.Run("Statements Without Password", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      staticRolePath + testRotationRole,
+			Data: map[string]interface{}{
+				"rotation_statements": []string{"CALL SYSPROC.SET_PASSWORD('{{username}}')"},
+			},
+			Storage: s,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+}
+
+func TestRenderStatements(t *testing.T) {
+	require.Equal(t,
+		[]string{"CALL SYSPROC.SET_PASSWORD('o''brien', 'it''s;DROP')"},
+		renderStatements([]string{"CALL SYSPROC.SET_PASSWORD('{{username}}', '{{password}}')"}, "o'brien", "it's;DROP"),
+	)
+}
+
+// TestRotateRole_Locking checks that a hung rotation only blocks its own
+// role, and that a role written during a rotation keeps both changes.
+func TestRotateRole_Locking(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	db.setPassword(testRotationUsername, testRotationPassword)
+	db.setPassword("other", testRotationPassword)
+	testRotationSetup(t, b, s, nil)
+
+	const otherRole = "other"
+	require.NotEqual(t, locksutil.LockIndexForKey(testRotationRole), locksutil.LockIndexForKey(otherRole))
+	_, err := testTokenRoleCreate(t, b, s, otherRole, map[string]interface{}{
+		"username":         "other",
+		"current_password": testRotationPassword,
+		"password_policy":  testPasswordPolicy,
+		"database":         "sample",
+	})
+	require.NoError(t, err)
+
+	release := make(chan struct{})
+	db.blocked[testRotationUsername] = release
+
+	rotated := make(chan error)
+	go func() {
+		_, err := testRotateRole(t, b, s, testRotationRole)
+		rotated <- err
+	}()
+	<-db.entered
+
+	// another role rotates while the first is hung
+	otherRotated := make(chan error)
+	go func() {
+		_, err := testRotateRole(t, b, s, otherRole)
+		otherRotated <- err
+	}()
+	select {
+	case err := <-otherRotated:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("rotation of another role was blocked")
+	}
+
+	// a write to the hung role waits for its rotation
+	written := make(chan error)
+	go func() {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      staticRolePath + testRotationRole,
+			Data:      map[string]interface{}{"ttl": "5m"},
+			Storage:   s,
+		})
+		if err == nil && resp != nil {
+			err = resp.Error()
+		}
+		written <- err
+	}()
+	select {
+	case <-written:
+		t.Fatal("role write did not wait for the rotation")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	require.NoError(t, <-rotated)
+	require.NoError(t, <-written)
+
+	role, err := b.staticRole(ctx, s, testRotationRole)
+	require.NoError(t, err)
+	require.Equal(t, db.password(testRotationUsername), role.CurrentPassword)
+	require.Equal(t, 5*time.Minute, role.TTL)
+}
+
+// TestRotateRole_Cancelled checks that cancelling the request aborts a
+// rotation hung in DB2, leaving the role's password as it was and its lock
+// free for the next rotation.
+func TestRotateRole_Cancelled(t *testing.T) {
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	db.setPassword(testRotationUsername, testRotationPassword)
+	testRotationSetup(t, b, s, nil)
+
+	db.blocked[testRotationUsername] = make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rotated := make(chan error)
+	go func() {
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      rotateRolePath + testRotationRole,
+			Storage:   s,
+		})
+		rotated <- err
+	}()
+	<-db.entered
+	cancel()
+
+	select {
+	case err := <-rotated:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("rotation was not aborted by the cancelled request")
+	}
+	require.Equal(t, testRotationPassword, db.password(testRotationUsername))
+
+	db.Lock()
+	delete(db.blocked, testRotationUsername)
+	db.Unlock()
+	_, err := testRotateRole(t, b, s, testRotationRole)
+	require.NoError(t, err)
+	require.Equal(t, 1, db.rotations)
+}
+
+// TestRotateBulk checks that rotate-cred rotates only the roles matching its
+// selector and reports a failure without stopping the other rotations.
+func TestRotateBulk(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	require.NoError(t, testConfigCreate(t, b, s, map[string]interface{}{
+		"hostname": "localhost",
+		"port":     "50000",
+	}))
+
+	roles := map[string]map[string]interface{}{
+		"payroll-prod": {"tags": "app:payroll,env:prod", "database": "sample"},
+		"payroll-dev":  {"tags": "app:payroll,env:dev", "database": "SAMPLE"},
+		"billing":      {"tags": "app:billing", "database": "billing"},
+		"untagged":     {"database": "sample"},
+	}
+	for name, d := range roles {
+		db.setPassword(name, testRotationPassword)
+		d["username"] = name
+		d["current_password"] = testRotationPassword
+		d["password_policy"] = testPasswordPolicy
+		_, err := testTokenRoleCreate(t, b, s, name, d)
+		require.NoError(t, err)
+	}
+
+	t.Run("Read Tags", func(t *testing.T) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      staticRolePath + "payroll-prod",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"app:payroll", "env:prod"}, resp.Data["tags"])
+	})
+
+	t.Run("Selector Required", func(t *testing.T) {
+		for _, d := range []map[string]interface{}{
+			{},
+			{"all": true, "tags": "app:payroll"},
+			{"all": true, "database": "sample"},
+			{"all": true, "max_parallel": 0},
+			{"all": true, "max_parallel": maxBulkRotationParallel + 1},
+		} {
+			resp, err := testRotateBulk(t, b, s, d)
+			require.NoError(t, err)
+			require.True(t, resp.IsError(), "%v", d)
+		}
+		require.Zero(t, db.rotations)
+	})
+
+	rotated := func(t *testing.T, d map[string]interface{}) []string {
+		t.Helper()
+		resp, err := testRotateBulk(t, b, s, d)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		var names []string
+		for name, result := range resp.Data["roles"].(map[string]interface{}) {
+			require.Equal(t, true, result.(map[string]interface{})["success"], name)
+			names = append(names, name)
+
+			role, err := b.staticRole(ctx, s, name)
+			require.NoError(t, err)
+			require.Equal(t, db.password(name), role.CurrentPassword)
+		}
+		require.Equal(t, len(names), resp.Data["rotated"])
+		require.Equal(t, 0, resp.Data["failed"])
+		return names
+	}
+
+	t.Run("Tags", func(t *testing.T) {
+		require.ElementsMatch(t, []string{"payroll-prod", "payroll-dev"}, rotated(t, map[string]interface{}{"tags": "app:payroll"}))
+		require.ElementsMatch(t, []string{"payroll-prod"}, rotated(t, map[string]interface{}{"tags": "env:prod,app:payroll"}))
+		require.Empty(t, rotated(t, map[string]interface{}{"tags": "env:staging"}))
+	})
+
+	t.Run("Database", func(t *testing.T) {
+		require.ElementsMatch(t, []string{"payroll-prod", "payroll-dev", "untagged"}, rotated(t, map[string]interface{}{"database": "sample"}))
+		require.ElementsMatch(t, []string{"payroll-dev"}, rotated(t, map[string]interface{}{"database": "sample", "tags": "env:dev"}))
+	})
+
+	t.Run("All", func(t *testing.T) {
+		require.ElementsMatch(t, []string{"payroll-prod", "payroll-dev", "billing", "untagged"}, rotated(t, map[string]interface{}{"all": true, "max_parallel": 2}))
+	})
+
+	t.Run("Partial Failure", func(t *testing.T) {
+		db.setPassword("billing", "changed-out-of-band")
+
+		resp, err := testRotateBulk(t, b, s, map[string]interface{}{"all": true})
+		require.NoError(t, err)
+		require.Equal(t, 4, resp.Data["requested"])
+		require.Equal(t, 3, resp.Data["rotated"])
+		require.Equal(t, 1, resp.Data["failed"])
+
+		results := resp.Data["roles"].(map[string]interface{})
+		billing := results["billing"].(map[string]interface{})
+		require.Equal(t, false, billing["success"])
+		require.NotEmpty(t, billing["error"])
+		require.Equal(t, true, results["untagged"].(map[string]interface{})["success"])
+		for _, result := range results {
+			require.NotContains(t, result, "current_password")
+		}
+
+		role, err := b.staticRole(ctx, s, "billing")
+		require.NoError(t, err)
+		require.Equal(t, 1, role.ConsecutiveFailures)
+	})
+}
+
+func testRotateBulk(t *testing.T, b *db2Backend, s logical.Storage, d map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "rotate-cred",
+		Data:      d,
+		Storage:   s,
+	})
+}
+
+// TestRotateRole_DryRun checks that a dry run reports each check, leaves DB2
+// untouched and only records its login with the role's circuit breaker.
+func TestRotateRole_DryRun(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	db.setPassword(testRotationUsername, testRotationPassword)
+	testRotationSetup(t, b, s, nil)
+
+	dryRun := func(t *testing.T) map[string]interface{} {
+		t.Helper()
+		before, err := b.staticRole(ctx, s, testRotationRole)
+		require.NoError(t, err)
+
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      rotateRolePath + testRotationRole + "/dry-run",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		after, err := b.staticRole(ctx, s, testRotationRole)
+		require.NoError(t, err)
+		after.AuthFailures, after.CircuitOpenUntil = before.AuthFailures, before.CircuitOpenUntil
+		require.Equal(t, before, after)
+		require.Zero(t, db.rotations)
+		wals, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Empty(t, wals)
+
+		failed := map[string]interface{}{}
+		for _, check := range resp.Data["checks"].([]map[string]interface{}) {
+			require.NotContains(t, check, "password")
+			if check["success"] == false {
+				failed[check["name"].(string)] = check["error"]
+			}
+		}
+		require.Equal(t, len(failed) == 0, resp.Data["success"])
+		return failed
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		require.Empty(t, dryRun(t))
+		require.Equal(t, testRotationPassword, db.password(testRotationUsername))
+	})
+
+	t.Run("Current Password Rejected", func(t *testing.T) {
+		db.setPassword(testRotationUsername, "changed-out-of-band")
+		defer db.setPassword(testRotationUsername, testRotationPassword)
+
+		failed := dryRun(t)
+		require.Len(t, failed, 1)
+		require.Contains(t, failed, "current_password")
+
+		// the failed login counts towards the circuit breaker
+		role, err := b.staticRole(ctx, s, testRotationRole)
+		require.NoError(t, err)
+		require.Equal(t, 1, role.AuthFailures)
+	})
+
+	t.Run("Current Password Expired", func(t *testing.T) {
+		db.setExpired(testRotationUsername, true)
+		defer db.setExpired(testRotationUsername, false)
+
+		// NEWPWD replaces an expired password, so the rotation can go ahead
+		require.Empty(t, dryRun(t))
+	})
+
+	t.Run("Unknown Password Policy", func(t *testing.T) {
+		testRotationRoleUpdate(t, b, s, map[string]interface{}{"password_policy": "missing"})
+		defer testRotationRoleUpdate(t, b, s, map[string]interface{}{"password_policy": testPasswordPolicy})
+
+		failed := dryRun(t)
+		require.Len(t, failed, 1)
+		require.Contains(t, failed, "password_policy")
+	})
+
+	t.Run("Statements Without Admin Credentials", func(t *testing.T) {
+		testRotationRoleUpdate(t, b, s, map[string]interface{}{
+			"rotation_statements": []string{"CALL SYSPROC.SET_PASSWORD('{{username}}', '{{password}}')"},
+		})
+
+		failed := dryRun(t)
+		require.Len(t, failed, 1)
+		require.Contains(t, failed, "admin_credentials")
+	})
+
+	t.Run("No Config", func(t *testing.T) {
+		// the config cannot be deleted while the role uses it
+		require.NoError(t, s.Delete(context.Background(), configStoragePath))
+		require.NoError(t, s.Delete(context.Background(), connectionPath+defaultConnectionName))
+
+		failed := dryRun(t)
+		require.Len(t, failed, 1)
+		require.Contains(t, failed, "config")
+	})
+}
+
+// TestRotateRole_ExpiredPassword checks that a role whose password has
+// expired is not treated as out of sync or as failing to log in, and is
+// rotated early through NEWPWD.
+func TestRotateRole_ExpiredPassword(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	withTestClock(b)
+	db.setPassword(testRotationUsername, testRotationPassword)
+	testRotationSetup(t, b, s, map[string]interface{}{
+		"rotation_period": "24h",
+	})
+	require.NoError(t, testConfigUpdate(t, b, s, map[string]interface{}{
+		"lockout_threshold": 1,
+	}))
+	_, err := testRotateRole(t, b, s, testRotationRole)
+	require.NoError(t, err)
+	require.Equal(t, 1, db.rotations)
+
+	db.setExpired(testRotationUsername, true)
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      staticRolePath + testRotationRole + "/verify",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), resp.Error())
+	require.Equal(t, false, resp.Data["out_of_sync"])
+	require.Contains(t, resp.Data["drift_check_error"], "PASSWORD EXPIRED")
+	require.Contains(t, resp.Data["drift_check_error"], "newpwd")
+
+	role, err := b.staticRole(ctx, s, testRotationRole)
+	require.NoError(t, err)
+	require.Zero(t, role.AuthFailures)
+
+	// the role is not due for a day, but the expired password is replaced
+	// at the next tick
+	testTick(t, b, s)
+	require.Equal(t, 2, db.rotations)
+
+	role, err = b.staticRole(ctx, s, testRotationRole)
+	require.NoError(t, err)
+	require.Equal(t, role.CurrentPassword, db.password(testRotationUsername))
+	require.NoError(t, db.Verify(ctx, db2client.ConnectionInfo{Username: testRotationUsername, Password: role.CurrentPassword}))
+}
@@ -0,0 +1,270 @@
+package db2secretengine
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	statusPath = "status"
+
+	// overdueSlack is how long past its rotation time a role's password may
+	// be before it is reported as overdue, so that roles waiting for the
+	// next periodic function invocation are not.
+	overdueSlack = 5 * time.Minute
+)
+
+// statusCSVHeader lists the columns of the status report in CSV format, one
+// row per static role.
+var statusCSVHeader = []string{
+	"role",
+	"username",
+	"database",
+	"last_vault_rotation",
+	"next_vault_rotation",
+	"overdue",
+	"failing",
+	"never_rotated",
+	"out_of_sync",
+	"consecutive_failures",
+	"last_rotation_error",
+}
+
+// roleStatus is the health of one static role in the status report.
+type roleStatus struct {
+	Name         string
+	Role         *db2RoleEntry
+	Overdue      bool
+	Failing      bool
+	NeverRotated bool
+}
+
+func (r *roleStatus) csvRecord() []string {
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	var next time.Time
+	if r.Role.autoRotates() {
+		next = r.Role.NextRotationTime()
+	}
+	return []string{
+		r.Name,
+		r.Role.Username,
+		r.Role.Database,
+		formatTime(r.Role.LastVaultRotation),
+		formatTime(next),
+		strconv.FormatBool(r.Overdue),
+		strconv.FormatBool(r.Failing),
+		strconv.FormatBool(r.NeverRotated),
+		strconv.FormatBool(r.Role.OutOfSync),
+		strconv.Itoa(r.Role.ConsecutiveFailures),
+		r.Role.LastRotationError,
+	}
+}
+
+// overdue reports whether the role's password has outlived its rotation
+// period or schedule, or maxPasswordAge when that is set. A role that was
+// never rotated has no known age and is not overdue.
+func (r *db2RoleEntry) overdue(now time.Time, maxPasswordAge time.Duration) bool {
+	if r.LastVaultRotation.IsZero() {
+		return false
+	}
+	if maxPasswordAge != 0 && now.Sub(r.LastVaultRotation) > maxPasswordAge {
+		return true
+	}
+	return r.autoRotates() && now.After(r.NextRotationTime().Add(overdueSlack))
+}
+
+func pathStatus(b *db2Backend) *framework.Path {
+	return &framework.Path{
+		Pattern: statusPath,
+		Fields: map[string]*framework.FieldSchema{
+			"format": {
+				Type:        framework.TypeString,
+				Description: `The format of the report, "json" or "csv". The CSV report has one row per static role.`,
+				Default:     "json",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathStatusRead,
+			},
+		},
+		HelpSynopsis:    pathStatusHelpSynopsis,
+		HelpDescription: pathStatusHelpDescription,
+	}
+}
+
+func (b *db2Backend) pathStatusRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	format := d.Get("format").(string)
+	if format != "json" && format != "csv" {
+		return logical.ErrorResponse("unknown format %q, expected json or csv", format), nil
+	}
+
+	config, err := getSettings(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	var maxPasswordAge time.Duration
+	if config != nil {
+		maxPasswordAge = config.MaxPasswordAge
+	}
+
+	names, err := req.Storage.List(ctx, staticRolePath)
+	if err != nil {
+		return nil, err
+	}
+
+	now := b.now()
+	statuses := make([]*roleStatus, 0, len(names))
+	for _, name := range names {
+		role, err := b.staticRole(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			// deleted since it was listed
+			continue
+		}
+		statuses = append(statuses, &roleStatus{
+			Name:         name,
+			Role:         role,
+			Overdue:      role.overdue(now, maxPasswordAge),
+			Failing:      role.ConsecutiveFailures > 0,
+			NeverRotated: role.LastVaultRotation.IsZero(),
+		})
+	}
+
+	if format == "csv" {
+		return statusCSV(statuses)
+	}
+
+	overdue := []string{}
+	failing := []string{}
+	neverRotated := []string{}
+	outOfSync := []string{}
+	for _, status := range statuses {
+		if status.Overdue {
+			overdue = append(overdue, status.Name)
+		}
+		if status.Failing {
+			failing = append(failing, status.Name)
+		}
+		if status.NeverRotated {
+			neverRotated = append(neverRotated, status.Name)
+		}
+		if status.Role.OutOfSync {
+			outOfSync = append(outOfSync, status.Name)
+		}
+	}
+
+	connectionNames, err := listConnections(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	connections := []map[string]interface{}{}
+	allReachable := true
+	for _, name := range connectionNames {
+		connectionConfig, err := getConnectionConfig(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if connectionConfig == nil {
+			// deleted since it was listed
+			continue
+		}
+		connection := map[string]interface{}{
+			"name":      name,
+			"hostname":  connectionConfig.Hostname,
+			"port":      connectionConfig.Port,
+			"reachable": true,
+			"error":     "",
+		}
+		if err := b.pingConnection(ctx, req.Storage, name, connectionConfig); err != nil {
+			connection["reachable"] = false
+			connection["error"] = err.Error()
+			allReachable = false
+		}
+		connections = append(connections, connection)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"healthy": allReachable && len(overdue) == 0 && len(failing) == 0 &&
+				len(neverRotated) == 0 && len(outOfSync) == 0,
+			"time":                now,
+			"max_password_age":    maxPasswordAge.Seconds(),
+			"role_count":          len(statuses),
+			"overdue":             overdue,
+			"overdue_count":       len(overdue),
+			"failing":             failing,
+			"failing_count":       len(failing),
+			"never_rotated":       neverRotated,
+			"never_rotated_count": len(neverRotated),
+			"out_of_sync":         outOfSync,
+			"out_of_sync_count":   len(outOfSync),
+			"connections":         connections,
+		},
+	}, nil
+}
+
+// pingConnection checks that the DB2 server of the named connection, whose
+// settings are in config, is reachable.
+func (b *db2Backend) pingConnection(ctx context.Context, s logical.Storage, name string, config *db2Config) error {
+	db2Client, err := b.getClient(ctx, s, name)
+	if err != nil {
+		return err
+	}
+	defer b.releaseClient(db2Client)
+	return db2Client.Ping(ctx, config.Hostname, config.Port)
+}
+
+// statusCSV returns the role statuses as a raw CSV response.
+func statusCSV(statuses []*roleStatus) (*logical.Response, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(statusCSVHeader); err != nil {
+		return nil, err
+	}
+	for _, status := range statuses {
+		if err := w.Write(status.csvRecord()); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			logical.HTTPContentType: "text/csv",
+			logical.HTTPRawBody:     buf.Bytes(),
+			logical.HTTPStatusCode:  http.StatusOK,
+		},
+	}, nil
+}
+
+const pathStatusHelpSynopsis = `Report the health of every static role and of the DB2 connections.`
+
+const pathStatusHelpDescription = `
+Walks all static roles and reports which are overdue for rotation, which are
+failing to rotate, which were never rotated by Vault and which are out of
+sync with DB2. A role is overdue when its password has outlived its rotation
+period or schedule, or the config's max_password_age. The report also says
+whether the DB2 server of each configured connection accepts connections,
+and "healthy" is true only when nothing needs attention.
+
+Set format=csv for one row per static role, suitable for compliance records.
+`
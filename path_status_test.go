@@ -0,0 +1,167 @@
+package db2secretengine
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+
+	"vault-plugin-secrets-hashicups/db2client"
+)
+
+// TestStatus checks that the status report lists overdue, failing, never
+// rotated and out of sync roles and whether the connection is reachable.
+func TestStatus(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	clock := withTestClock(b)
+
+	statusRead := func(t *testing.T, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      statusPath,
+			Data:      data,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), resp.Error())
+		return resp
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		resp := statusRead(t, nil)
+		require.Equal(t, true, resp.Data["healthy"])
+		require.Equal(t, 0, resp.Data["role_count"])
+		require.Empty(t, resp.Data["connections"])
+	})
+
+	require.NoError(t, testConfigCreate(t, b, s, map[string]interface{}{
+		"hostname":         "localhost",
+		"port":             "50000",
+		"max_password_age": "720h",
+	}))
+	for _, role := range []struct {
+		name   string
+		period string
+	}{
+		{"fresh", "24h"},
+		{"stale", "0"},
+		{"broken", "0"},
+		{"unrotated", "0"},
+	} {
+		db.setPassword(role.name+"-user", testRotationPassword)
+		resp, err := testTokenRoleCreate(t, b, s, role.name, map[string]interface{}{
+			"username":         role.name + "-user",
+			"current_password": testRotationPassword,
+			"password_policy":  testPasswordPolicy,
+			"database":         "sample",
+			"rotation_period":  role.period,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	}
+	for _, name := range []string{"fresh", "stale", "broken"} {
+		_, err := testRotateRole(t, b, s, name)
+		require.NoError(t, err)
+	}
+
+	t.Run("Healthy Apart From Never Rotated", func(t *testing.T) {
+		resp := statusRead(t, nil)
+		require.Equal(t, false, resp.Data["healthy"])
+		require.Equal(t, 4, resp.Data["role_count"])
+		require.Equal(t, []string{"unrotated"}, resp.Data["never_rotated"])
+		require.Equal(t, 1, resp.Data["never_rotated_count"])
+		require.Empty(t, resp.Data["overdue"])
+		require.Empty(t, resp.Data["failing"])
+		require.Equal(t, []map[string]interface{}{{
+			"name":      defaultConnectionName,
+			"hostname":  "localhost",
+			"port":      "50000",
+			"reachable": true,
+			"error":     "",
+		}}, resp.Data["connections"])
+	})
+
+	t.Run("Overdue And Failing", func(t *testing.T) {
+		db.failPhase = db2client.PhaseVerifyNew
+		_, err := testRotateRole(t, b, s, "broken")
+		require.Error(t, err)
+		db.failPhase = ""
+
+		clock.Add(25 * time.Hour)
+		resp := statusRead(t, nil)
+		require.Equal(t, []string{"fresh"}, resp.Data["overdue"])
+		require.Equal(t, []string{"broken"}, resp.Data["failing"])
+		require.Equal(t, 1, resp.Data["failing_count"])
+
+		clock.Add(30 * 24 * time.Hour)
+		resp = statusRead(t, nil)
+		require.Equal(t, []string{"broken", "fresh", "stale"}, resp.Data["overdue"])
+		require.Equal(t, 3, resp.Data["overdue_count"])
+	})
+
+	t.Run("Out Of Sync", func(t *testing.T) {
+		db.setPassword("fresh-user", "changed-outside-vault")
+		_, err := b.verifyRole(ctx, s, "fresh")
+		require.NoError(t, err)
+
+		resp := statusRead(t, nil)
+		require.Equal(t, []string{"fresh"}, resp.Data["out_of_sync"])
+		require.Equal(t, 1, resp.Data["out_of_sync_count"])
+	})
+
+	t.Run("Unreachable Connection", func(t *testing.T) {
+		db.pingErr = errors.New("connection refused")
+		defer func() { db.pingErr = nil }()
+
+		resp := statusRead(t, nil)
+		connections := resp.Data["connections"].([]map[string]interface{})
+		require.Len(t, connections, 1)
+		require.Equal(t, false, connections[0]["reachable"])
+		require.Equal(t, "connection refused", connections[0]["error"])
+	})
+
+	t.Run("CSV", func(t *testing.T) {
+		resp := statusRead(t, map[string]interface{}{"format": "csv"})
+		require.Equal(t, "text/csv", resp.Data[logical.HTTPContentType])
+
+		records, err := csv.NewReader(strings.NewReader(string(resp.Data[logical.HTTPRawBody].([]byte)))).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, records, 5)
+		require.Equal(t, statusCSVHeader, records[0])
+
+		rows := map[string]map[string]string{}
+		for _, record := range records[1:] {
+			row := map[string]string{}
+			for i, column := range statusCSVHeader {
+				row[column] = record[i]
+			}
+			rows[row["role"]] = row
+		}
+		require.Equal(t, "true", rows["broken"]["failing"])
+		require.Equal(t, "1", rows["broken"]["consecutive_failures"])
+		require.NotEmpty(t, rows["broken"]["last_rotation_error"])
+		require.Equal(t, "true", rows["fresh"]["out_of_sync"])
+		require.Equal(t, "true", rows["unrotated"]["never_rotated"])
+		require.Equal(t, "", rows["unrotated"]["last_vault_rotation"])
+		require.Equal(t, "unrotated-user", rows["unrotated"]["username"])
+	})
+
+	t.Run("Unknown Format", func(t *testing.T) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      statusPath,
+			Data:      map[string]interface{}{"format": "xml"},
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+}
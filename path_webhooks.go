@@ -0,0 +1,220 @@
+package db2secretengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	webhookPath = "config/webhook/"
+)
+
+// webhookConfig is an endpoint notified after every rotation attempt.
+type webhookConfig struct {
+	URL string `json:"url"`
+
+	// Secret is the HMAC key used to sign each event.
+	Secret string `json:"secret"`
+}
+
+func pathWebhooks(b *db2Backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: webhookPath + framework.GenericNameRegex("name"),
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the webhook",
+					Required:    true,
+				},
+				"url": {
+					Type:        framework.TypeString,
+					Description: "The http or https URL that rotation events are posted to.",
+					Required:    true,
+					DisplayAttrs: &framework.DisplayAttributes{
+						Name: "URL",
+					},
+				},
+				"secret": {
+					Type:        framework.TypeString,
+					Description: "The key used to sign events with HMAC-SHA256. The signature is sent in the " + webhookSignatureHeader + " header.",
+					Required:    true,
+					DisplayAttrs: &framework.DisplayAttributes{
+						Name:      "Secret",
+						Sensitive: true,
+					},
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathWebhookRead,
+				},
+				logical.CreateOperation: &framework.PathOperation{
+					Callback: b.pathWebhookWrite,
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathWebhookWrite,
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathWebhookDelete,
+				},
+			},
+			ExistenceCheck:  b.pathWebhookExistenceCheck,
+			HelpSynopsis:    pathWebhookHelpSynopsis,
+			HelpDescription: pathWebhookHelpDescription,
+		},
+		{
+			Pattern: webhookPath + "?$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathWebhooksList,
+				},
+			},
+			HelpSynopsis:    pathWebhookListHelpSynopsis,
+			HelpDescription: pathWebhookListHelpDescription,
+		},
+	}
+}
+
+func (b *db2Backend) pathWebhookExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	webhook, err := getWebhook(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+	return webhook != nil, nil
+}
+
+func (b *db2Backend) pathWebhooksList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entries, err := req.Storage.List(ctx, webhookPath)
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(entries), nil
+}
+
+func (b *db2Backend) pathWebhookRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	webhook, err := getWebhook(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if webhook == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"url": webhook.URL,
+		},
+	}, nil
+}
+
+func (b *db2Backend) pathWebhookWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	webhook, err := getWebhook(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if webhook == nil {
+		webhook = new(webhookConfig)
+	}
+
+	if rawURL, ok := d.GetOk("url"); ok {
+		webhook.URL = rawURL.(string)
+	}
+	if secret, ok := d.GetOk("secret"); ok {
+		webhook.Secret = secret.(string)
+	}
+
+	if err := validateWebhookURL(webhook.URL); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if webhook.Secret == "" {
+		return logical.ErrorResponse("missing secret in webhook"), nil
+	}
+
+	entry, err := logical.StorageEntryJSON(webhookPath+name, webhook)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *db2Backend) pathWebhookDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, webhookPath+d.Get("name").(string)); err != nil {
+		return nil, fmt.Errorf("error deleting webhook: %w", err)
+	}
+	return nil, nil
+}
+
+func validateWebhookURL(rawURL string) error {
+	if rawURL == "" {
+		return errors.New("missing url in webhook")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	return nil
+}
+
+func getWebhook(ctx context.Context, s logical.Storage, name string) (*webhookConfig, error) {
+	entry, err := s.Get(ctx, webhookPath+name)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving webhook: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	webhook := new(webhookConfig)
+	if err := entry.DecodeJSON(webhook); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// getWebhooks returns every configured webhook.
+func getWebhooks(ctx context.Context, s logical.Storage) ([]*webhookConfig, error) {
+	names, err := s.List(ctx, webhookPath)
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := make([]*webhookConfig, 0, len(names))
+	for _, name := range names {
+		webhook, err := getWebhook(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+		if webhook != nil {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	return webhooks, nil
+}
+
+const pathWebhookHelpSynopsis = `Configure a webhook notified of rotation events.`
+
+const pathWebhookHelpDescription = `
+After every attempt to rotate a static role, a JSON event naming the role,
+username, database, outcome and time is posted to each configured webhook.
+Events never contain a password. Each event is signed with HMAC-SHA256 using
+the webhook's secret, and delivery is retried with backoff.
+`
+
+const pathWebhookListHelpSynopsis = `List the configured webhooks.`
+
+const pathWebhookListHelpDescription = `List the names of the webhooks notified of rotation events.`
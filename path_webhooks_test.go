@@ -0,0 +1,251 @@
+package db2secretengine
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+
+	"vault-plugin-secrets-hashicups/db2client"
+)
+
+const testWebhookSecret = "webhook-secret"
+
+// testWebhookReceiver records the requests posted to it, answering with the
+// queued statuses before returning 200.
+type testWebhookReceiver struct {
+	*httptest.Server
+	requests chan *http.Request
+	bodies   chan []byte
+	statuses chan int
+}
+
+func newTestWebhookReceiver(t *testing.T) *testWebhookReceiver {
+	r := &testWebhookReceiver{
+		requests: make(chan *http.Request, 10),
+		bodies:   make(chan []byte, 10),
+		statuses: make(chan int, 10),
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		r.requests <- req
+		r.bodies <- body
+
+		select {
+		case status := <-r.statuses:
+			w.WriteHeader(status)
+		default:
+		}
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// receive returns the next event posted to the receiver and its raw body
+// after checking its signature.
+func (r *testWebhookReceiver) receive(t *testing.T) (*webhookEvent, string) {
+	t.Helper()
+	select {
+	case req := <-r.requests:
+		body := <-r.bodies
+		require.Equal(t, http.MethodPost, req.Method)
+		require.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		require.Equal(t, signWebhook(testWebhookSecret, body), req.Header.Get(webhookSignatureHeader))
+
+		var event webhookEvent
+		require.NoError(t, json.Unmarshal(body, &event))
+		return &event, string(body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook event received")
+		return nil, ""
+	}
+}
+
+// TestWebhook checks that every rotation attempt is posted, signed, to each
+// webhook without the password, and that failed deliveries are retried.
+func TestWebhook(t *testing.T) {
+	b, s := getTestBackend(t)
+	b.webhookBackoff = time.Millisecond
+	db := withFakeDB2(b)
+	db.setPassword(testRotationUsername, testRotationPassword)
+	testRotationSetup(t, b, s, nil)
+
+	receivers := []*testWebhookReceiver{newTestWebhookReceiver(t), newTestWebhookReceiver(t)}
+	for i, receiver := range receivers {
+		resp, err := testWebhookWrite(t, b, s, string(rune('a'+i)), map[string]interface{}{
+			"url":    receiver.URL,
+			"secret": testWebhookSecret,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	}
+
+	t.Run("Rotation", func(t *testing.T) {
+		resp, err := testRotateRole(t, b, s, testRotationRole)
+		require.NoError(t, err)
+
+		for _, receiver := range receivers {
+			event, body := receiver.receive(t)
+			require.NotContains(t, body, resp.Data["current_password"].(string))
+			require.NotContains(t, body, testRotationPassword)
+			require.NotEmpty(t, event.ID)
+			require.Equal(t, "rotation", event.Type)
+			require.Equal(t, testRotationRole, event.Role)
+			require.Equal(t, testRotationUsername, event.Username)
+			require.Equal(t, "sample", event.Database)
+			require.Equal(t, triggerManual, event.Trigger)
+			require.True(t, event.Success)
+			require.Empty(t, event.ErrorCategory)
+			require.False(t, event.Timestamp.IsZero())
+		}
+	})
+
+	t.Run("Failed Rotation", func(t *testing.T) {
+		db.failPhase = db2client.PhaseChange
+		defer func() { db.failPhase = "" }()
+
+		_, err := testRotateRole(t, b, s, testRotationRole)
+		require.Error(t, err)
+
+		for _, receiver := range receivers {
+			event, _ := receiver.receive(t)
+			require.False(t, event.Success)
+			require.Equal(t, errorCategoryChange, event.ErrorCategory)
+		}
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		receivers[0].statuses <- http.StatusInternalServerError
+		receivers[0].statuses <- http.StatusTooManyRequests
+
+		_, err := testRotateRole(t, b, s, testRotationRole)
+		require.NoError(t, err)
+
+		_, first := receivers[0].receive(t)
+		for i := 0; i < 2; i++ {
+			_, body := receivers[0].receive(t)
+			require.Equal(t, first, body)
+		}
+		receivers[1].receive(t)
+	})
+
+	t.Run("No Retry On Client Error", func(t *testing.T) {
+		receivers[0].statuses <- http.StatusBadRequest
+
+		_, err := testRotateRole(t, b, s, testRotationRole)
+		require.NoError(t, err)
+
+		receivers[0].receive(t)
+		receivers[1].receive(t)
+		b.webhooks.Wait()
+		require.Empty(t, receivers[0].requests)
+	})
+
+	t.Run("Gives Up", func(t *testing.T) {
+		for i := 0; i < webhookAttempts; i++ {
+			receivers[0].statuses <- http.StatusServiceUnavailable
+		}
+
+		_, err := testRotateRole(t, b, s, testRotationRole)
+		require.NoError(t, err)
+
+		for i := 0; i < webhookAttempts; i++ {
+			receivers[0].receive(t)
+		}
+		receivers[1].receive(t)
+		b.webhooks.Wait()
+		require.Empty(t, receivers[0].requests)
+	})
+
+	t.Run("Recovery", func(t *testing.T) {
+		ctx := context.Background()
+		role, err := b.staticRole(ctx, s, testRotationRole)
+		require.NoError(t, err)
+
+		_, err = framework.PutWAL(ctx, s, staticWALKey, &setCredentialsWAL{
+			RoleName:    testRotationRole,
+			Username:    testRotationUsername,
+			OldPassword: role.CurrentPassword,
+			NewPassword: "New!Password1",
+		})
+		require.NoError(t, err)
+		db.setPassword(testRotationUsername, "New!Password1")
+
+		testWALRollback(t, b, s)
+
+		for _, receiver := range receivers {
+			event, body := receiver.receive(t)
+			require.NotContains(t, body, "New!Password1")
+			require.Equal(t, triggerRecovery, event.Trigger)
+			require.True(t, event.Success)
+		}
+	})
+}
+
+// TestWebhookConfig checks webhook validation and that the secret is never
+// returned.
+func TestWebhookConfig(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	for _, d := range []map[string]interface{}{
+		{"secret": testWebhookSecret},
+		{"url": "ftp://example.com/hook", "secret": testWebhookSecret},
+		{"url": "/hook", "secret": testWebhookSecret},
+		{"url": "https://example.com/hook"},
+	} {
+		resp, err := testWebhookWrite(t, b, s, "invalid", d)
+		require.NoError(t, err)
+		require.True(t, resp.IsError(), "%v", d)
+	}
+
+	resp, err := testWebhookWrite(t, b, s, "ops", map[string]interface{}{
+		"url":    "https://example.com/hook",
+		"secret": testWebhookSecret,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	resp, err = testWebhookWrite(t, b, s, "ops", map[string]interface{}{
+		"url": "https://example.com/other",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      webhookPath + "ops",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"url": "https://example.com/other"}, resp.Data)
+
+	webhook, err := getWebhook(context.Background(), s, "ops")
+	require.NoError(t, err)
+	require.Equal(t, testWebhookSecret, webhook.Secret)
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      webhookPath,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"ops"}, resp.Data["keys"])
+}
+
+func testWebhookWrite(t *testing.T, b *db2Backend, s logical.Storage, name string, d map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      webhookPath + name,
+		Data:      d,
+		Storage:   s,
+	})
+}
@@ -0,0 +1,597 @@
+package db2secretengine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hashicorp/vault/sdk/queue"
+
+	"vault-plugin-secrets-hashicups/db2client"
+)
+
+const (
+	// minRotationPeriod is the smallest rotation period a static role may use.
+	// Vault invokes the periodic function roughly once a minute, so shorter
+	// periods could not be honoured anyway.
+	minRotationPeriod = time.Minute
+
+	// minRotationWindow is the smallest rotation window a scheduled static
+	// role may use, leaving room for a few periodic function invocations.
+	minRotationWindow = time.Hour
+
+	// rotationRetryBackoff is how long a role waits before the periodic
+	// function tries again after its first failed rotation. The wait doubles
+	// with each consecutive failure, up to maxRotationRetryBackoff.
+	rotationRetryBackoff    = 10 * time.Second
+	maxRotationRetryBackoff = time.Hour
+
+	// staticWALKey is the WAL kind used to record in-flight static role
+	// rotations.
+	staticWALKey = "staticRotationKey"
+
+	// rootWALKey is the WAL kind used to record in-flight rotations of a
+	// connection's administrative password.
+	rootWALKey = "rootRotationKey"
+
+	// minStaticWALAge is how old a rotation WAL entry must be before it is
+	// reconciled, so that rotations still in flight are left alone.
+	minStaticWALAge = time.Minute
+)
+
+// setCredentialsWAL records a password change that has been sent to DB2 but
+// not yet committed to the role. It is written before DB2 is contacted so
+// the new password survives a crash.
+type setCredentialsWAL struct {
+	RoleName    string `json:"role_name"`
+	Username    string `json:"username"`
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// setRootCredentialsWAL records a change of the administrative password of a
+// connection that has been sent to DB2 but not yet committed to storage.
+type setRootCredentialsWAL struct {
+	Connection  string `json:"connection"`
+	Username    string `json:"username"`
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// initialize rebuilds the rotation queue from storage when the backend is
+// loaded. Only the node that is able to write to storage manages rotations.
+func (b *db2Backend) initialize(ctx context.Context, req *logical.InitializationRequest) error {
+	if !b.canRotate() {
+		return nil
+	}
+
+	if err := b.migrateConfig(ctx, req.Storage); err != nil {
+		b.Logger().Warn("unable to migrate config to the default connection", "error", err)
+	}
+
+	b.populateQueue(ctx, req.Storage)
+	return nil
+}
+
+// canRotate reports whether this node is responsible for rotating credentials.
+func (b *db2Backend) canRotate() bool {
+	replicationState := b.System().ReplicationState()
+	if (b.System().LocalMount() || !replicationState.HasState(consts.ReplicationPerformanceSecondary)) &&
+		!replicationState.HasState(consts.ReplicationDRSecondary) &&
+		!replicationState.HasState(consts.ReplicationPerformanceStandby) {
+		return true
+	}
+	return false
+}
+
+// periodicFunc is invoked by Vault on a regular interval. It checks static
+// roles for drift when due and rotates any whose rotation period has elapsed.
+func (b *db2Backend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	if !b.canRotate() {
+		return nil
+	}
+
+	b.checkDrift(ctx, req.Storage)
+	b.rotateCredentials(ctx, req.Storage)
+	b.expirePreviousPasswords(ctx, req.Storage)
+	return nil
+}
+
+// expirePreviousPasswords drops previous passwords whose grace period has
+// ended from storage.
+func (b *db2Backend) expirePreviousPasswords(ctx context.Context, s logical.Storage) {
+	roles, err := s.List(ctx, staticRolePath)
+	if err != nil {
+		b.Logger().Warn("unable to list static roles", "error", err)
+		return
+	}
+
+	for _, roleName := range roles {
+		if err := b.expirePreviousPassword(ctx, s, roleName); err != nil {
+			b.Logger().Warn("unable to expire previous password", "role", roleName, "error", err)
+		}
+	}
+}
+
+func (b *db2Backend) expirePreviousPassword(ctx context.Context, s logical.Storage, roleName string) error {
+	lock := b.roleLock(roleName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := b.staticRole(ctx, s, roleName)
+	if err != nil {
+		return err
+	}
+	if role == nil || role.PreviousPassword == "" || role.previousPasswordValid(b.now()) {
+		return nil
+	}
+
+	role.PreviousPassword = ""
+	role.PreviousVaultRotation = time.Time{}
+	return setRole(ctx, s, roleName, role)
+}
+
+// populateQueue loads every static role with a rotation period into the
+// rotation queue, prioritized by its next rotation time.
+func (b *db2Backend) populateQueue(ctx context.Context, s logical.Storage) {
+	log := b.Logger()
+	log.Info("populating role rotation queue")
+
+	roles, err := s.List(ctx, staticRolePath)
+	if err != nil {
+		log.Warn("unable to list static roles", "error", err)
+		return
+	}
+
+	for _, roleName := range roles {
+		select {
+		case <-ctx.Done():
+			log.Info("rotation queue restore cancelled")
+			return
+		default:
+		}
+
+		role, err := b.staticRole(ctx, s, roleName)
+		if err != nil {
+			log.Warn("unable to read static role", "error", err, "role", roleName)
+			continue
+		}
+		if role == nil || !role.autoRotates() {
+			continue
+		}
+
+		if err := b.pushItem(&queue.Item{
+			Key:      roleName,
+			Priority: b.nextRotationAttempt(role).Unix(),
+		}); err != nil {
+			log.Warn("unable to enqueue item", "error", err, "role", roleName)
+		}
+	}
+}
+
+// rotateCredentials rotates every static role that is currently due.
+func (b *db2Backend) rotateCredentials(ctx context.Context, s logical.Storage) {
+	for b.rotateCredential(ctx, s) {
+	}
+}
+
+// rotateCredential pops the next role off the rotation queue and rotates it
+// if it is due. It returns false once there is nothing left to rotate.
+func (b *db2Backend) rotateCredential(ctx context.Context, s logical.Storage) bool {
+	// Quit rotating credentials if shutdown has started
+	select {
+	case <-ctx.Done():
+		return false
+	default:
+	}
+
+	item, err := b.popFromRotationQueue()
+	if err != nil {
+		if !errors.Is(err, queue.ErrEmpty) {
+			b.Logger().Error("error popping item from queue", "error", err)
+		}
+		return false
+	}
+
+	// Guard against possible nil item
+	if item == nil {
+		return false
+	}
+
+	// If "now" is less than the Item priority, then this item does not need
+	// to be rotated
+	if b.now().Unix() < item.Priority {
+		if err := b.pushItem(item); err != nil {
+			b.Logger().Error("unable to push item on to queue", "error", err)
+		}
+		return false
+	}
+
+	// Grab the exclusive lock for this Role, to make sure we don't incur any
+	// writes during the rotation process
+	lock := b.roleLock(item.Key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Validate the role still exists and is still scheduled
+	role, err := b.staticRole(ctx, s, item.Key)
+	if err != nil {
+		b.Logger().Error("unable to load role", "role", item.Key, "error", err)
+		item.Priority = b.now().Add(rotationRetryBackoff).Unix()
+		if err := b.pushItem(item); err != nil {
+			b.Logger().Error("unable to push item on to queue", "error", err)
+		}
+		return true
+	}
+	if role == nil || !role.autoRotates() {
+		b.Logger().Warn("role not found or no longer scheduled for rotation", "role", item.Key)
+		return true
+	}
+
+	// An account lent out by a library is rotated when it is checked in
+	out, err := getCheckOut(ctx, s, item.Key)
+	if err != nil {
+		b.Logger().Error("unable to load check-out", "role", item.Key, "error", err)
+	}
+	if out != nil || err != nil {
+		item.Priority = b.now().Add(minRotationPeriod).Unix()
+		if err := b.pushItem(item); err != nil {
+			b.Logger().Error("unable to push item on to queue", "error", err)
+		}
+		return true
+	}
+
+	// A role whose password was changed outside Vault waits for an operator,
+	// who reschedules it by resolving the drift
+	if role.OutOfSync {
+		b.Logger().Warn("skipping rotation of out of sync role", "role", item.Key)
+		return true
+	}
+
+	// A scheduled role that missed its rotation window waits for the next one
+	if now := b.now(); !role.inRotationWindow(now) {
+		b.Logger().Info("rotation window missed, waiting for the next scheduled time", "role", item.Key)
+		if err := role.setNextVaultRotation(now); err != nil {
+			b.Logger().Error("unable to compute next scheduled rotation", "role", item.Key, "error", err)
+			return true
+		}
+		if err := setRole(ctx, s, item.Key, role); err != nil {
+			b.Logger().Error("unable to store next scheduled rotation", "role", item.Key, "error", err)
+		}
+		item.Priority = b.nextRotationAttempt(role).Unix()
+		if err := b.pushItem(item); err != nil {
+			b.Logger().Error("unable to push item on to queue", "error", err)
+		}
+		return true
+	}
+
+	input := &setStaticAccountInput{
+		RoleName: item.Key,
+		Role:     role,
+		Trigger:  triggerScheduled,
+	}
+
+	if _, err := b.setStaticAccountPassword(ctx, s, input); err != nil {
+		b.Logger().Error("unable to rotate credentials in periodic function", "role", item.Key, "failures", input.Role.ConsecutiveFailures, "error", err)
+
+		// Push the role back far enough that the next call to this method
+		// will not attempt to rotate it, backing off further with every
+		// consecutive failure
+		item.Priority = b.nextRotationAttempt(input.Role).Unix()
+		if err := b.pushItem(item); err != nil {
+			b.Logger().Error("unable to push item on to queue", "error", err)
+		}
+		return true
+	}
+
+	item.Priority = b.nextRotationAttempt(input.Role).Unix()
+	if err := b.pushItem(item); err != nil {
+		b.Logger().Warn("unable to push item on to queue", "error", err)
+	}
+	return true
+}
+
+// rotationBackoff returns how long to wait before retrying a role that has
+// failed to rotate the given number of consecutive times.
+func rotationBackoff(failures int) time.Duration {
+	backoff := rotationRetryBackoff
+	for i := 1; i < failures; i++ {
+		backoff *= 2
+		if backoff >= maxRotationRetryBackoff {
+			return maxRotationRetryBackoff
+		}
+	}
+	return backoff
+}
+
+// nextRotationAttempt returns when the role will next be rotated, taking
+// the backoff from any consecutive failures and an open circuit breaker into
+// account.
+func (b *db2Backend) nextRotationAttempt(role *db2RoleEntry) time.Time {
+	next := role.NextRotationTime()
+	if role.ConsecutiveFailures != 0 {
+		if retry := role.LastRotationAttempt.Add(rotationBackoff(role.ConsecutiveFailures)); retry.After(next) {
+			next = retry
+		}
+	}
+	// an open circuit breaker holds rotations until it closes
+	if role.CircuitOpenUntil.After(next) {
+		next = role.CircuitOpenUntil
+	}
+	return next
+}
+
+// scheduleRotation adds the role to the rotation queue, replacing any
+// existing entry. Roles without a rotation period are removed from the queue.
+func (b *db2Backend) scheduleRotation(name string, role *db2RoleEntry) error {
+	if _, err := b.popByKey(name); err != nil {
+		return err
+	}
+	if role == nil || !role.autoRotates() || role.OutOfSync {
+		return nil
+	}
+
+	return b.pushItem(&queue.Item{
+		Key:      name,
+		Priority: b.nextRotationAttempt(role).Unix(),
+	})
+}
+
+// pushItem wraps the internal queue's Push call, to make sure a queue is
+// actually available.
+func (b *db2Backend) pushItem(item *queue.Item) error {
+	if b.credRotationQueue == nil {
+		return errors.New("rotation queue is not initialized")
+	}
+	return b.credRotationQueue.Push(item)
+}
+
+// popFromRotationQueue wraps the internal queue's Pop call, to make sure a
+// queue is actually available.
+func (b *db2Backend) popFromRotationQueue() (*queue.Item, error) {
+	if b.credRotationQueue == nil {
+		return nil, errors.New("rotation queue is not initialized")
+	}
+	return b.credRotationQueue.Pop()
+}
+
+// popByKey wraps the internal queue's PopByKey call, to make sure a queue is
+// actually available.
+func (b *db2Backend) popByKey(name string) (*queue.Item, error) {
+	if b.credRotationQueue == nil {
+		return nil, errors.New("rotation queue is not initialized")
+	}
+	return b.credRotationQueue.PopByKey(name)
+}
+
+// walRollback reconciles a rotation that was interrupted before storage was
+// updated. Whichever of the old and new password authenticates is kept.
+// Returning nil discards the WAL entry.
+func (b *db2Backend) walRollback(ctx context.Context, req *logical.Request, kind string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case staticWALKey:
+		var wal setCredentialsWAL
+		if err := json.Unmarshal(raw, &wal); err != nil {
+			return err
+		}
+		return b.rollbackStaticRotation(ctx, req, &wal)
+	case rootWALKey:
+		var wal setRootCredentialsWAL
+		if err := json.Unmarshal(raw, &wal); err != nil {
+			return err
+		}
+		return b.rollbackRootRotation(ctx, req, &wal)
+	case jitGrantWALKey:
+		var wal jitGrantWAL
+		if err := json.Unmarshal(raw, &wal); err != nil {
+			return err
+		}
+		return b.rollbackJITGrant(ctx, req, &wal)
+	}
+	return fmt.Errorf("unknown WAL entry kind %q", kind)
+}
+
+// rollbackStaticRotation reconciles an interrupted static role rotation,
+// storing whichever of its passwords DB2 accepts. The role holds the old
+// password if Vault stopped before storing the new one, and the new one if
+// verification failed after DB2 accepted it. Its logins count towards the
+// role's circuit breaker, and after a failed attempt it backs off like a
+// failed rotation, so that a WAL entry retried by every rollback cannot
+// lock the account out.
+func (b *db2Backend) rollbackStaticRotation(ctx context.Context, req *logical.Request, wal *setCredentialsWAL) error {
+	lock := b.roleLock(wal.RoleName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := b.staticRole(ctx, req.Storage, wal.RoleName)
+	if err != nil {
+		return err
+	}
+
+	// The role was deleted, re-pointed at another user or already moved on
+	// from both passwords of this rotation; nothing to reconcile.
+	if role == nil || role.Username != wal.Username ||
+		(role.CurrentPassword != wal.OldPassword && role.CurrentPassword != wal.NewPassword) {
+		return nil
+	}
+
+	// the WAL entry is kept until the breaker closes or the backoff passes
+	if err := role.circuitError(wal.RoleName, b.now()); err != nil {
+		return err
+	}
+	if role.ConsecutiveFailures != 0 {
+		if retry := role.LastRotationAttempt.Add(rotationBackoff(role.ConsecutiveFailures)); b.now().Before(retry) {
+			return fmt.Errorf("recovery of role %q is backing off after %d failures until %s", wal.RoleName, role.ConsecutiveFailures, retry.Format(time.RFC3339))
+		}
+	}
+
+	config, err := getConnectionConfig(ctx, req.Storage, role.connectionName())
+	if err != nil {
+		return err
+	}
+	if config == nil {
+		return connectionUnsetError(role.connectionName())
+	}
+
+	db2Client, err := b.getClient(ctx, req.Storage, role.connectionName())
+	if err != nil {
+		return err
+	}
+	defer b.releaseClient(db2Client)
+
+	// recordAuth counts a login towards the role's circuit breaker
+	recordAuth := func(err error) {
+		if role.recordAuthResult(config, err, b.now()) {
+			b.Logger().Warn("authentication failures reached the lockout threshold, opening the circuit breaker", "role", wal.RoleName, "failures", role.AuthFailures, "until", role.CircuitOpenUntil)
+		}
+	}
+
+	// an expired password is still the one DB2 has
+	newErr := db2Client.Verify(ctx, config.connectionInfo(role.Database, role.Username, wal.NewPassword))
+	if newErr == nil || errors.Is(newErr, db2client.ErrPasswordExpired) {
+		b.Logger().Info("finalizing interrupted rotation", "role", wal.RoleName)
+		role.LastRotationAttempt = b.now()
+		role.LastRotationError = ""
+		role.ConsecutiveFailures = 0
+		role.resetCircuitBreaker()
+		if role.CurrentPassword != wal.NewPassword {
+			if err := role.setRotatedPassword(wal.NewPassword, b.now()); err != nil {
+				b.Logger().Warn("unable to compute next scheduled rotation", "role", wal.RoleName, "error", err)
+			}
+		}
+		if err := setRole(ctx, req.Storage, wal.RoleName, role); err != nil {
+			return err
+		}
+		event := &rotationEvent{
+			Time:     b.now(),
+			Trigger:  triggerRecovery,
+			Username: role.Username,
+			Success:  true,
+		}
+		b.recordRotationEvent(ctx, req.Storage, wal.RoleName, event)
+		b.notifyWebhooks(ctx, req.Storage, wal.RoleName, role, event)
+		return b.scheduleRotation(wal.RoleName, role)
+	}
+
+	recordAuth(newErr)
+	if role.circuitOpen(b.now()) {
+		if err := setRole(ctx, req.Storage, wal.RoleName, role); err != nil {
+			return err
+		}
+		return role.circuitError(wal.RoleName, b.now())
+	}
+
+	oldErr := db2Client.Verify(ctx, config.connectionInfo(role.Database, role.Username, wal.OldPassword))
+	recordAuth(oldErr)
+	if oldErr == nil || errors.Is(oldErr, db2client.ErrPasswordExpired) {
+		b.Logger().Info("discarding interrupted rotation, the old password is still current", "role", wal.RoleName)
+		if role.CurrentPassword == wal.NewPassword {
+			role.CurrentPassword = wal.OldPassword
+			if role.PreviousPassword == wal.OldPassword {
+				role.PreviousPassword = ""
+				role.PreviousVaultRotation = time.Time{}
+			}
+		}
+		return setRole(ctx, req.Storage, wal.RoleName, role)
+	}
+
+	err = fmt.Errorf("neither the old nor the new password authenticates for role %q: new password: %v, old password: %v", wal.RoleName, newErr, oldErr)
+	role.LastRotationAttempt = b.now()
+	role.LastRotationError = err.Error()
+	role.ConsecutiveFailures++
+	if err := setRole(ctx, req.Storage, wal.RoleName, role); err != nil {
+		return err
+	}
+	return err
+}
+
+// rollbackRootRotation reconciles an interrupted rotation of a connection's
+// administrative password, storing whichever password DB2 accepts.
+func (b *db2Backend) rollbackRootRotation(ctx context.Context, req *logical.Request, wal *setRootCredentialsWAL) error {
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	config, err := getConnectionConfig(ctx, req.Storage, wal.Connection)
+	if err != nil {
+		return err
+	}
+
+	// The connection was deleted, re-pointed at another user or given a
+	// password of its own since; nothing to reconcile.
+	if config == nil || config.Username != wal.Username ||
+		(config.Password != wal.OldPassword && config.Password != wal.NewPassword) {
+		return nil
+	}
+
+	db2Client, err := b.getClient(ctx, req.Storage, wal.Connection)
+	if err != nil {
+		return err
+	}
+	defer b.releaseClient(db2Client)
+
+	for _, password := range []string{wal.NewPassword, wal.OldPassword} {
+		err := db2Client.Verify(ctx, config.connectionInfo(config.Database, config.Username, password))
+		if err != nil && !errors.Is(err, db2client.ErrPasswordExpired) {
+			continue
+		}
+		if config.Password != password {
+			b.Logger().Info("reconciling interrupted root rotation", "connection", wal.Connection)
+			config.Password = password
+			if err := putConnectionConfig(ctx, req.Storage, wal.Connection, config); err != nil {
+				return err
+			}
+			b.reset(wal.Connection)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("neither the old nor the new administrative password authenticates for connection %q", wal.Connection)
+}
+
+// refusedError is a password change that was refused before it could take
+// effect, such as one the external command reported as failed.
+type refusedError struct {
+	err error
+}
+
+func (e *refusedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *refusedError) Unwrap() error {
+	return e.err
+}
+
+// changeRefused reports whether err shows that a password change was refused
+// outright, so the old password is still current. Timeouts, connection
+// errors and cancellations are not refusals, as DB2 may have applied the
+// change before the failure.
+func changeRefused(err error) bool {
+	var rotationErr *db2client.RotationError
+	if !errors.As(err, &rotationErr) || rotationErr.Phase != db2client.PhaseChange {
+		return false
+	}
+	var refused *refusedError
+	return errors.As(err, &refused) ||
+		errors.Is(err, db2client.ErrInvalidCredentials) ||
+		errors.Is(err, db2client.ErrNewPasswordInvalid) ||
+		errors.Is(err, db2client.ErrAccountLocked)
+}
+
+// deleteWAL removes a WAL entry, logging rather than failing because a
+// leftover entry is reconciled by walRollback.
+func (b *db2Backend) deleteWAL(ctx context.Context, s logical.Storage, walID string) {
+	if err := framework.DeleteWAL(ctx, s, walID); err != nil {
+		b.Logger().Warn("unable to delete WAL entry", "wal_id", walID, "error", err)
+	}
+}
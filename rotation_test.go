@@ -0,0 +1,541 @@
+package db2secretengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+
+	"vault-plugin-secrets-hashicups/db2client"
+)
+
+const (
+	testRotationRole     = "rotating"
+	testRotationUsername = "db2inst1"
+	testRotationPassword = "Initial!123"
+)
+
+// TestRotationSchedule drives the periodic function with a fake clock and
+// checks that a static role is rotated only once its period has elapsed.
+func TestRotationSchedule(t *testing.T) {
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	clock := withTestClock(b)
+	db.setPassword(testRotationUsername, testRotationPassword)
+
+	testRotationSetup(t, b, s, map[string]interface{}{
+		"rotation_period": "1h",
+	})
+
+	t.Run("never rotated role is due immediately", func(t *testing.T) {
+		testTick(t, b, s)
+		require.Equal(t, 1, db.rotations)
+
+		role, err := b.staticRole(context.Background(), s, testRotationRole)
+		require.NoError(t, err)
+		require.Equal(t, db.password(testRotationUsername), role.CurrentPassword)
+		require.Equal(t, clock.Now(), role.LastVaultRotation)
+	})
+
+	t.Run("role is not rotated before its period elapses", func(t *testing.T) {
+		clock.Add(30 * time.Minute)
+		testTick(t, b, s)
+		require.Equal(t, 1, db.rotations)
+	})
+
+	t.Run("role is rotated once its period elapses", func(t *testing.T) {
+		clock.Add(31 * time.Minute)
+		testTick(t, b, s)
+		require.Equal(t, 2, db.rotations)
+
+		item, err := b.popByKey(testRotationRole)
+		require.NoError(t, err)
+		require.Equal(t, clock.Now().Add(time.Hour).Unix(), item.Priority)
+	})
+}
+
+// TestRotationSchedule_Failure checks that a failed rotation is retried
+// after a short back-off rather than on every tick.
+func TestRotationSchedule_Failure(t *testing.T) {
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	clock := withTestClock(b)
+	db.setPassword(testRotationUsername, "changed-outside-vault")
+
+	testRotationSetup(t, b, s, map[string]interface{}{
+		"rotation_period": "1h",
+	})
+
+	testTick(t, b, s)
+	require.Equal(t, 0, db.rotations)
+
+	item, err := b.popByKey(testRotationRole)
+	require.NoError(t, err)
+	require.Equal(t, clock.Now().Add(rotationRetryBackoff).Unix(), item.Priority)
+}
+
+// TestRotationSchedule_Initialize checks that the rotation queue is rebuilt
+// from storage when the backend is initialized.
+func TestRotationSchedule_Initialize(t *testing.T) {
+	b, s := getTestBackend(t)
+	withFakeDB2(b)
+	withTestClock(b)
+
+	testRotationSetup(t, b, s, map[string]interface{}{
+		"rotation_period": "1h",
+	})
+	_, err := testTokenRoleCreate(t, b, s, "manual", map[string]interface{}{
+		"username":         "manual",
+		"current_password": testRotationPassword,
+		"password_policy":  testPasswordPolicy,
+		"database":         "sample",
+	})
+	require.NoError(t, err)
+
+	lvr := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	role, err := b.staticRole(context.Background(), s, testRotationRole)
+	require.NoError(t, err)
+	role.LastVaultRotation = lvr
+	require.NoError(t, setRole(context.Background(), s, testRotationRole, role))
+
+	restarted, _ := getTestBackend(t)
+	withTestClock(restarted)
+	require.NoError(t, restarted.Initialize(context.Background(), &logical.InitializationRequest{Storage: s}))
+	require.Equal(t, 1, restarted.credRotationQueue.Len())
+
+	item, err := restarted.popByKey(testRotationRole)
+	require.NoError(t, err)
+	require.NotNil(t, item)
+	require.Equal(t, lvr.Add(time.Hour).Unix(), item.Priority)
+}
+
+// TestRotationSchedule_RoleChanges checks that writing and deleting a role
+// keeps the rotation queue in step with storage.
+func TestRotationSchedule_RoleChanges(t *testing.T) {
+	b, s := getTestBackend(t)
+	withFakeDB2(b)
+	withTestClock(b)
+
+	resp, err := testTokenRoleCreate(t, b, s, testRotationRole, map[string]interface{}{
+		"username":         testRotationUsername,
+		"current_password": testRotationPassword,
+		"password_policy":  testPasswordPolicy,
+		"database":         "sample",
+		"rotation_period":  "10s",
+	})
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+
+	testRotationSetup(t, b, s, map[string]interface{}{
+		"rotation_period": "1h",
+	})
+	require.Equal(t, 1, b.credRotationQueue.Len())
+
+	testRotationRoleUpdate(t, b, s, map[string]interface{}{
+		"rotation_period": 0,
+	})
+	require.Equal(t, 0, b.credRotationQueue.Len())
+
+	testRotationRoleUpdate(t, b, s, map[string]interface{}{
+		"rotation_period": "2h",
+	})
+	require.Equal(t, 1, b.credRotationQueue.Len())
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      staticRolePath + testRotationRole,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+	require.Equal(t, 0, b.credRotationQueue.Len())
+}
+
+// testRotationSetup writes a config and a static role for rotation tests,
+// merging extra into the role data.
+func testRotationSetup(t *testing.T, b *db2Backend, s logical.Storage, extra map[string]interface{}) {
+	t.Helper()
+	require.NoError(t, testConfigCreate(t, b, s, map[string]interface{}{
+		"hostname": "localhost",
+		"port":     "50000",
+	}))
+
+	data := map[string]interface{}{
+		"username":         testRotationUsername,
+		"current_password": testRotationPassword,
+		"password_policy":  testPasswordPolicy,
+		"database":         "sample",
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+
+	resp, err := testTokenRoleCreate(t, b, s, testRotationRole, data)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+}
+
+// testRotationRoleUpdate updates the rotation test role.
+func testRotationRoleUpdate(t *testing.T, b *db2Backend, s logical.Storage, d map[string]interface{}) {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      staticRolePath + testRotationRole,
+		Data:      d,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+}
+
+// testTick invokes the backend's periodic function the way Vault does.
+func testTick(t *testing.T, b *db2Backend, s logical.Storage) {
+	t.Helper()
+	_, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RollbackOperation,
+		Path:      "",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+}
+
+// TestRotationWAL checks that an interrupted rotation is recovered from its
+// WAL entry by testing which password DB2 actually accepts.
+func TestRotationWAL(t *testing.T) {
+	ctx := context.Background()
+
+	tests := map[string]struct {
+		db2Password  string
+		wantPassword string
+		wantWAL      bool
+	}{
+		"new password is finalized": {
+			db2Password:  "New!Password1",
+			wantPassword: "New!Password1",
+		},
+		"old password is kept": {
+			db2Password:  testRotationPassword,
+			wantPassword: testRotationPassword,
+		},
+		"neither password works": {
+			db2Password:  "changed-outside-vault",
+			wantPassword: testRotationPassword,
+			wantWAL:      true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, s := getTestBackend(t)
+			db := withFakeDB2(b)
+			withTestClock(b)
+			testRotationSetup(t, b, s, nil)
+
+			_, err := framework.PutWAL(ctx, s, staticWALKey, &setCredentialsWAL{
+				RoleName:    testRotationRole,
+				Username:    testRotationUsername,
+				OldPassword: testRotationPassword,
+				NewPassword: "New!Password1",
+			})
+			require.NoError(t, err)
+			db.setPassword(testRotationUsername, tc.db2Password)
+
+			testWALRollback(t, b, s)
+
+			role, err := b.staticRole(ctx, s, testRotationRole)
+			require.NoError(t, err)
+			require.Equal(t, tc.wantPassword, role.CurrentPassword)
+
+			wals, err := framework.ListWAL(ctx, s)
+			require.NoError(t, err)
+			require.Equal(t, tc.wantWAL, len(wals) == 1)
+		})
+	}
+}
+
+// TestRotationWAL_Lifecycle checks which rotation outcomes leave a WAL entry
+// behind for reconciliation.
+func TestRotationWAL_Lifecycle(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	clock := withTestClock(b)
+	db.setPassword(testRotationUsername, testRotationPassword)
+	testRotationSetup(t, b, s, nil)
+
+	_, err := testRotateRole(t, b, s, testRotationRole)
+	require.NoError(t, err)
+	wals, err := framework.ListWAL(ctx, s)
+	require.NoError(t, err)
+	require.Empty(t, wals)
+
+	// DB2 refusing the current password leaves nothing to reconcile
+	db.setPassword(testRotationUsername, "changed-outside-vault")
+	_, err = testRotateRole(t, b, s, testRotationRole)
+	require.Error(t, err)
+	wals, err = framework.ListWAL(ctx, s)
+	require.NoError(t, err)
+	require.Empty(t, wals)
+
+	// a dropped connection may have changed the password
+	role, err := b.staticRole(ctx, s, testRotationRole)
+	require.NoError(t, err)
+	db.setPassword(testRotationUsername, role.CurrentPassword)
+	db.failPhase = db2client.PhaseChange
+	_, err = testRotateRole(t, b, s, testRotationRole)
+	require.Error(t, err)
+	wals, err = framework.ListWAL(ctx, s)
+	require.NoError(t, err)
+	require.Len(t, wals, 1)
+	clock.Add(time.Minute)
+	testWALRollback(t, b, s)
+	wals, err = framework.ListWAL(ctx, s)
+	require.NoError(t, err)
+	require.Empty(t, wals)
+
+	db.failPhase = db2client.PhaseVerifyNew
+	_, err = testRotateRole(t, b, s, testRotationRole)
+	require.Error(t, err)
+	wals, err = framework.ListWAL(ctx, s)
+	require.NoError(t, err)
+	require.Len(t, wals, 1)
+
+	// the password was changed in DB2 before verification failed, so the
+	// rollback adopts it
+	db.failPhase = ""
+	clock.Add(time.Minute)
+	testWALRollback(t, b, s)
+
+	role, err = b.staticRole(ctx, s, testRotationRole)
+	require.NoError(t, err)
+	require.Equal(t, db.password(testRotationUsername), role.CurrentPassword)
+	wals, err = framework.ListWAL(ctx, s)
+	require.NoError(t, err)
+	require.Empty(t, wals)
+}
+
+// TestRotationWAL_Backoff checks that recovering an interrupted rotation
+// counts its logins towards the circuit breaker and backs off between
+// failed attempts.
+func TestRotationWAL_Backoff(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	clock := withTestClock(b)
+	testRotationSetup(t, b, s, nil)
+	require.NoError(t, testConfigUpdate(t, b, s, map[string]interface{}{
+		"lockout_threshold": 3,
+	}))
+
+	_, err := framework.PutWAL(ctx, s, staticWALKey, &setCredentialsWAL{
+		RoleName:    testRotationRole,
+		Username:    testRotationUsername,
+		OldPassword: testRotationPassword,
+		NewPassword: "New!Password1",
+	})
+	require.NoError(t, err)
+	db.setPassword(testRotationUsername, "changed-outside-vault")
+
+	// rollback runs the WAL rollback and returns the role and WAL entries
+	// left after it
+	rollback := func(t *testing.T) (*db2RoleEntry, []string) {
+		t.Helper()
+		testWALRollback(t, b, s)
+		role, err := b.staticRole(ctx, s, testRotationRole)
+		require.NoError(t, err)
+		wals, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		return role, wals
+	}
+
+	role, wals := rollback(t)
+	require.Len(t, wals, 1)
+	require.Equal(t, 2, role.AuthFailures)
+	require.Equal(t, 1, role.ConsecutiveFailures)
+
+	// too soon after the failure, nothing is tried
+	role, wals = rollback(t)
+	require.Len(t, wals, 1)
+	require.Equal(t, 2, role.AuthFailures)
+
+	// the next failed login reaches the threshold and opens the breaker
+	clock.Add(rotationBackoff(1))
+	role, wals = rollback(t)
+	require.Len(t, wals, 1)
+	require.Equal(t, 3, role.AuthFailures)
+	require.True(t, role.circuitOpen(clock.Now()))
+
+	db.setPassword(testRotationUsername, "New!Password1")
+	clock.Add(time.Minute)
+	role, wals = rollback(t)
+	require.Len(t, wals, 1)
+	require.Equal(t, testRotationPassword, role.CurrentPassword)
+
+	clock.Add(defaultLockoutCooldown)
+	role, wals = rollback(t)
+	require.Empty(t, wals)
+	require.Equal(t, "New!Password1", role.CurrentPassword)
+	require.Zero(t, role.AuthFailures)
+	require.Zero(t, role.ConsecutiveFailures)
+}
+
+// testWALRollback runs the WAL rollback regardless of entry age.
+func testWALRollback(t *testing.T, b *db2Backend, s logical.Storage) {
+	t.Helper()
+	_, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RollbackOperation,
+		Path:      "",
+		Storage:   s,
+		Data:      map[string]interface{}{"immediate": true},
+	})
+	require.NoError(t, err)
+}
+
+// TestRotationBackoff checks that consecutive failures are recorded on the
+// role, delay the next attempt exponentially, and can be cleared.
+func TestRotationBackoff(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	clock := withTestClock(b)
+	db.setPassword(testRotationUsername, "changed-outside-vault")
+
+	testRotationSetup(t, b, s, map[string]interface{}{
+		"rotation_period": "24h",
+	})
+
+	for failures, backoff := range map[int]time.Duration{
+		1: 10 * time.Second,
+		2: 20 * time.Second,
+		3: 40 * time.Second,
+	} {
+		require.Equal(t, backoff, rotationBackoff(failures))
+	}
+	require.Equal(t, maxRotationRetryBackoff, rotationBackoff(100))
+
+	testTick(t, b, s)
+	testTick(t, b, s)
+	clock.Add(10 * time.Second)
+	testTick(t, b, s)
+	clock.Add(10 * time.Second)
+	testTick(t, b, s)
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      staticRolePath + testRotationRole,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, resp.Data["consecutive_failures"])
+	require.Contains(t, resp.Data["last_rotation_error"], "SQL30082N")
+	require.Equal(t, clock.Now().Add(-10*time.Second), resp.Data["last_rotation_attempt"])
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      staticRolePath + testRotationRole + "/rotation-status",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, clock.Now().Add(10*time.Second), resp.Data["next_rotation_attempt"])
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      staticRolePath + testRotationRole + "/rotation-status",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	role, err := b.staticRole(ctx, s, testRotationRole)
+	require.NoError(t, err)
+	require.Zero(t, role.ConsecutiveFailures)
+	require.Empty(t, role.LastRotationError)
+
+	db.setPassword(testRotationUsername, testRotationPassword)
+	testTick(t, b, s)
+	require.Equal(t, 1, db.rotations)
+}
+
+// TestRotationSchedule_Cron checks that a role with a cron schedule is only
+// rotated inside its rotation window, in its own timezone.
+func TestRotationSchedule_Cron(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	db := withFakeDB2(b)
+	clock := withTestClock(b)
+	db.setPassword(testRotationUsername, testRotationPassword)
+
+	// Sundays 02:00-04:00 in Berlin, which is 00:00-02:00 UTC in August
+	testRotationSetup(t, b, s, map[string]interface{}{
+		"rotation_schedule": "0 2 * * SUN",
+		"rotation_window":   "2h",
+		"rotation_timezone": "Europe/Berlin",
+	})
+
+	firstWindow := time.Date(2021, 8, 8, 0, 0, 0, 0, time.UTC)
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      staticCredPath + testRotationRole,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.True(t, firstWindow.Equal(resp.Data["next_vault_rotation"].(time.Time)))
+
+	t.Run("not rotated before the window opens", func(t *testing.T) {
+		testTick(t, b, s)
+		require.Equal(t, 0, db.rotations)
+	})
+
+	t.Run("rotated inside the window", func(t *testing.T) {
+		clock.Add(firstWindow.Sub(clock.Now()) + 30*time.Minute)
+		testTick(t, b, s)
+		require.Equal(t, 1, db.rotations)
+
+		role, err := b.staticRole(ctx, s, testRotationRole)
+		require.NoError(t, err)
+		require.True(t, firstWindow.AddDate(0, 0, 7).Equal(role.NextVaultRotation))
+	})
+
+	t.Run("missed window waits for the next one", func(t *testing.T) {
+		clock.Add(7*24*time.Hour + 3*time.Hour)
+		testTick(t, b, s)
+		require.Equal(t, 1, db.rotations)
+
+		role, err := b.staticRole(ctx, s, testRotationRole)
+		require.NoError(t, err)
+		require.True(t, firstWindow.AddDate(0, 0, 14).Equal(role.NextVaultRotation))
+	})
+}
+
+// TestRotationSchedule_CronValidation checks the rotation schedule fields are
+// validated on role write.
+func TestRotationSchedule_CronValidation(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	for name, extra := range map[string]map[string]interface{}{
+		"period and schedule":     {"rotation_period": "1h", "rotation_schedule": "0 2 * * SUN"},
+		"window without schedule": {"rotation_window": "2h"},
+		"window too short":        {"rotation_schedule": "0 2 * * SUN", "rotation_window": "10m"},
+		"invalid schedule":        {"rotation_schedule": "every sunday"},
+		"invalid timezone":        {"rotation_schedule": "0 2 * * SUN", "rotation_timezone": "Mars/Olympus_Mons"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data := map[string]interface{}{
+				"username":         testRotationUsername,
+				"current_password": testRotationPassword,
+				"password_policy":  testPasswordPolicy,
+				"database":         "sample",
+			}
+			for k, v := range extra {
+				data[k] = v
+			}
+
+			resp, err := testTokenRoleCreate(t, b, s, testRotationRole, data)
+			require.NoError(t, err)
+			require.True(t, resp.IsError())
+		})
+	}
+}
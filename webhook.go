@@ -0,0 +1,158 @@
+package db2secretengine
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// webhookSignatureHeader carries the hex encoded HMAC-SHA256 of the
+	// request body, keyed with the webhook's secret and prefixed "sha256=".
+	webhookSignatureHeader = "X-Vault-DB2-Signature"
+
+	// webhookAttempts is the number of times an event is posted to a
+	// webhook before it is dropped. The wait between attempts starts at
+	// webhookRetryBackoff and doubles after each failure.
+	webhookAttempts     = 5
+	webhookRetryBackoff = time.Second
+
+	webhookTimeout = 10 * time.Second
+)
+
+// webhookEvent is the JSON body posted to webhooks after a rotation attempt.
+// It never holds a password.
+type webhookEvent struct {
+	ID            string    `json:"id"`
+	Type          string    `json:"type"`
+	Role          string    `json:"role"`
+	Username      string    `json:"username"`
+	Database      string    `json:"database"`
+	Trigger       string    `json:"trigger"`
+	Success       bool      `json:"success"`
+	ErrorCategory string    `json:"error_category,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// webhookStatusError is returned when a webhook responds with a status
+// other than 2xx.
+type webhookStatusError struct {
+	StatusCode int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("webhook responded with status %d", e.StatusCode)
+}
+
+// retryable reports whether the request may succeed if sent again.
+func (e *webhookStatusError) retryable() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// notifyWebhooks posts a rotation event to every configured webhook. The
+// webhooks are read from s before returning, but delivery happens in the
+// background so that a slow or unavailable receiver never holds up a
+// rotation or the role lock.
+func (b *db2Backend) notifyWebhooks(ctx context.Context, s logical.Storage, name string, role *db2RoleEntry, rotation *rotationEvent) {
+	webhooks, err := getWebhooks(ctx, s)
+	if err != nil {
+		b.Logger().Warn("unable to read webhooks", "role", name, "error", err)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		b.Logger().Warn("unable to generate webhook event id", "role", name, "error", err)
+		return
+	}
+	body, err := json.Marshal(&webhookEvent{
+		ID:            id,
+		Type:          "rotation",
+		Role:          name,
+		Username:      role.Username,
+		Database:      role.Database,
+		Trigger:       rotation.Trigger,
+		Success:       rotation.Success,
+		ErrorCategory: rotation.ErrorCategory,
+		Timestamp:     rotation.Time,
+	})
+	if err != nil {
+		b.Logger().Warn("unable to encode webhook event", "role", name, "error", err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		b.webhooks.Add(1)
+		go func(webhook *webhookConfig) {
+			defer b.webhooks.Done()
+			b.deliverWebhook(webhook, body)
+		}(webhook)
+	}
+}
+
+// deliverWebhook posts body to webhook, retrying with backoff until it is
+// accepted, a non-retryable status is returned, webhookAttempts is reached
+// or the backend is cleaned up.
+func (b *db2Backend) deliverWebhook(webhook *webhookConfig, body []byte) {
+	backoff := b.webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err := b.postWebhook(b.webhookCtx, webhook, body)
+		if err == nil {
+			return
+		}
+
+		statusErr, ok := err.(*webhookStatusError)
+		if attempt == webhookAttempts || (ok && !statusErr.retryable()) {
+			b.Logger().Warn("unable to deliver webhook event", "url", webhook.URL, "attempts", attempt, "error", err)
+			return
+		}
+
+		select {
+		case <-b.webhookCtx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (b *db2Backend) postWebhook(ctx context.Context, webhook *webhookConfig, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeader, signWebhook(webhook.Secret, body))
+
+	resp, err := b.webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &webhookStatusError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// signWebhook returns the value of the webhookSignatureHeader for body.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}